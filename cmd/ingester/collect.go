@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/kiquetal/go-duckdb-ingester/internal/prometheus"
+	"github.com/kiquetal/go-duckdb-ingester/internal/storage"
+	"github.com/kiquetal/go-duckdb-ingester/internal/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// jobSpec describes how a proxyJob is collected: the API proxies it queries
+// and the names it is logged, checkpointed and counted under
+type jobSpec struct {
+	// name qualifies errors, e.g. orders, eu/orders or eu/combined
+	name string
+
+	// checkpoint is the job's key in the checkpoint file
+	checkpoint string
+
+	// proxy is the api_proxy label of the telemetry recorded for writes
+	proxy string
+
+	// app is the app= partition of the job's files, empty when its API
+	// proxies are combined into one file
+	app string
+
+	apiProxies []string
+	logger     *slog.Logger
+}
+
+// combined reports whether the job writes several API proxies into one file
+func (s jobSpec) combined() bool {
+	return s.app == ""
+}
+
+// proxyLogger returns logger naming apiProxy, which the logger of a
+// single-proxy job already does
+func (s jobSpec) proxyLogger(logger *slog.Logger, apiProxy string) *slog.Logger {
+	if !s.combined() {
+		return logger
+	}
+	return logger.With("api_proxy", apiProxy)
+}
+
+// proxyErr qualifies an error of one API proxy of a combined job with its name
+func (s jobSpec) proxyErr(apiProxy string, err error) error {
+	if !s.combined() {
+		return err
+	}
+	return fmt.Errorf("%s: %w", apiProxy, err)
+}
+
+// collectProxy collects and stores the metrics of one API proxy, either as a
+// single instant collection or as a sequence of range batches
+func (c *cycle) collectProxy(ctx context.Context, job proxyJob) proxyResult {
+	// Qualify the proxy with its source in errors when collecting from several servers
+	name := job.apiProxy
+	logger := slog.With("api_proxy", job.apiProxy)
+	if job.source != "" {
+		name = job.source + "/" + job.apiProxy
+		logger = logger.With("source", job.source)
+	}
+
+	var res proxyResult
+	proxyStartTime := time.Now()
+	ctx, span := telemetry.StartSpan(ctx, "collect_proxy", attribute.String("api_proxy", job.apiProxy), attribute.String("source", job.source))
+	defer func() {
+		logger.Info("Finished API proxy", "duration", time.Since(proxyStartTime),
+			"succeeded", res.succeeded, "failed", len(res.errs))
+		telemetry.EndSpan(span, errors.Join(res.errs...), attribute.Int("succeeded", res.succeeded))
+	}()
+
+	res = c.collectJob(ctx, job, jobSpec{
+		name:       name,
+		checkpoint: name,
+		proxy:      job.apiProxy,
+		app:        job.apiProxy,
+		apiProxies: []string{job.apiProxy},
+		logger:     logger,
+	})
+	return res
+}
+
+// collectCombined collects every API proxy from one source and writes each
+// window (the instant collection or a range batch) into a single file. A
+// window in which any proxy fails is not written, and its range batch stays
+// pending in the checkpoint so the next run collects it again whole.
+func (c *cycle) collectCombined(ctx context.Context, job proxyJob) proxyResult {
+	logger := slog.With("api_proxies", job.apiProxies)
+	name, checkpointJob := "combined", combinedCheckpointJob
+	if job.source != "" {
+		logger = logger.With("source", job.source)
+		name = job.source + "/combined"
+		checkpointJob = job.source + "/" + combinedCheckpointJob
+	}
+
+	var res proxyResult
+	ctx, span := telemetry.StartSpan(ctx, "collect_combined", attribute.StringSlice("api_proxies", job.apiProxies),
+		attribute.String("source", job.source))
+	defer func() {
+		telemetry.EndSpan(span, errors.Join(res.errs...), attribute.Int("succeeded", res.succeeded))
+	}()
+
+	res = c.collectJob(ctx, job, jobSpec{
+		name:       name,
+		checkpoint: checkpointJob,
+		proxy:      combinedProxyLabel,
+		apiProxies: job.apiProxies,
+		logger:     logger,
+	})
+	return res
+}
+
+// collectJob collects the windows of a job: the instant collection, or the
+// range batches not completed by a previous run
+func (c *cycle) collectJob(ctx context.Context, job proxyJob, spec jobSpec) proxyResult {
+	cfg := c.cfg
+	logger := spec.logger
+	var res proxyResult
+
+	if cfg.DryRun {
+		for _, apiProxy := range spec.apiProxies {
+			proxyLogger := spec.proxyLogger(logger, apiProxy)
+			queries, err := job.client.ResolveQueries(apiProxy)
+			if err != nil {
+				proxyLogger.Error("[dry-run] Error resolving queries", "error", err)
+				c.fail(&res, fmt.Errorf("%s: %w", spec.name, spec.proxyErr(apiProxy, err)))
+				return res
+			}
+			for _, q := range queries {
+				proxyLogger.Info("[dry-run] Resolved query", "metric", q.Name, "query", q.Query)
+			}
+		}
+	}
+
+	// An instant collection is a single window partitioned by the cycle date.
+	// Only range batches advance the checkpoint.
+	windows := []prometheus.TimeRange{{}}
+	var resumed time.Time
+	var batches *batchTracker
+	var backfill *backfillProgress
+	if cfg.Prometheus.UseRangeQuery && !cfg.StartTime.IsZero() && !cfg.EndTime.IsZero() {
+		logger.Info("Processing metrics using range query",
+			"start", cfg.StartTime, "end", cfg.EndTime, "step", cfg.Prometheus.RangeStep)
+		windows = batchWindows(cfg)
+		// Batches before this were completed by a previous run
+		resumed = c.progress.CompletedThrough(spec.checkpoint, cfg.StartTime, cfg.EndTime)
+		batches = c.batchTracker(spec.checkpoint, resumed)
+		backfill = newBackfillProgress(logger, spec.name, len(windows))
+	} else {
+		logger.Debug("Collecting metrics using instant query")
+	}
+
+	writer := c.newBatchWriter(ctx, batches, spec.proxy)
+	processed := 0
+	for _, window := range windows {
+		if ctx.Err() != nil {
+			logger.Warn("Collection interrupted, aborting remaining batches")
+			break
+		}
+		backfill.report(processed)
+		processed++
+
+		if batches != nil && !window.End.After(resumed) {
+			logger.Info("Skipping batch completed by a previous run", "batch_start", window.Start, "batch_end", window.End)
+			continue
+		}
+		if !c.collectWindow(ctx, job, spec, window, batches, writer, &res) {
+			break
+		}
+	}
+	res.merge(writer.wait())
+	backfill.report(processed)
+	return res
+}
+
+// collectWindow collects the API proxies of a job for one window, the instant
+// collection when window is zero or a range batch, and hands their metrics to
+// writer. Failures are recorded in res. It returns false when the cycle was
+// interrupted before every API proxy was collected.
+func (c *cycle) collectWindow(ctx context.Context, job proxyJob, spec jobSpec, window prometheus.TimeRange, batches *batchTracker, writer *batchWriter, res *proxyResult) bool {
+	cfg := c.cfg
+	useRange := !window.Start.IsZero()
+
+	// Each batch gets its own file, partitioned by the day the batch starts on,
+	// so a query spanning several days is stored in the correct folder
+	pathData := storage.PathData{
+		Year:   c.year,
+		Month:  c.month,
+		Day:    c.day,
+		App:    spec.app,
+		Source: job.source,
+		RunID:  c.runID,
+	}
+	logger := spec.logger
+	wrap := func(err error) error { return fmt.Errorf("%s: %w", spec.name, err) }
+	if useRange {
+		c.setBatch(&pathData, window.Start, window.End)
+		logger = logger.With("batch_start", window.Start, "batch_end", window.End)
+		wrap = func(err error) error {
+			return fmt.Errorf("%s batch %s: %w", spec.name, window.Start.Format(time.RFC3339), err)
+		}
+		logger.Debug("Collecting batch")
+	}
+
+	if cfg.DryRun {
+		targets, err := outputPaths(c.paths, pathData, c.metricsFor(spec.app))
+		if useRange {
+			targets, err = c.batchOutputs(pathData)
+		}
+		if err != nil {
+			logger.Error("[dry-run] Error rendering output path", "error", err)
+			c.fail(res, wrap(err))
+			return true
+		}
+		logger.Info("[dry-run] Would collect metrics", "paths", targets)
+		res.succeeded++
+		return true
+	}
+
+	if useRange && c.batchWritten(ctx, logger, pathData) {
+		batches.complete(logger, window.Start, window.End)
+		c.partitionsSkipped(pathData)
+		return true
+	}
+
+	// Streaming is limited to range batches of a single API proxy
+	if useRange && c.cfg.Storage.Streaming {
+		c.streamBatch(ctx, job, spec, window, pathData, logger, wrap, batches, res)
+		return true
+	}
+
+	// Accumulate every API proxy's metrics for this window
+	var metrics []prometheus.MetricResult
+	collected := 0
+	for _, apiProxy := range spec.apiProxies {
+		if ctx.Err() != nil {
+			break
+		}
+		proxyLogger := spec.proxyLogger(logger, apiProxy)
+
+		queryStartTime := time.Now()
+		var proxyMetrics []prometheus.MetricResult
+		var err error
+		if useRange {
+			proxyMetrics, err = job.client.CollectMetricsRange(ctx, apiProxy, window)
+			telemetry.ObserveQuery("range", time.Since(queryStartTime))
+		} else {
+			proxyMetrics, err = job.client.CollectMetrics(ctx, apiProxy, cfg.EvaluationTime)
+			telemetry.ObserveQuery("instant", time.Since(queryStartTime))
+		}
+		queryDuration := time.Since(queryStartTime)
+		res.queryDuration += queryDuration
+
+		if err != nil {
+			proxyLogger.Error("Error collecting metrics", "error", err)
+			telemetry.IncQueryErrors(apiProxy)
+			c.fail(res, wrap(spec.proxyErr(apiProxy, err)))
+			c.partitionFailed(pathData)
+			continue
+		}
+		proxyLogger.Debug("Prometheus query finished", "rows", len(proxyMetrics), "duration", queryDuration)
+		metrics = append(metrics, proxyMetrics...)
+		collected++
+	}
+
+	// An interrupted window would be written without the API proxies not yet collected
+	if ctx.Err() != nil {
+		logger.Warn("Collection interrupted, aborting remaining batches")
+		return false
+	}
+	// A window missing an API proxy is neither written nor checkpointed, so
+	// it is retried whole; the errors are already recorded
+	if collected < len(spec.apiProxies) {
+		return true
+	}
+
+	metrics, err := c.process(logger, metrics)
+	if err != nil {
+		logger.Error("Error processing metrics", "error", err)
+		c.fail(res, wrap(err))
+		c.partitionFailed(pathData)
+		return true
+	}
+
+	if len(metrics) == 0 {
+		logger.Info("No metrics found")
+		c.completeEmpty(ctx, logger, spec.proxy, window, pathData, wrap, batches, res)
+		return true
+	}
+
+	// Rollups summarize the raw samples, so take them before downsampling
+	var rollups []prometheus.MetricResult
+	if useRange && c.rollups != nil {
+		rollups = prometheus.Rollup(metrics, window)
+	}
+
+	if useRange && cfg.Downsample.Interval > 0 {
+		raw := len(metrics)
+		metrics, err = prometheus.Downsample(metrics, cfg.Downsample.Interval, cfg.Downsample.Function)
+		if err != nil {
+			logger.Error("Error downsampling metrics", "error", err)
+			c.fail(res, wrap(err))
+			c.partitionFailed(pathData)
+			return true
+		}
+		logger.Debug("Downsampled metrics", "raw_rows", raw, "rows", len(metrics))
+	}
+
+	// A failed write is recorded and the next batch is still collected
+	writer.write(ctx, queriedBatch{
+		logger:  logger,
+		window:  window,
+		data:    pathData,
+		metrics: metrics,
+		rollups: rollups,
+		wrap:    wrap,
+	})
+	return true
+}
+
+// streamBatch streams the rows of a single-proxy range batch to storage as
+// each query returns instead of buffering the batch
+func (c *cycle) streamBatch(ctx context.Context, job proxyJob, spec jobSpec, window prometheus.TimeRange, pathData storage.PathData,
+	logger *slog.Logger, wrap func(error) error, batches *batchTracker, res *proxyResult) {
+	apiProxy := spec.apiProxies[0]
+	batchFilename, err := c.paths.Render(pathData)
+	if err != nil {
+		logger.Error("Error rendering output path", "error", err)
+		c.fail(res, wrap(err))
+		c.partitionFailed(pathData)
+		return
+	}
+
+	streamStartTime := time.Now()
+	batchCtx, cancelBatch := context.WithCancel(ctx)
+	batchCtx, span := telemetry.StartSpan(batchCtx, "storage.write_stream", attribute.String("path", batchFilename),
+		attribute.String("batch_start", window.Start.Format(time.RFC3339)), attribute.String("batch_end", window.End.Format(time.RFC3339)))
+	results, errs := job.client.CollectMetricsRangeStream(batchCtx, apiProxy, window)
+	rows, err := c.store.StoreMetricsStream(batchCtx, results, errs, batchFilename)
+	telemetry.EndSpan(span, err, attribute.Int("rows", rows))
+	cancelBatch()
+	streamDuration := time.Since(streamStartTime)
+	telemetry.ObserveQuery("range", streamDuration)
+	res.queryDuration += streamDuration
+
+	if err != nil {
+		logger.Error("Error collecting or storing metrics", "duration", streamDuration, "error", err)
+		// Query and write failures are indistinguishable when streaming
+		telemetry.IncStorageErrors(apiProxy)
+		c.fail(res, wrap(err))
+		c.partitionFailed(pathData)
+		return
+	}
+
+	if rows == 0 {
+		// The empty stream's file was removed
+		logger.Info("No metrics found in this batch")
+		c.completeEmpty(ctx, logger, apiProxy, window, pathData, wrap, batches, res)
+		return
+	}
+	res.succeeded++
+	res.rows += rows
+	batches.complete(logger, window.Start, window.End)
+	telemetry.AddRowsWritten(apiProxy, rows)
+	c.partitionsWritten(pathData, []string{batchFilename})
+
+	logger.Info("Successfully streamed metrics", "path", batchFilename, "rows", rows, "duration", streamDuration)
+}
+
+// completeEmpty records a window that returned no metrics as collected. A
+// range batch stores empty outputs first, so the next run skips it instead of
+// querying it again.
+func (c *cycle) completeEmpty(ctx context.Context, logger *slog.Logger, proxy string, window prometheus.TimeRange, pathData storage.PathData,
+	wrap func(error) error, batches *batchTracker, res *proxyResult) {
+	empty, err := c.storeEmpty(ctx, logger, pathData, nil)
+	if err != nil {
+		logger.Error("Error storing empty outputs", "error", err)
+		telemetry.IncStorageErrors(proxy)
+		c.fail(res, wrap(err))
+		c.partitionFailed(pathData)
+		return
+	}
+	c.partitionsWritten(pathData, empty)
+	res.succeeded++
+	batches.complete(logger, window.Start, window.End)
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/kiquetal/go-duckdb-ingester/internal/prometheus"
+	"github.com/kiquetal/go-duckdb-ingester/internal/storage"
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+// usage prints the available subcommands
+func usage(w io.Writer) {
+	fmt.Fprint(w, `Usage: ingester [command] [flags]
+
+Commands:
+  collect          Collect metrics periodically, or once with --once (default)
+  backfill         Collect a fixed time range in batches and exit
+  validate-config  Load and validate the configuration and print it with defaults applied
+  compact          Merge the Parquet files of partition directories into one file each
+  inspect          Print the schema, row groups and first rows of Parquet files
+  version          Print the version, commit and build date (also --version)
+  help             Show this help
+
+Run "ingester <command> -h" for the flags of a command.
+`)
+}
+
+// configPaths is the value of the --config flag, which may be repeated or
+// hold a comma-separated list of files, directories and URLs to merge
+type configPaths []string
+
+func (p *configPaths) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *configPaths) Set(value string) error {
+	for _, path := range strings.Split(value, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			*p = append(*p, path)
+		}
+	}
+	return nil
+}
+
+// newFlagSet creates the flag set of a subcommand with a --config flag. Parse
+// it with parseFlags, which applies the default configuration path.
+func newFlagSet(name string) (*flag.FlagSet, *configPaths) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	paths := new(configPaths)
+	fs.Var(paths, "config", "Configuration `path`: a file, a directory of *.yaml files or an http(s) URL; .gz files are decompressed (default config.yaml). "+
+		"Repeat the flag or separate paths with commas to merge several; later ones override earlier ones.")
+	return fs, paths
+}
+
+// parseFlags parses args, defaulting --config to config.yaml
+func parseFlags(fs *flag.FlagSet, paths *configPaths, args []string) {
+	fs.Parse(args)
+	if len(*paths) == 0 {
+		*paths = configPaths{"config.yaml"}
+	}
+}
+
+// metricsFileUsage describes the --metrics-file flag of collect and backfill
+const metricsFileUsage = "YAML `file` with a list of metric entries, as under prometheus.metrics, collected in addition to the configured metrics"
+
+// skipPrometheusCheckUsage describes the --skip-prometheus-check flag of
+// collect and backfill
+const skipPrometheusCheckUsage = "Start without checking that Prometheus answers a test query, e.g. for offline testing"
+
+// runCollect runs the collect command. Its flags are the ones the ingester
+// accepted before subcommands were introduced.
+func runCollect(args []string) int {
+	fs, configFiles := newFlagSet("collect")
+	var overrides flagOverrides
+	fs.StringVar(&overrides.startTime, "start", "", "Start time for range query (RFC3339 format, e.g., 2025-04-07T00:00:00Z)")
+	fs.StringVar(&overrides.endTime, "end", "", "End time for range query (RFC3339 format, e.g., 2025-04-08T00:00:00Z)")
+	fs.BoolVar(&overrides.useRangeQuery, "range", false, "Use range query instead of instant query")
+	fs.BoolVar(&overrides.runOnce, "once", false, "Run a single collection and exit (non-zero exit status on failure)")
+	fs.StringVar(&overrides.atTime, "at", "", "Evaluate instant queries at this time instead of now and exit after one collection (RFC3339 format)")
+	noResume := fs.Bool("no-resume", false, "Ignore the checkpoint file and re-run every batch of a range backfill")
+	fs.BoolVar(&overrides.failFast, "fail-fast", false, "Abort the collection at the first query or storage error instead of continuing")
+	fs.BoolVar(&overrides.dryRun, "dry-run", false, "Log the queries, batches and output paths that would be used, then exit without querying or writing")
+	listMetrics := fs.Bool("list-metrics", false, "Print every metric query resolved for each API proxy, then exit without querying")
+	fs.StringVar(&overrides.metricsFile, "metrics-file", "", metricsFileUsage)
+	fs.BoolVar(&overrides.skipPrometheusCheck, "skip-prometheus-check", false, skipPrometheusCheckUsage)
+	parseFlags(fs, configFiles, args)
+
+	if *listMetrics {
+		return listQueries(*configFiles, overrides.metricsFile)
+	}
+	return collect(*configFiles, overrides, *noResume)
+}
+
+// runBackfill runs the backfill command: a single range collection of
+// [--start, --end) split into prometheus.batchDuration batches
+func runBackfill(args []string) int {
+	fs, configFiles := newFlagSet("backfill")
+	var overrides flagOverrides
+	fs.StringVar(&overrides.startTime, "start", "", "Start of the range to backfill (RFC3339 format, required)")
+	fs.StringVar(&overrides.endTime, "end", "", "End of the range to backfill (RFC3339 format, required)")
+	noResume := fs.Bool("no-resume", false, "Ignore the checkpoint file and re-run every batch")
+	fs.BoolVar(&overrides.failFast, "fail-fast", false, "Abort the backfill at the first query or storage error instead of continuing")
+	fs.BoolVar(&overrides.dryRun, "dry-run", false, "Log the batches and output paths that would be used, then exit without querying or writing")
+	fs.StringVar(&overrides.metricsFile, "metrics-file", "", metricsFileUsage)
+	fs.BoolVar(&overrides.skipPrometheusCheck, "skip-prometheus-check", false, skipPrometheusCheckUsage)
+	parseFlags(fs, configFiles, args)
+
+	if overrides.startTime == "" || overrides.endTime == "" {
+		fmt.Fprintln(os.Stderr, "backfill requires --start and --end")
+		fs.Usage()
+		return 2
+	}
+
+	// A fixed range is collected once
+	overrides.useRangeQuery = true
+	overrides.runOnce = true
+	return collect(*configFiles, overrides, *noResume)
+}
+
+// runValidateConfig runs the validate-config command: it loads the
+// configuration and prints it with defaults applied and secrets redacted
+func runValidateConfig(args []string) int {
+	fs, configFiles := newFlagSet("validate-config")
+	parseFlags(fs, configFiles, args)
+
+	cfg, err := config.LoadConfig(*configFiles...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		return 1
+	}
+
+	out, err := yaml.Marshal(redacted(cfg))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode configuration: %v\n", err)
+		return 1
+	}
+	os.Stdout.Write(out)
+	return 0
+}
+
+// runCompact runs the compact command: the Parquet files of every partition
+// directory given as an argument are merged into one file sorted by timestamp
+func runCompact(args []string) int {
+	fs, configFiles := newFlagSet("compact")
+	output := fs.String("output", "metrics_compacted.parquet", "File `name` of the compacted file written into each directory")
+	deleteOriginals := fs.Bool("delete-originals", false, "Delete the merged files once the compacted file is written")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: ingester compact [flags] DIR...\n\n"+
+			"DIR is a partition directory below storage.outputDir, e.g. ./data/year=2025/month=04/day=07/app=memento")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, configFiles, args)
+
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "compact requires at least one directory")
+		fs.Usage()
+		return 2
+	}
+	if *output == "" || strings.ContainsAny(*output, "/\\") || !strings.HasSuffix(*output, ".parquet") {
+		fmt.Fprintf(os.Stderr, "--output must be a .parquet file name, got %q\n", *output)
+		return 2
+	}
+
+	cfg, err := config.LoadConfig(*configFiles...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		return 1
+	}
+	setupLogging(cfg)
+	if cfg.Storage.Type == config.StorageTypeDuckDB {
+		fmt.Fprintln(os.Stderr, "compact applies to file output and cannot be used with storage.type \"duckdb\"")
+		return 1
+	}
+
+	store, err := storage.NewParquetStorage(cfg.Storage)
+	if err != nil {
+		fatal("Failed to initialize storage", "error", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	code := 0
+	for _, dir := range fs.Args() {
+		start := time.Now()
+		res, err := store.Compact(ctx, dir, *output, *deleteOriginals)
+		if err != nil {
+			slog.Error("Failed to compact partition", "dir", dir, "error", err)
+			code = 1
+			continue
+		}
+		if res.Rows == 0 && len(res.Deleted) == 0 {
+			slog.Info("Nothing to compact", "dir", dir, "files", len(res.Inputs))
+			continue
+		}
+		slog.Info("Compacted partition", "dir", dir, "output", res.Output, "files", len(res.Inputs),
+			"rows", res.Rows, "deleted", len(res.Deleted), "duration", time.Since(start))
+	}
+	// Compacted files are listed and deleted ones dropped, even when interrupted
+	if err := store.WriteManifests(context.WithoutCancel(ctx)); err != nil {
+		code = 1
+	}
+	return code
+}
+
+// runInspect runs the inspect command: it prints the footer details and first
+// rows of each Parquet file given as an argument. No configuration is needed.
+func runInspect(args []string) int {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	rows := fs.Int("rows", 5, "Number of rows to print from each file (0 prints none)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: ingester inspect [flags] FILE...\n\n"+
+			"FILE is a local Parquet file written by the ingester or any other tool")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "inspect requires at least one file")
+		fs.Usage()
+		return 2
+	}
+	if *rows < 0 {
+		fmt.Fprintf(os.Stderr, "--rows must not be negative, got %d\n", *rows)
+		return 2
+	}
+
+	code := 0
+	for i, file := range fs.Args() {
+		if i > 0 {
+			fmt.Println()
+		}
+		info, err := storage.InspectParquetFile(file, *rows)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			code = 1
+			continue
+		}
+		printFileInfo(os.Stdout, file, info)
+	}
+	return code
+}
+
+// printFileInfo writes the details of a Parquet file read by inspect
+func printFileInfo(out io.Writer, file string, info storage.FileInfo) {
+	fmt.Fprintf(out, "file:           %s\n", file)
+	fmt.Fprintf(out, "rows:           %d\n", info.Rows)
+	fmt.Fprintf(out, "row groups:     %d\n", info.RowGroups)
+	fmt.Fprintf(out, "schema version: %d\n", info.SchemaVersion)
+	fmt.Fprintf(out, "created by:     %s\n", info.CreatedBy)
+	keys := make([]string, 0, len(info.Metadata))
+	for key := range info.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(out, "metadata:       %s=%s\n", key, info.Metadata[key])
+	}
+
+	fmt.Fprintln(out)
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "COLUMN\tTYPE\tCONVERTED\tREPETITION\tCOMPRESSION\tENCODINGS\tCOMPRESSED\tUNCOMPRESSED")
+	for _, c := range info.Columns {
+		converted := c.ConvertedType
+		if converted == "" && c.TimestampUnit != "" {
+			// Nanosecond timestamps only have a logical type
+			converted = "TIMESTAMP(" + c.TimestampUnit + ")"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n", c.Path, c.Type, converted, c.Repetition,
+			c.Compression, strings.Join(c.Encodings, ","), c.CompressedBytes, c.UncompressedBytes)
+	}
+	w.Flush()
+
+	for i, row := range info.Sample {
+		fmt.Fprintf(out, "\nrow %d:\n", i+1)
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		for _, column := range row {
+			value, err := json.Marshal(column.Value)
+			if err != nil {
+				value = []byte(fmt.Sprint(column.Value))
+			}
+			fmt.Fprintf(w, "  %s\t%s\n", column.Name, value)
+		}
+		w.Flush()
+	}
+}
+
+// listQueries prints the query of every configured metric as it is sent for
+// each configured API proxy. Discovered proxies are not listed, since finding
+// them requires querying Prometheus. Metrics listed in metricsFile, when set,
+// are included.
+func listQueries(files []string, metricsFile string) int {
+	cfg, err := config.LoadConfigWithMetrics(metricsFile, files...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		return 1
+	}
+
+	// Creating a client does not contact Prometheus
+	client, err := prometheus.NewClient(cfg.Prometheus)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create Prometheus client: %v\n", err)
+		return 1
+	}
+
+	if cfg.Prometheus.DiscoverProxies.Enabled {
+		fmt.Fprintln(os.Stderr, "note: API proxies discovered from Prometheus are not listed")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "API PROXY\tMETRIC\tQUERY")
+	code := 0
+	for _, apiProxy := range cfg.APIProxyNames() {
+		queries, err := client.ResolveQueries(apiProxy)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", apiProxy, err)
+			code = 1
+			continue
+		}
+		for _, q := range queries {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", apiProxy, q.Name, q.Query)
+		}
+	}
+	w.Flush()
+	return code
+}
+
+// redacted returns a copy of cfg with credentials replaced so the effective
+// configuration can be printed safely
+func redacted(cfg *config.Config) *config.Config {
+	const mask = "<redacted>"
+	hide := func(s *string) {
+		if *s != "" {
+			*s = mask
+		}
+	}
+
+	c := *cfg
+	hide(&c.Prometheus.Password)
+	hide(&c.Prometheus.BearerToken)
+	hide(&c.Storage.S3.SecretAccessKey)
+	hide(&c.Storage.S3.SessionToken)
+	if u, err := url.Parse(c.Prometheus.HTTPProxy); err == nil && u.User != nil {
+		c.Prometheus.HTTPProxy = u.Redacted()
+	}
+
+	c.Sources = append([]config.SourceConfig(nil), cfg.Sources...)
+	for i := range c.Sources {
+		hide(&c.Sources[i].Password)
+		hide(&c.Sources[i].BearerToken)
+	}
+	return &c
+}
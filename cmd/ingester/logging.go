@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+// setupLogging installs the configured slog handler as the default logger.
+// Output from the standard log package is routed through it as well.
+func setupLogging(cfg *config.Config) {
+	// The level was validated by config.LoadConfig
+	level, _ := cfg.SlogLevel()
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if cfg.LogFormat == config.LogFormatText {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
@@ -1,236 +1,813 @@
 package main
 
 import (
-	"flag"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
 	"os/signal"
-	"runtime"
+	"slices"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	// Embed the zone database so storage.timezone works in minimal images
+	_ "time/tzdata"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/kiquetal/go-duckdb-ingester/internal/checkpoint"
 	"github.com/kiquetal/go-duckdb-ingester/internal/prometheus"
 	"github.com/kiquetal/go-duckdb-ingester/internal/storage"
+	"github.com/kiquetal/go-duckdb-ingester/internal/telemetry"
 	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
 )
 
+// invocationID identifies the process in the invocation_id column of the rows
+// it collects, its logs and its run summaries
+var invocationID string
+
 func main() {
-	// Parse command line flags
-	configPath := flag.String("config", "config.yaml", "Path to configuration file")
-	startTimeStr := flag.String("start", "", "Start time for range query (RFC3339 format, e.g., 2025-04-07T00:00:00Z)")
-	endTimeStr := flag.String("end", "", "End time for range query (RFC3339 format, e.g., 2025-04-08T00:00:00Z)")
-	useRangeQuery := flag.Bool("range", false, "Use range query instead of instant query")
-	flag.Parse()
+	invocationID = uuid.NewString()
+
+	// Without a subcommand the ingester collects, as it did before subcommands existed
+	name, args := "collect", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	// --version prints and exits before any flag parsing or config loading
+	if len(args) > 0 && (args[0] == "--version" || args[0] == "-version") {
+		name = "version"
+	}
+
+	var code int
+	switch name {
+	case "collect":
+		code = runCollect(args)
+	case "backfill":
+		code = runBackfill(args)
+	case "validate-config":
+		code = runValidateConfig(args)
+	case "compact":
+		code = runCompact(args)
+	case "inspect":
+		code = runInspect(args)
+	case "version":
+		printVersion(os.Stdout)
+	case "help":
+		usage(os.Stdout)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage(os.Stderr)
+		code = 2
+	}
+	os.Exit(code)
+}
+
+// collect loads the configuration, applies the command line overrides and runs
+// collections until interrupted, or once in one-shot mode. It returns the exit
+// status of the process.
+func collect(configPaths []string, overrides flagOverrides, noResume bool) int {
+	// Exit status for one-shot runs
+	exitCode := 0
 
 	// Load configuration
-	cfg, err := config.LoadConfig(*configPath)
+	cfg, err := config.LoadConfigWithMetrics(overrides.metricsFile, configPaths...)
 	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
+		fatal("Failed to load configuration", "error", err)
 	}
+	setupLogging(cfg)
+	logDisabledMetrics(cfg)
+	slog.Info("Starting ingester", "invocation_id", invocationID)
+	cfg.Storage.InvocationID = invocationID
 
 	// Override configuration with command line flags if provided
-	if *useRangeQuery {
-		cfg.Prometheus.UseRangeQuery = true
+	if err := overrides.apply(cfg); err != nil {
+		fatal("Invalid command line flags", "error", err)
+	}
+	applyMemoryLimit(cfg.SoftMemoryLimit)
+
+	// Create the Prometheus clients and output path template
+	col, err := newCollector(cfg)
+	if err != nil {
+		fatal("Failed to initialize collector", "error", err)
 	}
 
-	// Parse start and end times if provided
-	if *startTimeStr != "" && *endTimeStr != "" {
-		startTime, err := time.Parse(time.RFC3339, *startTimeStr)
+	// Load backfill progress so completed batches are skipped
+	var progress *checkpoint.Checkpoint
+	if cfg.CheckpointFile != "" {
+		progress, err = checkpoint.Open(cfg.CheckpointFile, !noResume)
 		if err != nil {
-			log.Fatalf("Failed to parse start time: %v", err)
+			fatal("Failed to load checkpoint", "error", err)
 		}
+	}
 
-		endTime, err := time.Parse(time.RFC3339, *endTimeStr)
+	// Initialize storage; skipped in dry-run mode since it creates directories and database files
+	var store storage.Storage
+	if !cfg.DryRun {
+		store, err = storage.New(cfg.Storage)
 		if err != nil {
-			log.Fatalf("Failed to parse end time: %v", err)
+			fatal("Failed to initialize storage", "error", err)
+		}
+		if closer, ok := store.(io.Closer); ok {
+			defer closer.Close()
 		}
+	}
 
-		// Store the time range in the configuration
-		cfg.Prometheus.UseRangeQuery = true
-		cfg.StartTime = startTime
-		cfg.EndTime = endTime
+	// Setup signal handling for graceful shutdown; the context is cancelled on
+	// SIGINT/SIGTERM so in-flight queries and writes are aborted
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Fail fast on a wrong URL or credentials instead of on every query of the
+	// first collection; nothing is queried in dry-run mode
+	if !cfg.DryRun && !overrides.skipPrometheusCheck {
+		for _, client := range col.clients {
+			if err := client.Ping(ctx); err != nil {
+				if ctx.Err() != nil {
+					slog.Info("Shutting down")
+					return exitCode
+				}
+				fatal("Prometheus is not reachable; check prometheus.url or pass --skip-prometheus-check",
+					"source", client.Source(), "error", err)
+			}
+		}
 	}
 
-	// Initialize Prometheus client
-	promClient, err := prometheus.NewClient(cfg.Prometheus)
-	if err != nil {
-		log.Fatalf("Failed to create Prometheus client: %v", err)
+	// Expose the ingester's own health and progress metrics
+	if !cfg.Telemetry.Disabled && !cfg.DryRun {
+		telemetry.Serve(ctx, cfg.Telemetry.ListenAddress)
 	}
 
-	// Initialize storage
-	store, err := storage.NewParquetStorage(cfg.Storage)
+	// Spans are discarded unless an OTLP endpoint is configured
+	stopTracing, err := telemetry.StartTracing(ctx, cfg.Tracing.Endpoint, cfg.Tracing.ServiceName)
 	if err != nil {
-		log.Fatalf("Failed to initialize storage: %v", err)
+		fatal("Failed to start tracing", "error", err)
 	}
+	defer stopTracing()
 
-	// Setup signal handling for graceful shutdown
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	// Probes only make sense for a long-running collector; readiness allows one
+	// missed cycle before reporting the collector as stale
+	if cfg.Health.ListenAddress != "" && !cfg.OneShot {
+		telemetry.ServeHealth(ctx, cfg.Health.ListenAddress, 2*cfg.CollectionInterval)
+	}
 
-	// Create ticker for daily collection
-	ticker := time.NewTicker(24 * time.Hour)
-	if cfg.Debug {
-		// Use shorter interval for debugging
-		ticker = time.NewTicker(1 * time.Minute)
+	// In one-shot mode collect once and exit, reporting failures through the exit status
+	if cfg.OneShot {
+		if err := collectAndStore(ctx, col, store, progress); err != nil {
+			slog.Error("Collection failed", "error", err)
+			exitCode = 1
+		}
+		return exitCode
 	}
 
+	// Reload the configuration on SIGHUP; collections run in this goroutine, so
+	// the new settings take effect from the next cycle
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+
+	// Create ticker for periodic collection
+	ticker := time.NewTicker(cfg.CollectionInterval)
+	slog.Info("Collecting metrics periodically", "interval", cfg.CollectionInterval)
+
 	// Run initial collection
-	collectAndStore(promClient, store, cfg)
+	if err := collectAndStore(ctx, col, store, progress); err != nil {
+		slog.Error("Collection completed with errors", "error", err)
+	}
 
 	// Main loop
-	fmt.Println("Starting metrics collection. Press Ctrl+C to exit.")
+	slog.Info("Starting metrics collection. Press Ctrl+C to exit.")
 	for {
 		select {
 		case <-ticker.C:
-			collectAndStore(promClient, store, cfg)
-		case <-sigCh:
-			fmt.Println("Shutting down...")
+			if err := collectAndStore(ctx, col, store, progress); err != nil {
+				slog.Error("Collection completed with errors", "error", err)
+			}
+		case <-reload:
+			next, err := col.reload(configPaths, overrides)
+			if err != nil {
+				slog.Error("Failed to reload configuration, keeping the current one", "error", err)
+				continue
+			}
+			if next.cfg.CollectionInterval != col.cfg.CollectionInterval {
+				ticker.Reset(next.cfg.CollectionInterval)
+			}
+			col = next
+			slog.Info("Configuration reloaded", "api_proxies", col.cfg.APIProxyNames(),
+				"metrics", len(col.cfg.Prometheus.EnabledMetrics()), "interval", col.cfg.CollectionInterval)
+		case <-ctx.Done():
+			slog.Info("Shutting down")
 			ticker.Stop()
-			return
+			return exitCode
 		}
 	}
 }
 
-func collectAndStore(client *prometheus.Client, store *storage.ParquetStorage, cfg *config.Config) {
+// collectAndStore runs one collection cycle. Failures of individual API proxies
+// or batches do not stop the cycle unless failFast is set; they are joined into
+// the returned error.
+func collectAndStore(parent context.Context, col *collector, store storage.Storage, progress *checkpoint.Checkpoint) error {
+	cfg, clients := col.cfg, col.clients
 	totalStartTime := time.Now()
-	log.Printf("Collecting metrics for API proxies: %v", cfg.APIProxies)
+	slog.Info("Collecting metrics for API proxies", "api_proxies", cfg.APIProxyNames())
 
 	// Determine the date to use for file partitioning
 	var fileDate time.Time
 	if !cfg.StartTime.IsZero() {
 		// If start time is provided, use it for file partitioning
 		fileDate = cfg.StartTime
+	} else if !cfg.EvaluationTime.IsZero() {
+		// A pinned instant belongs to the day it was evaluated at
+		fileDate = cfg.EvaluationTime
 	} else {
 		// Otherwise use current time
 		fileDate = time.Now()
 	}
+	// Partitions follow the calendar days of storage.timezone, like the date column
+	fileDate = fileDate.In(cfg.Storage.Location)
+
+	c := &cycle{
+		cfg:        cfg,
+		store:      store,
+		paths:      col.paths,
+		rollups:    col.rollups,
+		progress:   progress,
+		processors: col.processors,
+		runID:      totalStartTime.UTC().Format("20060102T150405Z"),
+		year:       fileDate.Format("2006"),
+		month:      fileDate.Format("01"),
+		day:        fileDate.Format("02"),
+	}
+	if cfg.Storage.SuccessMarker != "" && !cfg.DryRun {
+		c.partitions = newPartitions()
+	}
 
-	year := fileDate.Format("2006")
-	month := fileDate.Format("01")
-	day := fileDate.Format("02")
-
-	// Process each API proxy sequentially to reduce memory usage
-	for _, apiProxy := range cfg.APIProxies {
-		if cfg.Prometheus.UseRangeQuery && !cfg.StartTime.IsZero() && !cfg.EndTime.IsZero() {
-			// Use range query if enabled and start/end times are provided
-			log.Printf("Processing metrics for %s using range query from %s to %s with step %s",
-				apiProxy, cfg.StartTime.Format(time.RFC3339), cfg.EndTime.Format(time.RFC3339),
-				cfg.Prometheus.RangeStep)
+	// The collection is the root span of its proxies, queries and writes
+	attrs := []attribute.KeyValue{attribute.String("run_id", c.runID), attribute.String("invocation_id", invocationID)}
+	if !cfg.StartTime.IsZero() {
+		attrs = append(attrs, attribute.String("range_start", cfg.StartTime.Format(time.RFC3339)),
+			attribute.String("range_end", cfg.EndTime.Format(time.RFC3339)))
+	}
+	parent, span := telemetry.StartSpan(parent, "collect", attrs...)
+
+	// Log memory usage at debug level while the cycle runs
+	stopWatch := watchMemory(parent)
+	defer logMemStats(parent, "Memory usage after collection")
+	defer stopWatch()
+
+	// With failFast the first error cancels the proxies and batches still running
+	ctx := parent
+	if cfg.FailFast {
+		var cancel context.CancelCauseFunc
+		ctx, cancel = context.WithCancelCause(parent)
+		defer cancel(nil)
+		c.abort = cancel
+	}
 
-			// Calculate the total duration
-			totalDuration := cfg.EndTime.Sub(cfg.StartTime)
+	// One job per Prometheus source and API proxy, or per source when all
+	// proxies are combined into one file
+	var jobs []proxyJob
+	var discoveryErrs []error
+	for _, client := range clients {
+		// Configured sources each get their own source=NAME partition level
+		source := ""
+		if len(cfg.Sources) > 0 {
+			source = client.Source()
+		}
 
-			// Use a batch size of 6 hours to reduce memory usage
-			batchDuration := 6 * time.Hour
+		// A failed discovery still collects the configured proxies
+		apiProxies, err := c.apiProxies(ctx, client)
+		if err != nil {
+			slog.Error("Error discovering API proxies, collecting the configured ones", "source", client.Source(), "error", err)
+			discoveryErrs = append(discoveryErrs, err)
+			if c.abort != nil {
+				c.abort(err)
+			}
+		}
 
-			// If the total duration is less than the batch size, just use the total duration
-			if totalDuration < batchDuration {
-				batchDuration = totalDuration
+		if cfg.Storage.CombineProxies {
+			if len(apiProxies) > 0 {
+				jobs = append(jobs, proxyJob{client: client, source: source, apiProxies: apiProxies})
 			}
+			continue
+		}
+		for _, apiProxy := range apiProxies {
+			jobs = append(jobs, proxyJob{client: client, source: source, apiProxy: apiProxy})
+		}
+	}
 
-			// Process data in batches to reduce memory usage
-			for batchStart := cfg.StartTime; batchStart.Before(cfg.EndTime); batchStart = batchStart.Add(batchDuration) {
-				batchEnd := batchStart.Add(batchDuration)
-				if batchEnd.After(cfg.EndTime) {
-					batchEnd = cfg.EndTime
+	// Process proxies through a bounded worker pool. Peak memory grows with the
+	// pool size, so the default of a single worker keeps collection sequential.
+	results := make([]proxyResult, len(jobs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(cfg.MaxConcurrentProxies, len(jobs)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				// A job handed over as the cycle was aborted is skipped
+				if ctx.Err() != nil {
+					continue
+				}
+				if cfg.Storage.CombineProxies {
+					results[i] = c.collectCombined(ctx, jobs[i])
+				} else {
+					results[i] = c.collectProxy(ctx, jobs[i])
 				}
+			}
+		}()
+	}
+
+dispatch:
+	for i := range jobs {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+			if parent.Err() == nil {
+				slog.Error("Aborting collection after the first error (failFast), skipping remaining API proxies",
+					"error", context.Cause(ctx))
+			} else {
+				slog.Warn("Collection interrupted, skipping remaining API proxies")
+			}
+			break dispatch
+		}
+	}
+	close(next)
+	wg.Wait()
 
-				log.Printf("Collecting batch for %s from %s to %s",
-					apiProxy, batchStart.Format(time.RFC3339), batchEnd.Format(time.RFC3339))
+	// Track per-proxy/per-batch outcomes so failures can be reported without stopping the cycle
+	cycleErrs := discoveryErrs
+	if err := c.markPartitions(ctx); err != nil {
+		cycleErrs = append(cycleErrs, err)
+	}
+	if store != nil {
+		// Files written before an interruption are still listed
+		if err := store.WriteManifests(context.WithoutCancel(ctx)); err != nil {
+			cycleErrs = append(cycleErrs, err)
+		}
+	}
+	var collectErrs []error
+	succeeded := 0
+	for _, res := range results {
+		succeeded += res.succeeded
+		collectErrs = append(collectErrs, res.errs...)
+	}
 
-				timeRange := prometheus.TimeRange{
-					Start: batchStart,
-					End:   batchEnd,
-					Step:  cfg.Prometheus.RangeStep,
-				}
+	// Log total time taken for the entire collection and storage process
+	totalDuration := time.Since(totalStartTime)
+	slog.Info("Collection summary", "invocation_id", invocationID, "run_id", c.runID, "succeeded", succeeded, "failed", len(cycleErrs)+len(collectErrs), "duration", totalDuration)
 
-				// Measure time for Prometheus query
-				queryStartTime := time.Now()
-				metrics, err := client.CollectMetricsRange(apiProxy, timeRange)
-				queryDuration := time.Since(queryStartTime)
-				log.Printf("Prometheus range query for %s took %s", apiProxy, queryDuration)
+	if err := parent.Err(); err != nil {
+		cycleErrs = append(cycleErrs, fmt.Errorf("collection interrupted: %w", err))
+	} else if ctx.Err() != nil {
+		cycleErrs = append(cycleErrs, errors.New("collection aborted after the first error (failFast)"))
+	}
 
-				if err != nil {
-					log.Printf("Error collecting metrics for %s: %v", apiProxy, err)
-					continue
-				}
+	// The summary of an interrupted cycle is still written, so detach it from ctx
+	if cfg.Storage.WriteRunSummary && store != nil {
+		summary := newRunSummary(c, totalStartTime, totalDuration, jobs, results, cycleErrs)
+		if name, err := writeRunSummary(context.WithoutCancel(ctx), store, summary); err != nil {
+			slog.Error("Failed to write run summary", "error", err)
+		} else {
+			slog.Info("Wrote run summary", "file", name)
+		}
+	}
 
-				if len(metrics) == 0 {
-					log.Printf("No metrics found for %s in this batch", apiProxy)
-					continue
-				}
+	err := errors.Join(append(cycleErrs, collectErrs...)...)
+	telemetry.ObserveCollection(totalDuration, err)
+	telemetry.EndSpan(span, err, attribute.Int("succeeded", succeeded))
+	return err
+}
 
-				// Store metrics in parquet file with recommended partitioning structure
-				// year=YYYY/month=MM/day=DD/app=apiProxy/metrics_HHMMSS_HHMMSS.parquet
-				// Create a unique filename for each batch to avoid memory issues
-				// Use the batch start time for file partitioning to ensure each day's data
-				// is stored in the correct folder, especially when the query spans multiple days
-				batchYear := batchStart.Format("2006")
-				batchMonth := batchStart.Format("01")
-				batchDay := batchStart.Format("02")
-
-				batchFilename := fmt.Sprintf("%s/year=%s/month=%s/day=%s/app=%s/metrics_%s_%s.parquet",
-					cfg.Storage.OutputDir, batchYear, batchMonth, batchDay, apiProxy,
-					batchStart.Format("150405"), batchEnd.Format("150405"))
-
-				// Measure time for Parquet file writing
-				writeStartTime := time.Now()
-				if err := store.StoreMetrics(metrics, batchFilename); err != nil {
-					log.Printf("Error storing metrics for %s: %v", apiProxy, err)
-					// Continue processing even if there's an error
-					log.Printf("Continuing to next batch despite error...")
-				} else {
-					writeDuration := time.Since(writeStartTime)
-					log.Printf("Successfully stored metrics for %s in %s (took %s)", apiProxy, batchFilename, writeDuration)
-				}
+// cycle holds the settings shared by every API proxy collected in one cycle
+type cycle struct {
+	cfg   *config.Config
+	store storage.Storage
+	paths *storage.PathTemplate
 
-				// Force garbage collection to free up memory
-				metrics = nil
-				runtime.GC()
+	// rollups renders rollup output paths; nil when rollups are disabled
+	rollups *storage.PathTemplate
 
-				// Log the next batch start time to help with debugging
-				nextBatchStart := batchStart.Add(batchDuration)
-				if nextBatchStart.Before(cfg.EndTime) {
-					log.Printf("Next batch will start at %s", nextBatchStart.Format(time.RFC3339))
-				} else {
-					log.Printf("All batches processed for %s", apiProxy)
-				}
+	// processors transform collected samples before rollups, downsampling
+	// and storage
+	processors prometheus.Processors
+
+	// progress records completed range batches; nil when checkpointing is off
+	progress *checkpoint.Checkpoint
+
+	// partitions tracks the directories written for storage.successMarker;
+	// nil when markers are disabled
+	partitions *partitions
+
+	// runID identifies the cycle in output paths
+	runID string
+
+	// year, month and day partition instant collections
+	year  string
+	month string
+	day   string
+
+	// abort cancels the cycle at its first error; nil unless failFast is set
+	abort context.CancelCauseFunc
+}
+
+// process runs collected metrics through the processors chain
+func (c *cycle) process(logger *slog.Logger, metrics []prometheus.MetricResult) ([]prometheus.MetricResult, error) {
+	if len(c.processors) == 0 {
+		return metrics, nil
+	}
+	collected := len(metrics)
+	metrics, err := c.processors.Process(metrics)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug("Processed metrics", "collected_rows", collected, "rows", len(metrics))
+	return metrics, nil
+}
+
+// fail records err in res and, with failFast, aborts the rest of the cycle
+func (c *cycle) fail(res *proxyResult, err error) {
+	res.errs = append(res.errs, err)
+	if c.abort != nil {
+		c.abort(err)
+	}
+}
+
+// proxyJob is one API proxy to collect from one Prometheus source. Combined
+// jobs leave apiProxy empty and cover all of apiProxies instead.
+type proxyJob struct {
+	client     *prometheus.Client
+	source     string
+	apiProxy   string
+	apiProxies []string
+}
+
+// apiProxies returns the API proxies to collect from client: the configured
+// ones, plus those found in Prometheus when discovery is enabled. On error the
+// configured proxies are returned along with it.
+func (c *cycle) apiProxies(ctx context.Context, client *prometheus.Client) ([]string, error) {
+	cfg := c.cfg
+	configured := cfg.APIProxyNames()
+	if !cfg.Prometheus.DiscoverProxies.Enabled {
+		return configured, nil
+	}
+	if cfg.DryRun {
+		slog.Info("[dry-run] Skipping API proxy discovery", "source", client.Source(),
+			"label", cfg.Prometheus.DiscoverProxies.Label)
+		return configured, nil
+	}
+
+	// A backfill collects the proxies that had series during its range, other
+	// collections those active within the lookback
+	var start, end time.Time
+	if cfg.Prometheus.UseRangeQuery && !cfg.StartTime.IsZero() && !cfg.EndTime.IsZero() {
+		start, end = cfg.StartTime, cfg.EndTime
+	} else if lookback := cfg.Prometheus.DiscoverProxies.Lookback; lookback > 0 {
+		end = time.Now()
+		start = end.Add(-lookback)
+	}
+	discovered, err := client.DiscoverProxies(ctx, start, end)
+	if err != nil {
+		return configured, err
+	}
+
+	proxies := configured
+	for _, apiProxy := range discovered {
+		if !slices.Contains(proxies, apiProxy) {
+			proxies = append(proxies, apiProxy)
+		}
+	}
+	slog.Info("Discovered API proxies", "source", client.Source(), "discovered", len(discovered), "api_proxies", proxies)
+	return proxies, nil
+}
+
+// proxyResult counts the successful collections of a proxyJob and records its failures
+type proxyResult struct {
+	succeeded int
+	errs      []error
+
+	// rows, rows per metric and time spent querying and writing, for the run summary
+	rows          int
+	metricRows    map[string]int
+	queryDuration time.Duration
+	writeDuration time.Duration
+}
+
+// setBatch sets the batch bounds of a range batch's path data and partitions
+// it by the day the batch starts on in storage.timezone, so a batch spanning
+// several days is stored in the first of them
+func (c *cycle) setBatch(data *storage.PathData, start, end time.Time) {
+	loc := c.cfg.Storage.Location
+	data.BatchStart, data.BatchEnd = start.In(loc), end.In(loc)
+	data.Year = data.BatchStart.Format("2006")
+	data.Month = data.BatchStart.Format("01")
+	data.Day = data.BatchStart.Format("02")
+}
+
+// batchOutputs renders every file a range batch writes: the raw output and,
+// when rollups are enabled, the rollup output
+func (c *cycle) batchOutputs(data storage.PathData) ([]string, error) {
+	metrics := c.metricsFor(data.App)
+	targets, err := outputPaths(c.paths, data, metrics)
+	if err != nil || c.rollups == nil {
+		return targets, err
+	}
+
+	rollupTargets, err := outputPaths(c.rollups, data, metrics)
+	if err != nil {
+		return nil, err
+	}
+	for _, target := range rollupTargets {
+		// DuckDB identifies rollup batches like raw ones
+		if !slices.Contains(targets, target) {
+			targets = append(targets, target)
+		}
+	}
+	return targets, nil
+}
+
+// metricsFor returns the metrics collected for app, every metric for combined
+// files, which leave the API proxy empty and hold every proxy's metrics
+func (c *cycle) metricsFor(app string) []config.MetricConfig {
+	if app == "" {
+		return c.cfg.Prometheus.AllMetrics()
+	}
+	return c.cfg.Prometheus.MetricsFor(app)
+}
+
+// storeRollups stores the rollups of a range batch below rollup.outputDir,
+// routed to files by the metric they summarize, and returns the paths written
+func (c *cycle) storeRollups(ctx context.Context, logger *slog.Logger, data storage.PathData, rollups []prometheus.MetricResult) ([]string, error) {
+	if c.rollups == nil || len(rollups) == 0 {
+		return nil, nil
+	}
+
+	targets, rows, duration, err := storeGrouped(ctx, c.store, c.rollups, data, rollups, prometheus.RollupMetric)
+	if err != nil {
+		logger.Error("Error storing rollups", "duration", duration, "error", err)
+		return nil, fmt.Errorf("rollup: %w", err)
+	}
+	logger.Info("Successfully stored rollups", "paths", targets, "rows", rows, "duration", duration)
+	return targets, nil
+}
+
+// batchWritten reports whether every output file of a range batch already
+// exists from an earlier run, in which case the batch is skipped unless
+// storage.overwriteExisting is set. A failed check collects the batch anyway.
+func (c *cycle) batchWritten(ctx context.Context, logger *slog.Logger, data storage.PathData) bool {
+	if c.cfg.Storage.OverwriteExisting {
+		return false
+	}
+
+	targets, err := c.batchOutputs(data)
+	if err != nil {
+		// Rendering fails again when storing, which reports the error
+		return false
+	}
+	for _, target := range targets {
+		exists, err := c.store.Exists(ctx, target)
+		if err != nil {
+			logger.Warn("Failed to check for existing output, collecting batch", "path", target, "error", err)
+			return false
+		}
+		if !exists {
+			return false
+		}
+	}
+
+	logger.Info("Skipping batch, output already exists", "paths", targets)
+	return true
+}
+
+// storeEmpty writes an output without rows for every file of a range batch
+// that received no metrics, e.g. a per-metric file of a metric without samples,
+// so batchWritten counts the batch as written on the next run. written lists
+// the files the batch stored; the files written here are returned.
+func (c *cycle) storeEmpty(ctx context.Context, logger *slog.Logger, data storage.PathData, written []string) ([]string, error) {
+	// Instant collections are never skipped, and overwritten batches are
+	// never checked
+	if data.BatchStart.IsZero() || c.cfg.Storage.OverwriteExisting {
+		return nil, nil
+	}
+
+	targets, err := c.batchOutputs(data)
+	if err != nil {
+		return nil, err
+	}
+	var empty []string
+	for _, target := range targets {
+		if slices.Contains(written, target) {
+			continue
+		}
+		if err := c.store.StoreEmpty(ctx, target); err != nil {
+			return empty, fmt.Errorf("%s: %w", target, err)
+		}
+		empty = append(empty, target)
+	}
+	if len(empty) > 0 {
+		logger.Debug("Stored empty outputs for metrics without samples", "paths", empty)
+	}
+	return empty, nil
+}
+
+// batchTracker tracks the contiguous run of completed batches of one job in
+// the checkpoint. Batches may complete out of order when writes are
+// pipelined, so it is safe for concurrent use.
+type batchTracker struct {
+	progress   *checkpoint.Checkpoint
+	job        string
+	start, end time.Time
+
+	mu sync.Mutex
+
+	// through is the end of the contiguous run of completed batches
+	through time.Time
+
+	// ahead maps the start of each batch completed after a gap to its end
+	ahead map[time.Time]time.Time
+}
+
+// batchTracker starts tracking job's batches from through, the time up to
+// which earlier runs completed the range
+func (c *cycle) batchTracker(job string, through time.Time) *batchTracker {
+	return &batchTracker{progress: c.progress, job: job, start: c.cfg.StartTime, end: c.cfg.EndTime, through: through}
+}
+
+// complete records a written batch. Only a batch continuing the contiguous run
+// advances the checkpoint, so a failed batch is retried on the next run even
+// if later batches succeeded. A batch completed ahead of the run is held until
+// the batches before it complete.
+func (t *batchTracker) complete(logger *slog.Logger, batchStart, batchEnd time.Time) {
+	if t == nil || t.progress == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !batchStart.Equal(t.through) {
+		if batchStart.After(t.through) {
+			if t.ahead == nil {
+				t.ahead = make(map[time.Time]time.Time)
 			}
-		} else {
-			// Use instant query
-			log.Printf("Collecting metrics for %s using instant query", apiProxy)
+			t.ahead[batchStart.UTC()] = batchEnd
+		}
+		return
+	}
+	t.through = batchEnd
+	for {
+		end, ok := t.ahead[t.through.UTC()]
+		if !ok {
+			break
+		}
+		delete(t.ahead, t.through.UTC())
+		t.through = end
+	}
+	if err := t.progress.Advance(t.job, t.start, t.end, t.through); err != nil {
+		logger.Warn("Failed to save checkpoint", "error", err)
+	}
+}
+
+// combinedProxyLabel is the api_proxy telemetry label for writes of combined files
+const combinedProxyLabel = "combined"
 
-			// Measure time for Prometheus query
-			queryStartTime := time.Now()
-			metrics, err := client.CollectMetrics(apiProxy)
-			queryDuration := time.Since(queryStartTime)
-			log.Printf("Prometheus instant query for %s took %s", apiProxy, queryDuration)
+// combinedCheckpointJob is the checkpoint job of combined files. API proxy
+// names cannot contain '=', so it never collides with a proxy's own progress.
+const combinedCheckpointJob = "=combined"
 
+// batchWindows splits the configured range into half-open batches of
+// prometheus.batchDuration
+func batchWindows(cfg *config.Config) []prometheus.TimeRange {
+	batchDuration := cfg.Prometheus.BatchDuration
+	if total := cfg.EndTime.Sub(cfg.StartTime); total < batchDuration {
+		batchDuration = total
+	}
+
+	var windows []prometheus.TimeRange
+	for batchStart := cfg.StartTime; batchStart.Before(cfg.EndTime); batchStart = batchStart.Add(batchDuration) {
+		batchEnd := batchStart.Add(batchDuration)
+		if batchEnd.After(cfg.EndTime) {
+			batchEnd = cfg.EndTime
+		}
+		windows = append(windows, prometheus.TimeRange{Start: batchStart, End: batchEnd, Step: cfg.Prometheus.RangeStep})
+	}
+	return windows
+}
+
+// storeMetricsTimed stores metrics and returns the rows stored and how long the
+// store took, whether or not it succeeded
+func storeMetricsTimed(ctx context.Context, store storage.Storage, metrics []prometheus.MetricResult, target string) (int, time.Duration, error) {
+	ctx, span := telemetry.StartSpan(ctx, "storage.write", attribute.String("path", target))
+	start := time.Now()
+	rows, err := store.StoreMetrics(ctx, metrics, target)
+	telemetry.EndSpan(span, err, attribute.Int("rows", rows))
+	return rows, time.Since(start), err
+}
+
+// storeRendered writes metrics to the path rendered from data, or to one file
+// per metric when the path template uses .MetricName or metrics are configured
+// with separateFile. It returns the paths written, the rows stored and the
+// total store duration.
+func storeRendered(ctx context.Context, store storage.Storage, paths *storage.PathTemplate, data storage.PathData, metrics []prometheus.MetricResult) ([]string, int, time.Duration, error) {
+	return storeGrouped(ctx, store, paths, data, metrics, func(name string) string { return name })
+}
+
+// storeGrouped is storeRendered for results whose file is chosen by the
+// metric returned by metricOf rather than their own name
+func storeGrouped(ctx context.Context, store storage.Storage, paths *storage.PathTemplate, data storage.PathData, metrics []prometheus.MetricResult, metricOf func(name string) string) ([]string, int, time.Duration, error) {
+	if !paths.Split() {
+		target, err := paths.Render(data)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		rows, duration, err := storeMetricsTimed(ctx, store, metrics, target)
+		return []string{target}, rows, duration, err
+	}
+
+	// Group by target file, keeping the order metrics were returned in
+	var targets []string
+	groups := make(map[string][]prometheus.MetricResult)
+	targetOf := make(map[string]string)
+	for _, metric := range metrics {
+		target, ok := targetOf[metric.Name]
+		if !ok {
+			var err error
+			target, err = paths.RenderMetric(data, metricOf(metric.Name))
 			if err != nil {
-				log.Printf("Error collecting metrics for %s: %v", apiProxy, err)
-				continue
+				return nil, 0, 0, err
 			}
+			targetOf[metric.Name] = target
+		}
+		if _, ok := groups[target]; !ok {
+			targets = append(targets, target)
+		}
+		groups[target] = append(groups[target], metric)
+	}
 
-			// Store metrics in parquet file with recommended partitioning structure
-			// year=YYYY/month=MM/day=DD/app=apiProxy/metrics.parquet
-			filename := fmt.Sprintf("%s/year=%s/month=%s/day=%s/app=%s/metrics.parquet",
-				cfg.Storage.OutputDir, year, month, day, apiProxy)
-
-			// Measure time for Parquet file writing
-			writeStartTime := time.Now()
-			if err := store.StoreMetrics(metrics, filename); err != nil {
-				log.Printf("Error storing metrics for %s: %v", apiProxy, err)
-				// Continue processing even if there's an error
-				log.Printf("Continuing to next API proxy despite error...")
-			} else {
-				writeDuration := time.Since(writeStartTime)
-				log.Printf("Successfully stored metrics for %s in %s (took %s)", apiProxy, filename, writeDuration)
-			}
+	var written []string
+	var totalRows int
+	var total time.Duration
+	for _, target := range targets {
+		rows, duration, err := storeMetricsTimed(ctx, store, groups[target], target)
+		totalRows += rows
+		total += duration
+		if err != nil {
+			return written, totalRows, total, fmt.Errorf("%s: %w", target, err)
 		}
+		written = append(written, target)
 	}
+	return written, totalRows, total, nil
+}
 
-	// Log total time taken for the entire collection and storage process
-	totalDuration := time.Since(totalStartTime)
-	log.Printf("Total time for collecting and storing metrics: %s", totalDuration)
+// outputPaths renders the paths a collection would write to: one per metric
+// when the path template uses .MetricName, plus one per separateFile metric
+func outputPaths(paths *storage.PathTemplate, data storage.PathData, metrics []config.MetricConfig) ([]string, error) {
+	if !paths.Split() {
+		target, err := paths.Render(data)
+		if err != nil {
+			return nil, err
+		}
+		return []string{target}, nil
+	}
+
+	var targets []string
+	seen := make(map[string]bool, len(metrics))
+	for _, metric := range metrics {
+		target, err := paths.RenderMetric(data, metric.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[target] {
+			seen[target] = true
+			targets = append(targets, target)
+		}
+	}
+	return targets, nil
+}
+
+// logDisabledMetrics reports the metrics configured with enabled: false, so
+// their absence from the output is not mistaken for missing data
+func logDisabledMetrics(cfg *config.Config) {
+	disabled := cfg.Prometheus.DisabledMetrics()
+	if len(disabled) > 0 {
+		slog.Warn("Metrics disabled in the configuration will not be collected", "metrics", disabled)
+	}
+
+	// Overrides may disable different metrics for an API proxy
+	for _, proxy := range cfg.APIProxies {
+		if forProxy := cfg.Prometheus.DisabledMetricsFor(proxy.Name); len(forProxy) > 0 && !slices.Equal(forProxy, disabled) {
+			slog.Warn("Metrics disabled for API proxy will not be collected", "api_proxy", proxy.Name, "metrics", forProxy)
+		}
+	}
+}
+
+// fatal logs msg at error level and exits, the structured counterpart of log.Fatalf
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
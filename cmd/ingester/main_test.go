@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/go-duckdb-ingester/internal/checkpoint"
+	"github.com/kiquetal/go-duckdb-ingester/internal/prometheus"
+	"github.com/kiquetal/go-duckdb-ingester/internal/storage"
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+// fakeStore records the targets of StoreMetrics and StoreEmpty calls, each
+// failing with err; StoreMetrics takes delay. A target exists once stored.
+// Other Storage methods are not implemented.
+type fakeStore struct {
+	storage.Storage
+	delay time.Duration
+	err   error
+
+	mu      sync.Mutex
+	targets []string
+	empty   []string
+	markers map[string]bool
+}
+
+func (s *fakeStore) StoreMetrics(ctx context.Context, metrics []prometheus.MetricResult, target string) (int, error) {
+	time.Sleep(s.delay)
+	s.mu.Lock()
+	s.targets = append(s.targets, target)
+	s.mu.Unlock()
+	if s.err != nil {
+		return 0, s.err
+	}
+	return len(metrics), nil
+}
+
+func (s *fakeStore) StoreEmpty(ctx context.Context, target string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.empty = append(s.empty, target)
+	return s.err
+}
+
+func (s *fakeStore) Exists(ctx context.Context, target string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Contains(s.targets, target) || slices.Contains(s.empty, target), nil
+}
+
+func (s *fakeStore) StoreMetricsStream(ctx context.Context, metrics <-chan prometheus.MetricResult, errs <-chan error, target string) (int, error) {
+	rows := 0
+	for range metrics {
+		rows++
+	}
+	for err := range errs {
+		if err != nil {
+			return rows, err
+		}
+	}
+	// Like the real stores, an empty stream leaves no file
+	if rows > 0 {
+		s.mu.Lock()
+		s.targets = append(s.targets, target)
+		s.mu.Unlock()
+	}
+	return rows, s.err
+}
+
+func (s *fakeStore) MarkPartition(ctx context.Context, dir string, complete bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.markers == nil {
+		s.markers = make(map[string]bool)
+	}
+	s.markers[dir] = complete
+	return s.err
+}
+
+// proxyServer answers range queries like Prometheus with one sample per
+// series, or fails those of the API proxies in failing with 500
+func proxyServer(t *testing.T, failing ...string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.FormValue("query")
+		for _, apiProxy := range failing {
+			if strings.Contains(query, fmt.Sprintf("%q", apiProxy)) {
+				http.Error(w, "boom", http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"app":"x"},"values":[[%s,"1"]]}]}}`,
+			r.FormValue("start"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testCycle returns a range collection of the day starting at start from the
+// Prometheus at url, storing to a fakeStore and checkpointing to a temporary
+// file. override is appended to the config.
+func testCycle(t *testing.T, url string, start time.Time, override string) (*cycle, *prometheus.Client, *fakeStore) {
+	t.Helper()
+	dir := t.TempDir()
+	content := fmt.Sprintf(`
+apiProxies: [orders, payments]
+checkpointFile: %q
+prometheus:
+  url: %q
+  useRangeQuery: true
+  rangeStep: 1h
+  batchDuration: 12h
+  metrics:
+    - name: requests
+      query: 'sum by (app) (rate(requests_total{app="{{.APIProxy}}"}[5m]))'
+storage:
+  outputDir: %q
+`, filepath.Join(dir, "checkpoint.json"), url, filepath.Join(dir, "data")) + override
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.StartTime, cfg.EndTime = start, start.Add(24*time.Hour)
+
+	client, err := prometheus.NewClient(cfg.Prometheus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, err := storage.NewPathTemplate("/data", "{{.MetricName}}-{{.BatchStart.Format \"15\"}}.parquet", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress, err := checkpoint.Open(cfg.CheckpointFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &fakeStore{}
+	return &cycle{cfg: cfg, store: store, paths: paths, progress: progress}, client, store
+}
+
+// TestCollectCombinedPartialFailure checks that a combined window is only
+// written and checkpointed once every API proxy was collected
+func TestCollectCombinedPartialFailure(t *testing.T) {
+	start := time.Date(2025, 4, 7, 0, 0, 0, 0, time.UTC)
+	c, client, store := testCycle(t, proxyServer(t, "payments").URL, start, `
+  combineProxies: true
+`)
+	job := proxyJob{client: client, apiProxies: []string{"orders", "payments"}}
+
+	res := c.collectCombined(context.Background(), job)
+	if res.succeeded != 0 || len(res.errs) != 2 {
+		t.Fatalf("succeeded %d and failed %d batches, want 0 and 2: %v", res.succeeded, len(res.errs), res.errs)
+	}
+	if len(store.targets) != 0 {
+		t.Errorf("batches missing an API proxy were written to %v", store.targets)
+	}
+	if through := c.progress.CompletedThrough(combinedCheckpointJob, c.cfg.StartTime, c.cfg.EndTime); !through.Equal(start) {
+		t.Errorf("checkpoint advanced to %s, want %s", through, start)
+	}
+
+	// Once the failing API proxy recovers, the whole windows are collected
+	c.cfg.Prometheus.URL = proxyServer(t).URL
+	recovered, err := prometheus.NewClient(c.cfg.Prometheus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.client = recovered
+	if res := c.collectCombined(context.Background(), job); res.succeeded != 2 || len(res.errs) != 0 {
+		t.Fatalf("succeeded %d and failed %d batches after recovery, want 2 and 0: %v", res.succeeded, len(res.errs), res.errs)
+	}
+	want := []string{"/data/requests-00.parquet", "/data/requests-12.parquet"}
+	slices.Sort(store.targets)
+	if !slices.Equal(store.targets, want) {
+		t.Errorf("wrote %v, want %v", store.targets, want)
+	}
+	if through := c.progress.CompletedThrough(combinedCheckpointJob, c.cfg.StartTime, c.cfg.EndTime); !through.Equal(c.cfg.EndTime) {
+		t.Errorf("checkpoint at %s after recovery, want %s", through, c.cfg.EndTime)
+	}
+}
+
+// TestEmptyBatchSkipped checks that range batches without metrics store
+// empty outputs, so a rerun without the checkpoint skips them instead of
+// querying them again
+func TestEmptyBatchSkipped(t *testing.T) {
+	start := time.Date(2025, 4, 7, 0, 0, 0, 0, time.UTC)
+	var queries atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"status":"success","data":{"resultType":"matrix","result":[]}}`)
+	}))
+	t.Cleanup(srv.Close)
+
+	for _, tt := range []struct {
+		name     string
+		override string
+		collect  func(*cycle, context.Context, proxyJob) proxyResult
+	}{
+		{"proxy", "", (*cycle).collectProxy},
+		{"combined", "  combineProxies: true\n", (*cycle).collectCombined},
+		{"streaming", "  streaming: true\n", (*cycle).collectProxy},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, client, store := testCycle(t, srv.URL, start, tt.override)
+			job := proxyJob{client: client, apiProxy: "orders", apiProxies: []string{"orders", "payments"}}
+			if res := tt.collect(c, context.Background(), job); res.succeeded != 2 || len(res.errs) != 0 {
+				t.Fatalf("succeeded %d and failed %d batches, want 2 and 0: %v", res.succeeded, len(res.errs), res.errs)
+			}
+			want := []string{"/data/requests-00.parquet", "/data/requests-12.parquet"}
+			slices.Sort(store.empty)
+			if !slices.Equal(store.empty, want) {
+				t.Errorf("stored empty outputs %v, want %v", store.empty, want)
+			}
+
+			// A rerun without the checkpoint finds the empty outputs
+			c.progress = nil
+			queries.Store(0)
+			tt.collect(c, context.Background(), job)
+			if n := queries.Load(); n != 0 {
+				t.Errorf("rerun sent %d queries for batches already collected", n)
+			}
+		})
+	}
+}
+
+func TestMarkPartitionsDayEnded(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Storage.Location = time.UTC
+	store := &fakeStore{}
+	c := &cycle{cfg: cfg, store: store, partitions: newPartitions()}
+
+	// Today's partition still grows with later cycles; yesterday's is final
+	now := time.Now().UTC()
+	yesterday, today := "/data/"+now.AddDate(0, 0, -1).Format("2006-01-02"), "/data/"+now.Format("2006-01-02")
+	for _, day := range []time.Time{now.AddDate(0, 0, -1), now} {
+		data := storage.PathData{Year: day.Format("2006"), Month: day.Format("01"), Day: day.Format("02")}
+		c.partitionsWritten(data, []string{"/data/" + day.Format("2006-01-02") + "/metrics.parquet"})
+	}
+	if err := c.markPartitions(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !store.markers[yesterday] {
+		t.Errorf("ended day %s was not marked", yesterday)
+	}
+	if complete, ok := store.markers[today]; !ok || complete {
+		t.Errorf("day in progress %s was marked (marker updated %t)", today, ok)
+	}
+}
+
+func TestBatchWindows(t *testing.T) {
+	start := time.Date(2025, 4, 7, 0, 0, 0, 0, time.UTC)
+	cfg := &config.Config{StartTime: start, EndTime: start.Add(14 * time.Hour)}
+	cfg.Prometheus.BatchDuration = 6 * time.Hour
+	cfg.Prometheus.RangeStep = time.Minute
+
+	windows := batchWindows(cfg)
+	wantEnds := []time.Duration{6 * time.Hour, 12 * time.Hour, 14 * time.Hour}
+	if len(windows) != len(wantEnds) {
+		t.Fatalf("got %d windows, want %d", len(windows), len(wantEnds))
+	}
+	next := start
+	for i, w := range windows {
+		// Half-open windows must tile the range: each starts where the last ended
+		if !w.Start.Equal(next) {
+			t.Errorf("window %d starts at %s, want %s", i, w.Start, next)
+		}
+		if want := start.Add(wantEnds[i]); !w.End.Equal(want) {
+			t.Errorf("window %d ends at %s, want %s", i, w.End, want)
+		}
+		if w.Contains(w.End) {
+			t.Errorf("window %d contains its end %s", i, w.End)
+		}
+		next = w.End
+	}
+}
+
+func TestStoreMetricsTimed(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	metrics := []prometheus.MetricResult{{Name: "a"}, {Name: "b"}}
+	failure := errors.New("disk full")
+
+	for _, err := range []error{nil, failure} {
+		store := &fakeStore{delay: delay, err: err}
+		rows, took, gotErr := storeMetricsTimed(context.Background(), store, metrics, "out.parquet")
+		if !errors.Is(gotErr, err) {
+			t.Errorf("error = %v, want %v", gotErr, err)
+		}
+		wantRows := 0
+		if err == nil {
+			wantRows = len(metrics)
+		}
+		if rows != wantRows {
+			t.Errorf("rows = %d, want %d", rows, wantRows)
+		}
+		// Failed stores are timed like successful ones
+		if took < delay {
+			t.Errorf("duration = %s with error %v, want at least %s", took, err, delay)
+		}
+	}
+}
+
+func TestCombinedCheckpointJob(t *testing.T) {
+	// A proxy with the same name would share the combined file's progress
+	if err := config.ValidateAPIProxyName(combinedCheckpointJob); err == nil {
+		t.Errorf("%q is a valid API proxy name", combinedCheckpointJob)
+	}
+}
+
+func TestStoreEmpty(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Prometheus.Metrics = []config.MetricConfig{{Name: "requests"}, {Name: "errors"}}
+	cfg.Storage.Location = time.UTC
+	paths, err := storage.NewPathTemplate("/data", "{{.App}}/{{.MetricName}}.parquet", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &fakeStore{}
+	c := &cycle{cfg: cfg, store: store, paths: paths}
+
+	data := storage.PathData{App: "orders"}
+	start := time.Date(2025, 4, 7, 0, 0, 0, 0, time.UTC)
+	c.setBatch(&data, start, start.Add(time.Hour))
+
+	empty, err := c.storeEmpty(context.Background(), slog.Default(), data, []string{"/data/orders/requests.parquet"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/data/orders/errors.parquet"}
+	if !slices.Equal(empty, want) || !slices.Equal(store.empty, want) {
+		t.Errorf("storeEmpty wrote %v (store saw %v), want %v", empty, store.empty, want)
+	}
+
+	// Outputs that are overwritten anyway, and instant collections, are never checked
+	cfg.Storage.OverwriteExisting = true
+	if empty, _ := c.storeEmpty(context.Background(), slog.Default(), data, nil); len(empty) != 0 {
+		t.Errorf("storeEmpty with overwriteExisting wrote %v", empty)
+	}
+	cfg.Storage.OverwriteExisting = false
+	if empty, _ := c.storeEmpty(context.Background(), slog.Default(), storage.PathData{App: "orders"}, nil); len(empty) != 0 {
+		t.Errorf("storeEmpty for an instant collection wrote %v", empty)
+	}
+}
+
+func TestSetBatchMidnight(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{}
+	cfg.Storage.Location = berlin
+	paths, err := storage.NewPathTemplate("/data", config.DefaultPathTemplate, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &cycle{cfg: cfg, paths: paths}
+
+	// 23:30 UTC on the 6th is 01:30 on the 7th in Berlin, the day the date
+	// column of its samples holds
+	start := time.Date(2025, 4, 6, 23, 30, 0, 0, time.UTC)
+	data := storage.PathData{App: "orders"}
+	c.setBatch(&data, start, start.Add(time.Hour))
+	got, err := paths.Render(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/data/year=2025/month=04/day=07/app=orders/"; !strings.HasPrefix(got, want) {
+		t.Errorf("batch path = %s, want prefix %s", got, want)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kiquetal/go-duckdb-ingester/internal/storage"
+)
+
+// partitions tracks the partition directories a cycle writes to, whether any
+// batch meant for them failed and whether their day is over, so
+// storage.successMarker files are only left in directories that are complete
+type partitions struct {
+	mu sync.Mutex
+
+	// failed is keyed by directory; false when only successful writes were seen
+	failed map[string]bool
+
+	// open holds the directories written for a day that has not ended yet,
+	// which later cycles still add to
+	open map[string]bool
+}
+
+// newPartitions returns an empty partitions tracker
+func newPartitions() *partitions {
+	return &partitions{failed: make(map[string]bool), open: make(map[string]bool)}
+}
+
+// record notes the directories of targets as written, or as failed when ok is
+// unset. open marks them as belonging to a day that has not ended.
+func (p *partitions) record(targets []string, ok, open bool) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, target := range targets {
+		dir := storage.PartitionDir(target)
+		p.failed[dir] = p.failed[dir] || !ok
+		p.open[dir] = p.open[dir] || open
+	}
+}
+
+// partitionsWritten records the files a batch for data wrote successfully
+func (c *cycle) partitionsWritten(data storage.PathData, targets []string) {
+	if c.partitions == nil {
+		return
+	}
+	c.partitions.record(targets, true, !c.dayEnded(data))
+}
+
+// partitionsSkipped records a batch skipped because its output already exists
+// as written, so a partition completed over several runs is still marked
+func (c *cycle) partitionsSkipped(data storage.PathData) {
+	if c.partitions == nil {
+		return
+	}
+	targets, _ := c.batchOutputs(data)
+	c.partitions.record(targets, true, !c.dayEnded(data))
+}
+
+// partitionFailed records a failed batch against every directory it would
+// have written to
+func (c *cycle) partitionFailed(data storage.PathData) {
+	if c.partitions == nil {
+		return
+	}
+	// A path that cannot be rendered was never written either
+	targets, _ := c.batchOutputs(data)
+	c.partitions.record(targets, false, false)
+}
+
+// dayEnded reports whether the partition day of data is over in
+// storage.timezone. Until then later cycles, e.g. scheduled instant
+// collections, keep adding files to its partitions.
+func (c *cycle) dayEnded(data storage.PathData) bool {
+	day, err := time.ParseInLocation("2006-01-02", data.Year+"-"+data.Month+"-"+data.Day, c.cfg.Storage.Location)
+	if err != nil {
+		return false
+	}
+	return !time.Now().Before(day.AddDate(0, 0, 1))
+}
+
+// markPartitions writes the success marker into every directory written
+// without failures whose day has ended, and removes it from the others. An
+// interrupted cycle may have skipped batches of any partition, so it only
+// removes markers.
+func (c *cycle) markPartitions(ctx context.Context) error {
+	if c.partitions == nil {
+		return nil
+	}
+	interrupted := ctx.Err() != nil
+	// Markers must be updated even when the cycle was interrupted
+	ctx = context.WithoutCancel(ctx)
+
+	dirs := make([]string, 0, len(c.partitions.failed))
+	for dir := range c.partitions.failed {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	var errs []error
+	marked := 0
+	for _, dir := range dirs {
+		complete := !c.partitions.failed[dir] && !c.partitions.open[dir] && !interrupted
+		if err := c.store.MarkPartition(ctx, dir, complete); err != nil {
+			slog.Error("Failed to update success marker", "dir", dir, "error", err)
+			errs = append(errs, fmt.Errorf("success marker: %w", err))
+			continue
+		}
+		switch {
+		case complete:
+			marked++
+		case c.partitions.open[dir] && !c.partitions.failed[dir] && !interrupted:
+			slog.Debug("Partition day not over, no success marker written", "dir", dir)
+		default:
+			slog.Info("Partition incomplete, no success marker written", "dir", dir)
+		}
+	}
+	slog.Debug("Updated success markers", "complete", marked, "partitions", len(dirs))
+	return errors.Join(errs...)
+}
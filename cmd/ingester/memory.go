@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// memStatsInterval is how often memory usage is logged during a collection
+const memStatsInterval = 30 * time.Second
+
+// startupMemoryLimit is the Go memory limit the process started with, e.g.
+// from GOMEMLIMIT, restored when softMemoryLimit is removed on reload
+var startupMemoryLimit = debug.SetMemoryLimit(-1)
+
+// applyMemoryLimit sets the Go runtime's soft memory limit to limit bytes, or
+// back to the startup limit when limit is 0
+func applyMemoryLimit(limit int64) {
+	if limit <= 0 {
+		limit = startupMemoryLimit
+	}
+	if previous := debug.SetMemoryLimit(limit); previous != limit {
+		slog.Info("Soft memory limit set", "bytes", limit)
+	}
+}
+
+// logMemStats logs the heap size and GC count at debug level. Reading them
+// briefly stops the world, so nothing is read unless debug logging is on.
+func logMemStats(ctx context.Context, msg string, args ...any) {
+	if !slog.Default().Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	args = append(args,
+		"alloc_bytes", m.HeapAlloc,
+		"heap_inuse_bytes", m.HeapInuse,
+		"heap_sys_bytes", m.HeapSys,
+		"sys_bytes", m.Sys,
+		"num_gc", m.NumGC,
+	)
+	slog.DebugContext(ctx, msg, args...)
+}
+
+// watchMemory logs memory usage every memStatsInterval until the returned
+// function is called
+func watchMemory(ctx context.Context) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(memStatsInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				logMemStats(ctx, "Memory usage")
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/kiquetal/go-duckdb-ingester/internal/prometheus"
+	"github.com/kiquetal/go-duckdb-ingester/internal/storage"
+	"github.com/kiquetal/go-duckdb-ingester/internal/telemetry"
+)
+
+// queriedBatch is a range batch whose metrics were collected and are ready to
+// be written
+type queriedBatch struct {
+	logger *slog.Logger
+	window prometheus.TimeRange
+	data   storage.PathData
+
+	// metrics and rollups are written to the batch's data and rollup paths
+	metrics []prometheus.MetricResult
+	rollups []prometheus.MetricResult
+
+	// wrap qualifies a write error with the job and batch it belongs to
+	wrap func(error) error
+}
+
+// batchWriter writes the queried batches of one job. With
+// prometheus.pipelineDepth set, batches are written in the background while the
+// next one is queried; up to that many queried batches wait in between.
+// Otherwise each batch is written before write returns.
+type batchWriter struct {
+	c       *cycle
+	batches *batchTracker
+
+	// proxy is the api_proxy label of the telemetry recorded for the writes
+	proxy string
+
+	// res records the writes; read it through wait
+	res proxyResult
+
+	// pending feeds the background writer, which closes done when it is
+	// drained; both are nil when writes are not pipelined
+	pending chan queriedBatch
+	done    chan struct{}
+}
+
+// newBatchWriter returns a writer for a job's batches, starting the
+// background writer when pipelining is enabled
+func (c *cycle) newBatchWriter(ctx context.Context, batches *batchTracker, proxy string) *batchWriter {
+	w := &batchWriter{c: c, batches: batches, proxy: proxy}
+	depth := c.cfg.Prometheus.PipelineDepth
+	if depth == 0 {
+		return w
+	}
+
+	w.pending = make(chan queriedBatch, depth)
+	w.done = make(chan struct{})
+	go func() {
+		defer close(w.done)
+		// Batches queued before an abort are still drained; their writes fail
+		// fast on the cancelled context
+		for b := range w.pending {
+			w.store(ctx, b)
+		}
+	}()
+	return w
+}
+
+// write stores b, or queues it for the background writer. A full queue blocks
+// until the writer catches up.
+func (w *batchWriter) write(ctx context.Context, b queriedBatch) {
+	if w.pending == nil {
+		w.store(ctx, b)
+		return
+	}
+	w.pending <- b
+}
+
+// wait waits for the queued batches to be written and returns the results of
+// every write
+func (w *batchWriter) wait() proxyResult {
+	if w.pending != nil {
+		close(w.pending)
+		<-w.done
+	}
+	return w.res
+}
+
+// store writes a batch's metrics and rollups and records the outcome
+func (w *batchWriter) store(ctx context.Context, b queriedBatch) {
+	c := w.c
+	targets, rows, writeDuration, err := storeRendered(ctx, c.store, c.paths, b.data, b.metrics)
+	if err != nil {
+		b.logger.Error("Error storing metrics", "duration", writeDuration, "error", err)
+		telemetry.IncStorageErrors(w.proxy)
+		c.fail(&w.res, b.wrap(err))
+		c.partitionFailed(b.data)
+	} else if rollupTargets, err := c.storeRollups(ctx, b.logger, b.data, b.rollups); err != nil {
+		telemetry.IncStorageErrors(w.proxy)
+		c.fail(&w.res, b.wrap(err))
+		c.partitionFailed(b.data)
+	} else if emptyTargets, err := c.storeEmpty(ctx, b.logger, b.data, append(targets, rollupTargets...)); err != nil {
+		b.logger.Error("Error storing empty outputs", "error", err)
+		telemetry.IncStorageErrors(w.proxy)
+		c.fail(&w.res, b.wrap(err))
+		c.partitionFailed(b.data)
+	} else {
+		c.partitionsWritten(b.data, append(append(targets, rollupTargets...), emptyTargets...))
+		w.res.succeeded++
+		w.res.stored(b.metrics, rows, writeDuration)
+		w.batches.complete(b.logger, b.window.Start, b.window.End)
+		telemetry.AddRowsWritten(w.proxy, rows)
+		b.logger.Info("Successfully stored metrics", "paths", targets, "rows", rows, "duration", writeDuration)
+	}
+
+	// Release the batch before the next one is collected
+	b.metrics, b.rollups = nil, nil
+	logMemStats(ctx, "Memory usage after batch", "api_proxy", w.proxy, "batch_start", b.window.Start, "batch_end", b.window.End)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/kiquetal/go-duckdb-ingester/internal/telemetry"
+)
+
+// backfillProgress reports how many of a job's range batches were processed,
+// whether they were stored, failed or skipped, in the log and on /metrics
+type backfillProgress struct {
+	logger *slog.Logger
+
+	// job labels the progress metric: the API proxy, or "combined"
+	job   string
+	total int
+}
+
+// newBackfillProgress starts reporting the progress of a job of total batches
+func newBackfillProgress(logger *slog.Logger, job string, total int) *backfillProgress {
+	telemetry.SetBackfillProgress(job, 0, total)
+	return &backfillProgress{logger: logger, job: job, total: total}
+}
+
+// report records that done batches were processed; a nil progress, as for
+// instant collections, reports nothing
+func (p *backfillProgress) report(done int) {
+	if p == nil || done == 0 {
+		return
+	}
+	percent := done * 100 / p.total
+	p.logger.Info("Backfill progress", "batch", fmt.Sprintf("%d/%d", done, p.total), "percent", percent)
+	telemetry.SetBackfillProgress(p.job, done, p.total)
+}
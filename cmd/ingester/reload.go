@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"time"
+
+	"github.com/kiquetal/go-duckdb-ingester/internal/prometheus"
+	"github.com/kiquetal/go-duckdb-ingester/internal/storage"
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+// flagOverrides holds the command line flags that override the configuration
+// file; they are applied again whenever the file is reloaded
+type flagOverrides struct {
+	startTime     string
+	endTime       string
+	atTime        string
+	useRangeQuery bool
+	runOnce       bool
+	dryRun        bool
+	failFast      bool
+
+	// metricsFile lists metrics collected in addition to the configured ones
+	metricsFile string
+
+	// skipPrometheusCheck skips the startup check that Prometheus is reachable
+	skipPrometheusCheck bool
+}
+
+// apply overrides cfg with the command line flags that were provided
+func (f flagOverrides) apply(cfg *config.Config) error {
+	if f.useRangeQuery {
+		cfg.Prometheus.UseRangeQuery = true
+	}
+	if f.runOnce {
+		cfg.OneShot = true
+	}
+	if f.failFast {
+		cfg.FailFast = true
+	}
+	if f.dryRun {
+		// A dry run never writes, so there is nothing to repeat
+		cfg.DryRun = true
+		cfg.OneShot = true
+	}
+
+	if f.atTime != "" && (f.useRangeQuery || f.startTime != "" || f.endTime != "") {
+		return errors.New("--at applies to instant queries and cannot be combined with --range, --start or --end")
+	}
+
+	// Parse start and end times if provided
+	if (f.startTime == "") != (f.endTime == "") {
+		return errors.New("both --start and --end must be provided for a range query")
+	}
+	if f.startTime != "" {
+		startTime, err := time.Parse(time.RFC3339, f.startTime)
+		if err != nil {
+			return fmt.Errorf("failed to parse start time: %w", err)
+		}
+
+		endTime, err := time.Parse(time.RFC3339, f.endTime)
+		if err != nil {
+			return fmt.Errorf("failed to parse end time: %w", err)
+		}
+
+		// Store the time range in the configuration
+		cfg.Prometheus.UseRangeQuery = true
+		cfg.StartTime = startTime
+		cfg.EndTime = endTime
+
+		if err := cfg.ValidateTimeRange(); err != nil {
+			return fmt.Errorf("invalid time range: %w", err)
+		}
+		slog.Info("Range queries will be split into batches", "batch_duration", cfg.Prometheus.BatchDuration)
+	}
+
+	// Parse the instant query evaluation time if provided
+	if f.atTime != "" {
+		at, err := time.Parse(time.RFC3339, f.atTime)
+		if err != nil {
+			return fmt.Errorf("failed to parse evaluation time: %w", err)
+		}
+		if at.After(time.Now()) {
+			return fmt.Errorf("evaluation time %s must not be in the future", at.Format(time.RFC3339))
+		}
+
+		// A pinned snapshot would be identical on every interval, so collect it once
+		cfg.EvaluationTime = at
+		cfg.OneShot = true
+		slog.Info("Instant queries will be evaluated at a fixed time", "at", at)
+	}
+
+	return nil
+}
+
+// collector is the configuration in effect for collection cycles together
+// with the Prometheus clients and path templates built from it. A reload
+// replaces it as a whole between cycles.
+type collector struct {
+	cfg     *config.Config
+	clients []*prometheus.Client
+	paths   *storage.PathTemplate
+
+	// rollups renders rollup output paths; nil when rollups are disabled
+	rollups *storage.PathTemplate
+
+	// processors transform collected samples before they are stored
+	processors prometheus.Processors
+}
+
+// newCollector creates one Prometheus client per source and parses the output
+// path template, so mistakes fail before any collection starts
+func newCollector(cfg *config.Config) (*collector, error) {
+	clients, err := newClients(cfg)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := newPaths(cfg)
+	if err != nil {
+		return nil, err
+	}
+	rollups, err := newRollupPaths(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &collector{cfg: cfg, clients: clients, paths: paths, rollups: rollups,
+		processors: prometheus.NewProcessors(cfg.Processors)}, nil
+}
+
+// newPaths parses the output path template, with the metrics configured with
+// separateFile written to their own files
+func newPaths(cfg *config.Config) (*storage.PathTemplate, error) {
+	var separate []string
+	for _, metric := range cfg.Prometheus.AllMetrics() {
+		if metric.SeparateFile {
+			separate = append(separate, metric.Name)
+		}
+	}
+
+	paths, err := storage.NewPathTemplate(cfg.Storage.OutputDir, cfg.Storage.PathTemplate, separate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage path template: %w", err)
+	}
+	if paths.Split() && cfg.Storage.Streaming {
+		return nil, errors.New("storage.streaming writes one file per batch and cannot be combined with {{.MetricName}} in storage.pathTemplate or separateFile metrics")
+	}
+	return paths, nil
+}
+
+// newRollupPaths parses the output path template below rollup.outputDir, or
+// returns nil when rollups are disabled. DuckDB storage only uses the paths to
+// identify batches, so they fall back to storage.outputDir.
+func newRollupPaths(cfg *config.Config) (*storage.PathTemplate, error) {
+	if !cfg.Rollup.Enabled {
+		return nil, nil
+	}
+
+	var separate []string
+	for _, metric := range cfg.Prometheus.AllMetrics() {
+		if metric.SeparateFile {
+			separate = append(separate, metric.Name)
+		}
+	}
+
+	outputDir := cfg.Rollup.OutputDir
+	if outputDir == "" {
+		outputDir = cfg.Storage.OutputDir
+	}
+	paths, err := storage.NewPathTemplate(outputDir, cfg.Storage.PathTemplate, separate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage path template: %w", err)
+	}
+	return paths, nil
+}
+
+// newClients creates one Prometheus client per configured source
+func newClients(cfg *config.Config) ([]*prometheus.Client, error) {
+	var clients []*prometheus.Client
+	for _, promCfg := range cfg.PrometheusSources() {
+		client, err := prometheus.NewClient(promCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Prometheus client for %s: %w", promCfg.URL, err)
+		}
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+// reload loads the configuration files again and returns the collector
+// to use from the next cycle. Settings bound to resources opened at startup
+// (storage, checkpoint, HTTP servers, run mode) keep their running values and
+// a warning asks for a restart. The Prometheus clients are only recreated if
+// their settings changed.
+func (c *collector) reload(files []string, overrides flagOverrides) (*collector, error) {
+	cfg, err := config.LoadConfigWithMetrics(overrides.metricsFile, files...)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Storage.InvocationID = invocationID
+	if err := overrides.apply(cfg); err != nil {
+		return nil, err
+	}
+
+	keep := func(name string, running, reloaded any, restore func()) {
+		if !reflect.DeepEqual(running, reloaded) {
+			slog.Warn("Configuration change requires a restart to take effect, keeping the running value", "setting", name)
+			restore()
+		}
+	}
+	keep("storage", c.cfg.Storage, cfg.Storage, func() { cfg.Storage = c.cfg.Storage })
+	keep("checkpointFile", c.cfg.CheckpointFile, cfg.CheckpointFile, func() { cfg.CheckpointFile = c.cfg.CheckpointFile })
+	keep("telemetry", c.cfg.Telemetry, cfg.Telemetry, func() { cfg.Telemetry = c.cfg.Telemetry })
+	keep("health", c.cfg.Health, cfg.Health, func() { cfg.Health = c.cfg.Health })
+	keep("tracing", c.cfg.Tracing, cfg.Tracing, func() { cfg.Tracing = c.cfg.Tracing })
+	keep("oneShot", c.cfg.OneShot, cfg.OneShot, func() { cfg.OneShot = c.cfg.OneShot })
+
+	// The template itself is part of storage, but metrics may have changed
+	// separateFile and rollups may have been toggled
+	paths, err := newPaths(cfg)
+	if err != nil {
+		return nil, err
+	}
+	rollups, err := newRollupPaths(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	next := &collector{cfg: cfg, clients: c.clients, paths: paths, rollups: rollups,
+		processors: prometheus.NewProcessors(cfg.Processors)}
+	if !reflect.DeepEqual(c.cfg.PrometheusSources(), cfg.PrometheusSources()) {
+		next.clients, err = newClients(cfg)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Prometheus settings changed, recreated clients", "sources", len(next.clients))
+	}
+
+	setupLogging(cfg)
+	logDisabledMetrics(cfg)
+	applyMemoryLimit(cfg.SoftMemoryLimit)
+	return next, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+func TestFlagOverridesAt(t *testing.T) {
+	const at = "2025-04-07T12:00:00Z"
+	tests := []struct {
+		name      string
+		overrides flagOverrides
+	}{
+		{"with --range", flagOverrides{atTime: at, useRangeQuery: true}},
+		{"with --start and --end", flagOverrides{atTime: at, startTime: "2025-04-07T00:00:00Z", endTime: "2025-04-07T06:00:00Z"}},
+		{"with --start", flagOverrides{atTime: at, startTime: "2025-04-07T00:00:00Z"}},
+		{"with --end", flagOverrides{atTime: at, endTime: "2025-04-07T06:00:00Z"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.overrides.apply(&config.Config{})
+			if err == nil || !strings.Contains(err.Error(), "--at applies to instant queries") {
+				t.Errorf("apply error = %v, want the --at conflict", err)
+			}
+		})
+	}
+
+	cfg := &config.Config{}
+	if err := (flagOverrides{atTime: at}).apply(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := time.Parse(time.RFC3339, at); !cfg.EvaluationTime.Equal(want) || !cfg.OneShot {
+		t.Errorf("EvaluationTime = %s, OneShot = %t, want %s and true", cfg.EvaluationTime, cfg.OneShot, want)
+	}
+}
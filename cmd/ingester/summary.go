@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/kiquetal/go-duckdb-ingester/internal/prometheus"
+	"github.com/kiquetal/go-duckdb-ingester/internal/storage"
+)
+
+// runSummary is the machine-readable report of one collection cycle written
+// when storage.writeRunSummary is set
+type runSummary struct {
+	RunID           string       `json:"run_id"`
+	InvocationID    string       `json:"invocation_id"`
+	Started         time.Time    `json:"started"`
+	DurationSeconds float64      `json:"duration_seconds"`
+	Succeeded       int          `json:"succeeded"`
+	Failed          int          `json:"failed"`
+	Jobs            []jobSummary `json:"jobs"`
+	Errors          []string     `json:"errors,omitempty"`
+}
+
+// jobSummary reports one API proxy, or one combined file, of one source
+type jobSummary struct {
+	Source     string   `json:"source,omitempty"`
+	APIProxy   string   `json:"api_proxy,omitempty"`
+	APIProxies []string `json:"api_proxies,omitempty"`
+
+	Succeeded int `json:"succeeded"`
+	Rows      int `json:"rows"`
+
+	// MetricRows counts the stored rows per metric; streamed batches are only
+	// counted in Rows
+	MetricRows map[string]int `json:"metric_rows,omitempty"`
+
+	// QuerySeconds includes the write time of streamed batches, which cannot
+	// be told apart from the query
+	QuerySeconds float64  `json:"query_seconds"`
+	WriteSeconds float64  `json:"write_seconds"`
+	Errors       []string `json:"errors,omitempty"`
+}
+
+// stored records metrics written by a successful store in the job's result
+func (r *proxyResult) stored(metrics []prometheus.MetricResult, rows int, writeDuration time.Duration) {
+	r.rows += rows
+	r.writeDuration += writeDuration
+	if r.metricRows == nil {
+		r.metricRows = make(map[string]int)
+	}
+	for _, metric := range metrics {
+		r.metricRows[metric.Name]++
+	}
+}
+
+// merge adds the outcomes recorded in other, such as a job's pipelined
+// writes, to the job's result
+func (r *proxyResult) merge(other proxyResult) {
+	r.succeeded += other.succeeded
+	r.errs = append(r.errs, other.errs...)
+	r.rows += other.rows
+	r.queryDuration += other.queryDuration
+	r.writeDuration += other.writeDuration
+	for metric, rows := range other.metricRows {
+		if r.metricRows == nil {
+			r.metricRows = make(map[string]int)
+		}
+		r.metricRows[metric] += rows
+	}
+}
+
+// newRunSummary builds the summary of a cycle from its jobs and their results
+func newRunSummary(c *cycle, started time.Time, duration time.Duration, jobs []proxyJob, results []proxyResult, cycleErrs []error) runSummary {
+	summary := runSummary{
+		RunID:           c.runID,
+		InvocationID:    invocationID,
+		Started:         started.UTC(),
+		DurationSeconds: duration.Seconds(),
+		Jobs:            make([]jobSummary, 0, len(jobs)),
+	}
+	for _, err := range cycleErrs {
+		summary.Errors = append(summary.Errors, err.Error())
+	}
+
+	for i, job := range jobs {
+		res := results[i]
+		js := jobSummary{
+			Source:       job.source,
+			APIProxy:     job.apiProxy,
+			APIProxies:   job.apiProxies,
+			Succeeded:    res.succeeded,
+			Rows:         res.rows,
+			MetricRows:   res.metricRows,
+			QuerySeconds: res.queryDuration.Seconds(),
+			WriteSeconds: res.writeDuration.Seconds(),
+		}
+		for _, err := range res.errs {
+			js.Errors = append(js.Errors, err.Error())
+		}
+		summary.Succeeded += res.succeeded
+		summary.Failed += len(res.errs)
+		summary.Jobs = append(summary.Jobs, js)
+	}
+	summary.Failed += len(cycleErrs)
+	return summary
+}
+
+// writeRunSummary stores the summary as run-summary-<run id>.json below the output directory
+func writeRunSummary(ctx context.Context, store storage.Storage, summary runSummary) (string, error) {
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode run summary: %w", err)
+	}
+	name := "run-summary-" + summary.RunID + ".json"
+	return name, store.WriteReport(ctx, name, data)
+}
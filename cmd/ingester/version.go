@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information, set at link time:
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse HEAD) \
+//	  -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)" ./cmd/ingester
+//
+// Values left unset are filled from the build info Go embeds in the binary
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+// buildInfo is the version, commit and build date of the running binary
+type buildInfo struct {
+	Version   string
+	Commit    string
+	BuildDate string
+	Modified  bool
+	GoVersion string
+}
+
+// readBuildInfo combines the link-time variables with the module version and
+// VCS settings recorded by the Go toolchain
+func readBuildInfo() buildInfo {
+	info := buildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		// "(devel)" is what go build reports outside of a module download
+		if info.Version == "" && bi.Main.Version != "(devel)" {
+			info.Version = bi.Main.Version
+		}
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = setting.Value
+				}
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+	}
+
+	if info.Version == "" {
+		info.Version = "dev"
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+// printVersion writes the build information, one line per field
+func printVersion(w io.Writer) {
+	info := readBuildInfo()
+	commit := info.Commit
+	if info.Modified {
+		commit += " (modified)"
+	}
+	fmt.Fprintf(w, "version:    %s\ncommit:     %s\nbuild date: %s\ngo:         %s\n",
+		info.Version, commit, info.BuildDate, info.GoVersion)
+}
@@ -0,0 +1,39 @@
+// Package backoff computes the delays between retries of Prometheus requests
+// and storage writes
+package backoff
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+// MaxDelay caps the doubled delay, so that many retries do not wait for
+// hours; write retries have no deadline to stop them
+const MaxDelay = time.Minute
+
+// Delay returns how long to wait before retrying after attempt (0 for the
+// first failure). The delay doubles each attempt starting from base, up to
+// MaxDelay or base if that is longer, and a random duration in
+// [delay/2, delay] is returned so that concurrent retries spread out.
+func Delay(base time.Duration, attempt int) time.Duration {
+	delay := base
+	// Doubling stops at MaxDelay, long before it could overflow
+	for ; attempt > 0 && delay < MaxDelay; attempt-- {
+		delay *= 2
+	}
+	delay = min(delay, max(base, MaxDelay))
+	return delay/2 + time.Duration(rand.Int64N(int64(delay/2)+1))
+}
+
+// Sleep waits for delay, returning false early if ctx is done first
+func Sleep(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
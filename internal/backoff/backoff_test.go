@@ -0,0 +1,47 @@
+package backoff
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     time.Duration
+		attempt  int
+		min, max time.Duration
+	}{
+		{"first retry", time.Second, 0, 500 * time.Millisecond, time.Second},
+		{"doubles", time.Second, 3, 4 * time.Second, 8 * time.Second},
+		{"capped", time.Second, 10, MaxDelay / 2, MaxDelay},
+		{"capped without overflow", time.Second, 63, MaxDelay / 2, MaxDelay},
+		{"base above the cap", 2 * MaxDelay, 3, MaxDelay, 2 * MaxDelay},
+		{"no backoff", 0, 2, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for range 100 {
+				if got := Delay(tt.base, tt.attempt); got < tt.min || got > tt.max {
+					t.Fatalf("Delay(%s, %d) = %s, want within [%s, %s]", tt.base, tt.attempt, got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+	if got := Delay(math.MaxInt64, 0); got <= 0 {
+		t.Errorf("Delay(max, 0) = %s, want positive", got)
+	}
+}
+
+func TestSleep(t *testing.T) {
+	if !Sleep(context.Background(), time.Millisecond) {
+		t.Error("Sleep returned false without cancellation")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if Sleep(ctx, time.Hour) {
+		t.Error("Sleep returned true for a cancelled context")
+	}
+}
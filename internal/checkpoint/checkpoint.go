@@ -0,0 +1,108 @@
+package checkpoint
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Progress records how far a range backfill of one job has completed
+type Progress struct {
+	// Start and End identify the requested range; progress for a different
+	// range is not reused
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	// CompletedThrough is the end of the last batch in the contiguous run of
+	// batches written since Start
+	CompletedThrough time.Time `json:"completed_through"`
+}
+
+// Checkpoint persists backfill progress per job (source and API proxy) so an
+// interrupted run can resume. A nil Checkpoint disables checkpointing.
+type Checkpoint struct {
+	path string
+
+	mu   sync.Mutex
+	jobs map[string]Progress
+}
+
+// Open loads the checkpoint file at path, starting empty if it does not exist.
+// When resume is false previous progress is discarded, forcing a full re-run.
+func Open(path string, resume bool) (*Checkpoint, error) {
+	c := &Checkpoint{path: path, jobs: make(map[string]Progress)}
+	if !resume {
+		return c, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint file: %w", err)
+	}
+	if err := json.Unmarshal(data, &c.jobs); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint file %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// CompletedThrough returns the time up to which job has completed the range
+// [start, end), or start when nothing of that range was completed yet
+func (c *Checkpoint) CompletedThrough(job string, start, end time.Time) time.Time {
+	if c == nil {
+		return start
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.jobs[job]
+	if !ok || !p.Start.Equal(start) || !p.End.Equal(end) {
+		return start
+	}
+	return p.CompletedThrough
+}
+
+// Advance records that job has completed the range [start, end) up to through
+// and saves the checkpoint file
+func (c *Checkpoint) Advance(job string, start, end, through time.Time) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.jobs[job] = Progress{Start: start, End: end, CompletedThrough: through}
+	return c.save()
+}
+
+// save writes the checkpoint through a temporary file so a crash mid-write
+// never leaves a truncated checkpoint behind
+func (c *Checkpoint) save() error {
+	data, err := json.MarshalIndent(c.jobs, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode checkpoint: %w", err)
+	}
+
+	if dir := filepath.Dir(c.path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create checkpoint directory: %w", err)
+		}
+	}
+
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write checkpoint file: %w", err)
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return fmt.Errorf("failed to replace checkpoint file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package prometheus
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenRefreshInterval controls how often a bearer token file is re-read so
+// rotated credentials are picked up without a restart
+const tokenRefreshInterval = 1 * time.Minute
+
+// basicAuthRoundTripper sets HTTP basic auth credentials on every request
+type basicAuthRoundTripper struct {
+	next     http.RoundTripper
+	username string
+	password string
+}
+
+// RoundTrip implements http.RoundTripper
+func (rt *basicAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the caller's request
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(rt.username, rt.password)
+	return rt.next.RoundTrip(req)
+}
+
+// bearerAuthRoundTripper injects an Authorization: Bearer header on every request
+type bearerAuthRoundTripper struct {
+	next      http.RoundTripper
+	token     string
+	tokenFile string
+
+	mu       sync.Mutex
+	cached   string
+	loadedAt time.Time
+}
+
+func newBearerAuthRoundTripper(token, tokenFile string, next http.RoundTripper) (*bearerAuthRoundTripper, error) {
+	rt := &bearerAuthRoundTripper{
+		next:      next,
+		token:     token,
+		tokenFile: tokenFile,
+	}
+
+	// Read the token file once up front so a bad path fails at startup
+	if tokenFile != "" {
+		if _, err := rt.currentToken(); err != nil {
+			return nil, err
+		}
+	}
+
+	return rt, nil
+}
+
+// RoundTrip implements http.RoundTripper
+func (rt *bearerAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := rt.currentToken()
+	if err != nil {
+		return nil, err
+	}
+
+	// RoundTrippers must not modify the caller's request
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return rt.next.RoundTrip(req)
+}
+
+// currentToken returns the static token, or the token file contents refreshed
+// at most once per tokenRefreshInterval
+func (rt *bearerAuthRoundTripper) currentToken() (string, error) {
+	if rt.tokenFile == "" {
+		return rt.token, nil
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if rt.cached != "" && time.Since(rt.loadedAt) < tokenRefreshInterval {
+		return rt.cached, nil
+	}
+
+	data, err := os.ReadFile(rt.tokenFile)
+	if err != nil {
+		// Keep using the last good token if the file is briefly unavailable mid-rotation
+		if rt.cached != "" {
+			return rt.cached, nil
+		}
+		return "", fmt.Errorf("failed to read bearer token file: %w", err)
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("bearer token file %s is empty", rt.tokenFile)
+	}
+
+	rt.cached = token
+	rt.loadedAt = time.Now()
+	return token, nil
+}
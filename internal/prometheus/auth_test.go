@@ -0,0 +1,37 @@
+package prometheus
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBasicAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		override string
+		wantAuth string
+	}{
+		{"credentials", "prometheus: {username: alice, password: s3cret}", "Basic YWxpY2U6czNjcmV0"},
+		{"no credentials", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotAuth string
+			srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				gotAuth = r.Header.Get("Authorization")
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(emptyVector))
+			})
+
+			client, _ := newTestClient(t, srv.URL, tt.override)
+			if _, err := client.CollectMetrics(context.Background(), "orders", time.Now()); err != nil {
+				t.Fatal(err)
+			}
+			if gotAuth != tt.wantAuth {
+				t.Errorf("Authorization = %q, want %q", gotAuth, tt.wantAuth)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+// errBatchTimeout is the cancellation cause of a batch that ran past
+// prometheus.batchTimeout
+var errBatchTimeout = errors.New("batch timeout exceeded")
+
+// batch tracks the metrics of one collect call that have not finished yet and
+// carries the deadline shared by all of their queries
+type batch struct {
+	ctx     context.Context
+	timeout string
+
+	mu      sync.Mutex
+	pending map[string]struct{}
+}
+
+// newBatch derives the shared context for collecting metrics, bounded by
+// prometheus.batchTimeout if set. The returned cancel func must be called once
+// the batch is done.
+func (c *Client) newBatch(ctx context.Context, metrics []config.MetricConfig) (*batch, context.CancelFunc) {
+	b := &batch{ctx: ctx, pending: make(map[string]struct{}, len(metrics))}
+	for _, m := range metrics {
+		b.pending[m.Name] = struct{}{}
+	}
+
+	cancel := context.CancelFunc(func() {})
+	if c.config.BatchTimeout > 0 {
+		b.ctx, cancel = context.WithTimeoutCause(ctx, c.config.BatchTimeout, errBatchTimeout)
+		b.timeout = c.config.BatchTimeout.String()
+	}
+	return b, cancel
+}
+
+// finish records that metric is done, unless err shows it was cut short by
+// the batch deadline
+func (b *batch) finish(metric string, err error) {
+	if err != nil && context.Cause(b.ctx) == errBatchTimeout {
+		return
+	}
+
+	b.mu.Lock()
+	delete(b.pending, metric)
+	b.mu.Unlock()
+}
+
+// err reports the metrics that did not finish before the batch deadline, or
+// nil if the deadline was not hit
+func (b *batch) err() error {
+	if context.Cause(b.ctx) != errBatchTimeout {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.pending) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(b.pending))
+	for name := range b.pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("batch timeout of %s exceeded, metrics not finished: %s", b.timeout, strings.Join(names, ", "))
+}
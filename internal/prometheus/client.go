@@ -2,21 +2,35 @@ package prometheus
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"net/http"
 	"sync"
 	"time"
 
+	"github.com/kiquetal/go-duckdb-ingester/internal/telemetry"
 	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
 	"github.com/prometheus/client_golang/api"
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/common/model"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/time/rate"
 )
 
+// stringValueLabel is the label holding the raw value of string query results
+const stringValueLabel = "string_value"
+
 // Client handles communication with Prometheus API
 type Client struct {
 	api    v1.API
+	client api.Client
 	config config.PrometheusConfig
+
+	// querySem bounds the number of in-flight queries (nil means unlimited)
+	querySem chan struct{}
+
+	// limiter caps the rate of requests to this server (nil means unlimited)
+	limiter *rate.Limiter
 }
 
 // MetricResult represents a collected metric with its values
@@ -25,26 +39,99 @@ type MetricResult struct {
 	Timestamp time.Time
 	Value     float64
 	Labels    map[string]string
+
+	// Source identifies the Prometheus server the result came from
+	Source string
+
+	// APIProxy is the API proxy the result was collected for, the api_proxy
+	// column when none of storage.apiProxyLabelKeys is among its labels
+	APIProxy string
+
+	// CollectedAt is when the query returning the result ran, zero unless
+	// prometheus.recordCollectedAt is set
+	CollectedAt time.Time
+
+	// InvocationID is the ingester invocation that collected a result read
+	// back from a file, empty for results of the current one
+	InvocationID string
 }
 
-// TimeRange represents a time range for querying metrics
+// TimeRange represents a half-open time range [Start, End) for querying metrics.
+// A sample exactly at End belongs to the next range, so adjacent batches never
+// return the same point twice.
 type TimeRange struct {
 	Start time.Time
 	End   time.Time
 	Step  time.Duration
 }
 
-// NewClient creates a new Prometheus client
+// Contains reports whether t falls within the half-open range [Start, End)
+func (r TimeRange) Contains(t time.Time) bool {
+	return !t.Before(r.Start) && t.Before(r.End)
+}
+
+// alignToStep rounds t down to a multiple of step since the Unix epoch
+func alignToStep(t time.Time, step time.Duration) time.Time {
+	if step <= 0 {
+		return t
+	}
+	ns := t.UnixNano()
+	offset := ns % int64(step)
+	if offset < 0 {
+		offset += int64(step)
+	}
+	return time.Unix(0, ns-offset).In(t.Location())
+}
+
+// NewClient creates a new Prometheus client. Each API proxy is collected with
+// its enabled metrics, see config.PrometheusConfig.MetricsFor.
 func NewClient(cfg config.PrometheusConfig) (*Client, error) {
-	clientConfig := api.Config{
-		Address: cfg.URL,
+	roundTripper := api.DefaultRoundTripper
+
+	// Use a dedicated transport when TLS or proxy settings are provided
+	tlsConfig, err := newTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("error configuring TLS: %w", err)
+	}
+	if tlsConfig != nil || cfg.HTTPProxy != "" {
+		transport := api.DefaultRoundTripper.(*http.Transport).Clone()
+		if tlsConfig != nil {
+			transport.TLSClientConfig = tlsConfig
+		}
+		transport.Proxy, err = proxyFunc(cfg.HTTPProxy)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring HTTP proxy: %w", err)
+		}
+		roundTripper = transport
 	}
 
 	// Add basic auth if provided
-	if cfg.Username != "" && cfg.Password != "" {
-		clientConfig.RoundTripper = api.DefaultRoundTripper
-		// Note: In a production environment, you might want to use a more secure
-		// way to handle authentication
+	if cfg.Username != "" || cfg.Password != "" {
+		roundTripper = &basicAuthRoundTripper{
+			next:     roundTripper,
+			username: cfg.Username,
+			password: cfg.Password,
+		}
+	}
+
+	// Add bearer token auth if provided
+	if cfg.BearerToken != "" || cfg.BearerTokenFile != "" {
+		rt, err := newBearerAuthRoundTripper(cfg.BearerToken, cfg.BearerTokenFile, roundTripper)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring bearer token auth: %w", err)
+		}
+		roundTripper = rt
+	}
+
+	// Pass per-query lookback deltas, which the v1 API has no option for
+	roundTripper = &lookbackRoundTripper{next: roundTripper}
+
+	// Keep the Retry-After header of 429 responses, which the v1 API discards
+	roundTripper = &throttleRoundTripper{next: roundTripper}
+
+	clientConfig := api.Config{
+		Address:      cfg.URL,
+		RoundTripper: roundTripper,
 	}
 
 	client, err := api.NewClient(clientConfig)
@@ -52,239 +139,342 @@ func NewClient(cfg config.PrometheusConfig) (*Client, error) {
 		return nil, fmt.Errorf("error creating Prometheus client: %w", err)
 	}
 
-	return &Client{
+	c := &Client{
 		api:    v1.NewAPI(client),
+		client: client,
 		config: cfg,
-	}, nil
-}
+	}
+	if cfg.MaxConcurrentQueries > 0 {
+		c.querySem = make(chan struct{}, cfg.MaxConcurrentQueries)
+	}
+	if cfg.QueriesPerSecond > 0 {
+		// A burst of one keeps the rate steady instead of front-loading a cycle
+		c.limiter = rate.NewLimiter(rate.Limit(cfg.QueriesPerSecond), 1)
+	}
 
-// CollectMetrics gathers metrics for a specific API proxy
-func (c *Client) CollectMetrics(apiProxy string) ([]MetricResult, error) {
-	// Use channels to collect results and errors from goroutines
-	resultsChan := make(chan []MetricResult, len(c.config.Metrics))
-	errorsChan := make(chan error, len(c.config.Metrics))
-	warningsChan := make(chan []string, len(c.config.Metrics))
+	return c, nil
+}
 
-	// Create a wait group to wait for all goroutines to finish
-	var wg sync.WaitGroup
+// Source returns the name of the Prometheus server this client collects from
+func (c *Client) Source() string {
+	return c.config.SourceName
+}
 
-	// Launch a goroutine for each metric
-	for _, metricCfg := range c.config.Metrics {
-		wg.Add(1)
-		go func(cfg config.MetricConfig) {
-			defer wg.Done()
+// pingTimeout bounds the startup check of Ping, so an unreachable server is
+// reported quickly; prometheus.timeout applies when it is shorter
+const pingTimeout = 10 * time.Second
+
+// Ping checks that the server answers queries by evaluating the constant
+// expression 1, which also verifies the credentials. It is not retried.
+func (c *Client) Ping(ctx context.Context) error {
+	timeout := min(pingTimeout, c.config.Timeout)
+	pingCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	_, _, err := c.api.Query(pingCtx, "1", time.Now())
+	switch {
+	case err == nil:
+		return nil
+	case ctx.Err() != nil:
+		return fmt.Errorf("test query to %s interrupted: %w", c.config.URL, ctx.Err())
+	case errors.Is(pingCtx.Err(), context.DeadlineExceeded):
+		return fmt.Errorf("%s did not answer a test query within %s: %w", c.config.URL, timeout, err)
+	default:
+		return fmt.Errorf("test query to %s failed: %w", c.config.URL, err)
+	}
+}
 
-			// Replace placeholder in query with actual API proxy name
-			query := replaceAPIProxyInQuery(cfg.Query, apiProxy)
+// queryTimeout returns the timeout for a metric's queries: its own override or
+// prometheus.timeout
+func (c *Client) queryTimeout(metric config.MetricConfig) time.Duration {
+	if metric.Timeout > 0 {
+		return metric.Timeout
+	}
+	return c.config.Timeout
+}
 
-			// Execute query with its own context
-			queryCtx, queryCancel := context.WithTimeout(context.Background(), c.config.Timeout)
-			defer queryCancel()
+// queryContext returns ctx carrying the lookback delta for a metric's queries:
+// its own override or prometheus.lookbackDelta
+func (c *Client) queryContext(ctx context.Context, metric config.MetricConfig) context.Context {
+	lookback := c.config.LookbackDelta
+	if metric.LookbackDelta > 0 {
+		lookback = metric.LookbackDelta
+	}
+	return withLookbackDelta(ctx, model.Duration(lookback))
+}
 
-			result, warnings, err := c.api.Query(queryCtx, query, time.Now())
-			if err != nil {
-				errorsChan <- fmt.Errorf("error querying Prometheus for metric %s: %w", cfg.Name, err)
-				return
-			}
+// tagSource records the client's source name on a result
+func (c *Client) tagSource(r *MetricResult) {
+	r.Source = c.config.SourceName
+}
 
-			if len(warnings) > 0 {
-				warningsChan <- warnings
-			}
+// acquireQuerySlot blocks until a query may be issued under MaxConcurrentQueries
+func (c *Client) acquireQuerySlot() {
+	if c.querySem != nil {
+		c.querySem <- struct{}{}
+	}
+}
 
-			var metricResults []MetricResult
-
-			// Process results
-			switch result.Type() {
-			case model.ValVector:
-				vector := result.(model.Vector)
-				for _, sample := range vector {
-					metricResult := MetricResult{
-						Name:      cfg.Name,
-						Timestamp: sample.Timestamp.Time(),
-						Value:     float64(sample.Value),
-						Labels:    make(map[string]string),
-					}
-
-					// Extract labels
-					for labelName, labelValue := range sample.Metric {
-						metricResult.Labels[string(labelName)] = string(labelValue)
-					}
-
-					metricResults = append(metricResults, metricResult)
-				}
-			case model.ValMatrix:
-				matrix := result.(model.Matrix)
-				for _, stream := range matrix {
-					for _, point := range stream.Values {
-						metricResult := MetricResult{
-							Name:      cfg.Name,
-							Timestamp: point.Timestamp.Time(),
-							Value:     float64(point.Value),
-							Labels:    make(map[string]string),
-						}
-
-						// Extract labels
-						for labelName, labelValue := range stream.Metric {
-							metricResult.Labels[string(labelName)] = string(labelValue)
-						}
-
-						metricResults = append(metricResults, metricResult)
-					}
-				}
-			default:
-				errorsChan <- fmt.Errorf("unsupported result type for metric %s: %s", cfg.Name, result.Type().String())
-				return
-			}
+// waitForRate blocks until a request may be sent under prometheus.queriesPerSecond
+func (c *Client) waitForRate(ctx context.Context) error {
+	if c.limiter == nil {
+		return nil
+	}
+	if err := c.limiter.Wait(ctx); err != nil {
+		return fmt.Errorf("waiting for query rate limit: %w", err)
+	}
+	return nil
+}
 
-			resultsChan <- metricResults
-		}(metricCfg)
+// releaseQuerySlot frees a slot taken by acquireQuerySlot
+func (c *Client) releaseQuerySlot() {
+	if c.querySem != nil {
+		<-c.querySem
 	}
+}
 
-	// Close channels when all goroutines are done
-	go func() {
-		wg.Wait()
-		close(resultsChan)
-		close(errorsChan)
-		close(warningsChan)
-	}()
+// CollectMetrics gathers metrics for a specific API proxy, evaluated at the
+// given time or at the current time when at is zero.
+// Cancelling ctx, or exceeding prometheus.batchTimeout, aborts all outstanding queries.
+func (c *Client) CollectMetrics(ctx context.Context, apiProxy string, at time.Time) ([]MetricResult, error) {
+	if at.IsZero() {
+		at = time.Now()
+	}
 
-	// Collect all results and errors
+	var mu sync.Mutex
 	var allResults []MetricResult
-	var allErrors []error
+	allErrors := c.forEachMetric(ctx, apiProxy, func(ctx context.Context, cfg config.MetricConfig) error {
+		metricResults, err := c.queryMetric(ctx, cfg, apiProxy, at)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		allResults = append(allResults, metricResults...)
+		mu.Unlock()
+		return nil
+	})
 
-	// Process warnings
-	for warnings := range warningsChan {
-		log.Printf("Warnings: %v", warnings)
+	// Return error if any occurred
+	if len(allErrors) > 0 {
+		return nil, fmt.Errorf("errors occurred while collecting metrics: %v", allErrors)
 	}
 
-	// Process errors
-	for err := range errorsChan {
-		allErrors = append(allErrors, err)
-	}
+	return allResults, nil
+}
 
-	// Process results
-	for results := range resultsChan {
-		allResults = append(allResults, results...)
-	}
+// CollectMetricsRange gathers metrics for a specific API proxy over a time range.
+// Cancelling ctx, or exceeding prometheus.batchTimeout, aborts all outstanding queries.
+func (c *Client) CollectMetricsRange(ctx context.Context, apiProxy string, timeRange TimeRange) ([]MetricResult, error) {
+	var mu sync.Mutex
+	var allResults []MetricResult
+	allErrors := c.forEachMetric(ctx, apiProxy, func(ctx context.Context, cfg config.MetricConfig) error {
+		var metricResults []MetricResult
+		err := c.queryRangeMetric(ctx, cfg, apiProxy, timeRange, func(r MetricResult) error {
+			metricResults = append(metricResults, r)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		allResults = append(allResults, metricResults...)
+		mu.Unlock()
+		return nil
+	})
 
 	// Return error if any occurred
 	if len(allErrors) > 0 {
-		return nil, fmt.Errorf("errors occurred while collecting metrics: %v", allErrors)
+		return nil, fmt.Errorf("errors occurred while collecting range metrics: %v", allErrors)
 	}
 
 	return allResults, nil
 }
 
-// CollectMetricsRange gathers metrics for a specific API proxy over a time range
-func (c *Client) CollectMetricsRange(apiProxy string, timeRange TimeRange) ([]MetricResult, error) {
-	// Use channels to collect results and errors from goroutines
-	resultsChan := make(chan []MetricResult, len(c.config.Metrics))
-	errorsChan := make(chan error, len(c.config.Metrics))
-	warningsChan := make(chan []string, len(c.config.Metrics))
+// forEachMetric runs query in its own goroutine for every metric collected for
+// apiProxy, within prometheus.maxConcurrentQueries and prometheus.batchTimeout.
+// It returns the errors of the failed metrics, led by the metrics cut short by
+// the batch deadline.
+func (c *Client) forEachMetric(ctx context.Context, apiProxy string, query func(ctx context.Context, cfg config.MetricConfig) error) []error {
+	metrics := c.config.MetricsFor(apiProxy)
+	b, cancel := c.newBatch(ctx, metrics)
+	defer cancel()
 
-	// Create a wait group to wait for all goroutines to finish
 	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var allErrors []error
 
 	// Launch a goroutine for each metric
-	for _, metricCfg := range c.config.Metrics {
+	for _, metricCfg := range metrics {
 		wg.Add(1)
 		go func(cfg config.MetricConfig) {
 			defer wg.Done()
 
-			// Replace placeholder in query with actual API proxy name
-			query := replaceAPIProxyInQuery(cfg.Query, apiProxy)
-
-			// Execute query with its own context
-			queryCtx, queryCancel := context.WithTimeout(context.Background(), c.config.Timeout)
-			defer queryCancel()
+			// Wait for a free query slot if concurrency is limited
+			c.acquireQuerySlot()
+			defer c.releaseQuerySlot()
 
-			// Execute range query
-			r := v1.Range{
-				Start: timeRange.Start,
-				End:   timeRange.End,
-				Step:  timeRange.Step,
-			}
-			result, warnings, err := c.api.QueryRange(queryCtx, query, r)
+			err := query(b.ctx, cfg)
+			b.finish(cfg.Name, err)
 			if err != nil {
-				errorsChan <- fmt.Errorf("error querying Prometheus range for metric %s: %w", cfg.Name, err)
-				return
+				mu.Lock()
+				allErrors = append(allErrors, err)
+				mu.Unlock()
 			}
+		}(metricCfg)
+	}
+	wg.Wait()
 
-			if len(warnings) > 0 {
-				warningsChan <- warnings
-			}
+	// Name the metrics cut short by the batch deadline first
+	if err := b.err(); err != nil {
+		allErrors = append([]error{err}, allErrors...)
+	}
+	return allErrors
+}
 
-			var metricResults []MetricResult
-
-			// Process results
-			switch result.Type() {
-			case model.ValMatrix:
-				matrix := result.(model.Matrix)
-				for _, stream := range matrix {
-					for _, point := range stream.Values {
-						metricResult := MetricResult{
-							Name:      cfg.Name,
-							Timestamp: point.Timestamp.Time(),
-							Value:     float64(point.Value),
-							Labels:    make(map[string]string),
-						}
-
-						// Extract labels
-						for labelName, labelValue := range stream.Metric {
-							metricResult.Labels[string(labelName)] = string(labelValue)
-						}
-
-						metricResults = append(metricResults, metricResult)
-					}
-				}
-			default:
-				errorsChan <- fmt.Errorf("unsupported result type for range query for metric %s: %s", cfg.Name, result.Type().String())
-				return
-			}
+// queryMetric runs the instant query for a single metric at the given time
+func (c *Client) queryMetric(ctx context.Context, cfg config.MetricConfig, apiProxy string, at time.Time) (results []MetricResult, err error) {
+	ctx, span := telemetry.StartSpan(ctx, "prometheus.query", attribute.String("metric", cfg.Name),
+		attribute.String("api_proxy", apiProxy), attribute.String("time", at.Format(time.RFC3339)))
+	defer func() { telemetry.EndSpan(span, err, attribute.Int("samples", len(results))) }()
 
-			resultsChan <- metricResults
-		}(metricCfg)
+	filter := c.newResultFilter(cfg, apiProxy)
+	defer filter.log()
+
+	// Render query template with the actual API proxy name
+	query, err := renderQuery(cfg, apiProxy)
+	if err != nil {
+		return nil, fmt.Errorf("error building query for metric %s: %w", cfg.Name, err)
 	}
 
-	// Close channels when all goroutines are done
-	go func() {
-		wg.Wait()
-		close(resultsChan)
-		close(errorsChan)
-		close(warningsChan)
-	}()
+	// Execute query with its own context
+	timeout := c.queryTimeout(cfg)
+	queryCtx, queryCancel := context.WithTimeout(c.queryContext(ctx, cfg), timeout)
+	defer queryCancel()
+
+	// The v1 API sends queries as POST form bodies, so long generated queries
+	// are not bound by URL length limits; it falls back to GET only when the
+	// server answers 405 or 501
+	var result model.Value
+	var warnings v1.Warnings
+	err = c.withRetry(queryCtx, "query for metric "+cfg.Name, func() error {
+		var err error
+		result, warnings, err = c.api.Query(queryCtx, query, at, v1.WithTimeout(timeout))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error querying Prometheus for metric %s: %w", cfg.Name, err)
+	}
+	filter.queried()
+	if err := c.checkWarnings(cfg.Name, apiProxy, warnings); err != nil {
+		return nil, err
+	}
 
-	// Collect all results and errors
-	var allResults []MetricResult
-	var allErrors []error
+	// Check the size before building a MetricResult per sample
+	limit, err := c.checkSampleLimit(cfg, apiProxy, sampleCount(result))
+	if err != nil {
+		return nil, err
+	}
+	result = truncateSamples(result, limit)
 
-	// Process warnings
-	for warnings := range warningsChan {
-		log.Printf("Warnings: %v", warnings)
+	metricResults, err := processValue(result, cfg.Name)
+	if err != nil {
+		return nil, err
 	}
 
-	// Process errors
-	for err := range errorsChan {
-		allErrors = append(allErrors, err)
+	kept := metricResults[:0]
+	for _, metricResult := range metricResults {
+		if filter.keep(&metricResult) {
+			kept = append(kept, metricResult)
+		}
 	}
+	return kept, nil
+}
 
-	// Process results
-	for results := range resultsChan {
-		allResults = append(allResults, results...)
+// queryRangeMetric runs the range query for a single metric and passes each
+// resulting sample within [Start, End) to emit. It stops at the first error
+// returned by emit.
+func (c *Client) queryRangeMetric(ctx context.Context, cfg config.MetricConfig, apiProxy string, timeRange TimeRange, emit func(MetricResult) error) (err error) {
+	ctx, span := telemetry.StartSpan(ctx, "prometheus.query_range", attribute.String("metric", cfg.Name),
+		attribute.String("api_proxy", apiProxy), attribute.String("batch_start", timeRange.Start.Format(time.RFC3339)),
+		attribute.String("batch_end", timeRange.End.Format(time.RFC3339)))
+	samples := 0
+	defer func() { telemetry.EndSpan(span, err, attribute.Int("samples", samples)) }()
+
+	// Prometheus treats both range bounds as inclusive; drop samples at End so
+	// batches are half-open
+	filter := c.newResultFilter(cfg, apiProxy)
+	defer filter.log()
+	emitInRange := emit
+	emit = func(r MetricResult) error {
+		if !timeRange.Contains(r.Timestamp) || !filter.keep(&r) {
+			return nil
+		}
+		samples++
+		return emitInRange(r)
 	}
 
-	// Return error if any occurred
-	if len(allErrors) > 0 {
-		return nil, fmt.Errorf("errors occurred while collecting range metrics: %v", allErrors)
+	// Render query template with the actual API proxy name
+	query, err := renderQuery(cfg, apiProxy)
+	if err != nil {
+		return fmt.Errorf("error building query for metric %s: %w", cfg.Name, err)
 	}
 
-	return allResults, nil
-}
+	// Execute query with its own context
+	timeout := c.queryTimeout(cfg)
+	queryCtx, queryCancel := context.WithTimeout(c.queryContext(ctx, cfg), timeout)
+	defer queryCancel()
+
+	// Fetch raw samples through remote read instead of the query API
+	if c.config.QueryMode == config.QueryModeRemoteRead {
+		metricResults, err := c.remoteReadRange(queryCtx, cfg.Name, query, timeRange)
+		if err != nil {
+			return fmt.Errorf("error reading remote samples for metric %s: %w", cfg.Name, err)
+		}
+		filter.queried()
+		limit, err := c.checkSampleLimit(cfg, apiProxy, len(metricResults))
+		if err != nil {
+			return err
+		}
+		metricResults = metricResults[:limit]
+		for _, metricResult := range metricResults {
+			if err := emit(metricResult); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Execute range query. An aligned start may precede the batch; the samples
+	// before it are dropped by emit.
+	r := v1.Range{
+		Start: timeRange.Start,
+		End:   timeRange.End,
+		Step:  timeRange.Step,
+	}
+	if c.config.AlignStep {
+		r.Start = alignToStep(r.Start, r.Step)
+	}
+	var result model.Value
+	var warnings v1.Warnings
+	err = c.withRetry(queryCtx, "range query for metric "+cfg.Name, func() error {
+		var err error
+		result, warnings, err = c.api.QueryRange(queryCtx, query, r, v1.WithTimeout(timeout))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error querying Prometheus range for metric %s: %w", cfg.Name, err)
+	}
+	filter.queried()
+	if err := c.checkWarnings(cfg.Name, apiProxy, warnings); err != nil {
+		return err
+	}
+
+	// Check the size before building a MetricResult per sample
+	limit, err := c.checkSampleLimit(cfg, apiProxy, sampleCount(result))
+	if err != nil {
+		return err
+	}
+	result = truncateSamples(result, limit)
 
-// replaceAPIProxyInQuery replaces the {apiproxy="..."} placeholder in the query
-func replaceAPIProxyInQuery(query, apiProxy string) string {
-	// This is a simple implementation - in a real-world scenario,
-	// you might want to use a more robust approach like template rendering
-	// or proper query parameter substitution
-	return fmt.Sprintf(query, apiProxy)
+	return eachResult(result, cfg.Name, emit)
 }
@@ -0,0 +1,86 @@
+package prometheus
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+// emptyVector is the body of a successful instant query without results
+const emptyVector = `{"status":"success","data":{"resultType":"vector","result":[]}}`
+
+// newTestServer starts a fake Prometheus answering every request with handler
+func newTestServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newTestClient loads a configuration collecting one metric from url, with
+// override, a YAML document such as "prometheus: {maxRetries: 2}", merged over
+// it, and returns the client and configuration
+func newTestClient(t *testing.T, url, override string) (*Client, *config.Config) {
+	t.Helper()
+	dir := t.TempDir()
+	base := fmt.Sprintf(`
+apiProxies: [orders]
+prometheus:
+  url: %q
+  metrics:
+    - name: requests
+      query: 'sum(rate(requests_total{app="{{.APIProxy}}"}[5m]))'
+storage:
+  outputDir: %q
+`, url, filepath.Join(dir, "data"))
+	paths := []string{filepath.Join(dir, "base.yaml"), filepath.Join(dir, "override.yaml")}
+	for i, content := range []string{base, override} {
+		if err := os.WriteFile(paths[i], []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg, err := config.LoadConfig(paths...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(cfg.Prometheus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, cfg
+}
+
+// rangeHandler answers range queries like Prometheus, with one series holding
+// a sample at every step from start to end, both inclusive. The sample value is
+// its Unix time.
+func rangeHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("parse form: %v", err)
+		}
+		parse := func(name string) float64 {
+			v, err := strconv.ParseFloat(r.Form.Get(name), 64)
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+			return v
+		}
+		start, end, step := parse("start"), parse("end"), parse("step")
+
+		var values []string
+		for ts := start; ts <= end; ts += step {
+			v := strconv.FormatFloat(ts, 'f', -1, 64)
+			values = append(values, fmt.Sprintf(`[%s,"%s"]`, v, v))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"requests_total","app":"orders"},"values":[%s]}]}}`,
+			strings.Join(values, ","))
+	}
+}
@@ -0,0 +1,23 @@
+package prometheus
+
+// Dedup drops repeated samples of a series at the same timestamp, keeping the
+// one seen last, e.g. when files that overlap are merged. Results keep the
+// order their series and timestamp were first seen in.
+func Dedup(metrics []MetricResult) []MetricResult {
+	type sample struct {
+		series string
+		ms     int64
+	}
+	index := make(map[sample]int, len(metrics))
+	deduped := make([]MetricResult, 0, len(metrics))
+	for _, m := range metrics {
+		key := sample{SeriesKey(m), m.Timestamp.UnixMilli()}
+		if i, ok := index[key]; ok {
+			deduped[i] = m
+			continue
+		}
+		index[key] = len(deduped)
+		deduped = append(deduped, m)
+	}
+	return deduped
+}
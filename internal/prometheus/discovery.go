@@ -0,0 +1,79 @@
+package prometheus
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+// DiscoverProxies returns the sorted values of the prometheus.discoverProxies
+// label that fully match its pattern and are valid API proxy names. Series
+// between start and end matching the configured selectors are considered; zero
+// times leave the range to the server. At most the configured limit is returned.
+func (c *Client) DiscoverProxies(ctx context.Context, start, end time.Time) ([]string, error) {
+	discovery := c.config.DiscoverProxies
+
+	// Validated by config.LoadConfig; anchored so the pattern must match the
+	// whole value. Without a pattern every value is collected.
+	var pattern *regexp.Regexp
+	if discovery.Match != "" {
+		var err error
+		pattern, err = regexp.Compile("^(?:" + discovery.Match + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid discovery pattern: %w", err)
+		}
+	}
+
+	queryCtx, queryCancel := context.WithTimeout(ctx, c.config.Timeout)
+	defer queryCancel()
+
+	// Without a pattern every valid value counts, so the server can stop at the
+	// limit; one extra value tells whether anything was left out
+	var opts []v1.Option
+	if discovery.Limit > 0 && discovery.Match == "" {
+		opts = append(opts, v1.WithLimit(uint64(discovery.Limit)+1))
+	}
+
+	var values model.LabelValues
+	var warnings v1.Warnings
+	err := c.withRetry(queryCtx, "label values for "+discovery.Label, func() error {
+		var err error
+		values, warnings, err = c.api.LabelValues(queryCtx, discovery.Label, discovery.Selectors, start, end, opts...)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error discovering API proxies from label %s: %w", discovery.Label, err)
+	}
+	if len(warnings) > 0 {
+		slog.Warn("Prometheus returned warnings", "source", c.config.SourceName,
+			"label", discovery.Label, "warnings", []string(warnings))
+	}
+
+	var proxies []string
+	for _, value := range values {
+		name := string(value)
+		if pattern != nil && !pattern.MatchString(name) {
+			continue
+		}
+		if err := config.ValidateAPIProxyName(name); err != nil {
+			slog.Warn("Ignoring discovered API proxy", "source", c.config.SourceName, "error", err)
+			continue
+		}
+		proxies = append(proxies, name)
+	}
+	sort.Strings(proxies)
+	if discovery.Limit > 0 && len(proxies) > discovery.Limit {
+		slog.Warn("Discovered more API proxies than prometheus.discoverProxies.limit, ignoring the rest",
+			"source", c.config.SourceName, "limit", discovery.Limit, "ignored", proxies[discovery.Limit:])
+		proxies = proxies[:discovery.Limit]
+	}
+	return proxies, nil
+}
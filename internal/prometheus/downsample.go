@@ -0,0 +1,145 @@
+package prometheus
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+// Downsample aggregates samples into fixed buckets of the given width, one
+// result per series and bucket. Series are identified by SeriesKey. Buckets are aligned to the Unix epoch and each result is
+// stamped with its bucket start. Results are ordered by series, then time, so
+// output is stable across runs.
+//
+// A bucket only sees the samples passed in: if a batch boundary falls inside a
+// bucket, each batch yields a partial aggregate for it with the same timestamp.
+// Keep the batch duration a multiple of the bucket width to avoid this.
+func Downsample(metrics []MetricResult, width time.Duration, function string) ([]MetricResult, error) {
+	aggregate, err := aggregator(function)
+	if err != nil {
+		return nil, err
+	}
+
+	type bucketKey struct {
+		series string
+		start  int64
+	}
+
+	buckets := make(map[bucketKey][]MetricResult)
+	var keys []bucketKey
+	for _, m := range metrics {
+		// Rounded down, so samples before 1970 start their bucket too
+		key := bucketKey{series: SeriesKey(m), start: alignToStep(m.Timestamp, width).UnixNano()}
+		if _, ok := buckets[key]; !ok {
+			keys = append(keys, key)
+		}
+		buckets[key] = append(buckets[key], m)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].series != keys[j].series {
+			return keys[i].series < keys[j].series
+		}
+		return keys[i].start < keys[j].start
+	})
+
+	results := make([]MetricResult, 0, len(keys))
+	for _, key := range keys {
+		samples := buckets[key]
+		first := samples[0]
+		results = append(results, MetricResult{
+			Name:         first.Name,
+			Timestamp:    time.Unix(0, key.start).UTC(),
+			Value:        aggregate(samples),
+			Labels:       first.Labels,
+			Source:       first.Source,
+			APIProxy:     first.APIProxy,
+			CollectedAt:  first.CollectedAt,
+			InvocationID: first.InvocationID,
+		})
+	}
+	return results, nil
+}
+
+// SeriesKey identifies the series a result belongs to: its name, source, API
+// proxy and labels. The API proxy is part of the key because aggregated queries
+// such as sum(rate(...)) return no labels, so the results of different proxies
+// in one combined batch would otherwise be taken for one series.
+func SeriesKey(m MetricResult) string {
+	names := make([]string, 0, len(m.Labels))
+	for name := range m.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(m.Name)
+	b.WriteByte(0)
+	b.WriteString(m.Source)
+	b.WriteByte(0)
+	b.WriteString(m.APIProxy)
+	for _, name := range names {
+		b.WriteByte(0)
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(m.Labels[name])
+	}
+	return b.String()
+}
+
+// aggregator returns the function reducing a bucket's samples to one value
+func aggregator(function string) (func([]MetricResult) float64, error) {
+	switch function {
+	case config.DownsampleAvg:
+		return func(samples []MetricResult) float64 {
+			sum := 0.0
+			for _, s := range samples {
+				sum += s.Value
+			}
+			return sum / float64(len(samples))
+		}, nil
+	case config.DownsampleSum:
+		return func(samples []MetricResult) float64 {
+			sum := 0.0
+			for _, s := range samples {
+				sum += s.Value
+			}
+			return sum
+		}, nil
+	case config.DownsampleMin:
+		return func(samples []MetricResult) float64 {
+			min := samples[0].Value
+			for _, s := range samples[1:] {
+				if s.Value < min {
+					min = s.Value
+				}
+			}
+			return min
+		}, nil
+	case config.DownsampleMax:
+		return func(samples []MetricResult) float64 {
+			max := samples[0].Value
+			for _, s := range samples[1:] {
+				if s.Value > max {
+					max = s.Value
+				}
+			}
+			return max
+		}, nil
+	case config.DownsampleLast:
+		return func(samples []MetricResult) float64 {
+			last := samples[0]
+			for _, s := range samples[1:] {
+				if !s.Timestamp.Before(last.Timestamp) {
+					last = s
+				}
+			}
+			return last.Value
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported downsample function %q", function)
+	}
+}
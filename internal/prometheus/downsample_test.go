@@ -0,0 +1,41 @@
+package prometheus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+func TestDownsampleBuckets(t *testing.T) {
+	epoch := time.Unix(0, 0).UTC()
+	tests := []struct {
+		name       string
+		timestamps []time.Duration
+		want       []time.Duration
+	}{
+		{"after epoch", []time.Duration{time.Minute, 4 * time.Minute, 6 * time.Minute}, []time.Duration{0, 5 * time.Minute}},
+		{"before epoch", []time.Duration{-time.Minute, -4 * time.Minute, -6 * time.Minute}, []time.Duration{-10 * time.Minute, -5 * time.Minute}},
+		{"across epoch", []time.Duration{-time.Second, time.Second}, []time.Duration{-5 * time.Minute, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var metrics []MetricResult
+			for _, offset := range tt.timestamps {
+				metrics = append(metrics, MetricResult{Name: "m", Timestamp: epoch.Add(offset), Value: 1})
+			}
+			got, err := Downsample(metrics, 5*time.Minute, config.DownsampleSum)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d buckets, want %d", len(got), len(tt.want))
+			}
+			for i, want := range tt.want {
+				if !got[i].Timestamp.Equal(epoch.Add(want)) {
+					t.Errorf("bucket %d starts at %s, want %s", i, got[i].Timestamp, epoch.Add(want))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package prometheus
+
+import (
+	"log/slog"
+	"sort"
+
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+// labelCheck checks the results of one query against the metric's
+// expectLabels and tallies the samples missing any of them
+type labelCheck struct {
+	metric config.MetricConfig
+
+	// samples counts the results missing an expected label
+	samples int
+
+	// missing holds the expected labels absent from any result
+	missing map[string]bool
+}
+
+func newLabelCheck(metric config.MetricConfig) *labelCheck {
+	return &labelCheck{metric: metric}
+}
+
+// keep reports whether r is stored under the metric's missingLabels policy
+func (lc *labelCheck) keep(r MetricResult) bool {
+	ok := true
+	for _, label := range lc.metric.ExpectLabels {
+		if _, present := r.Labels[label]; present {
+			continue
+		}
+		if lc.missing == nil {
+			lc.missing = make(map[string]bool)
+		}
+		lc.missing[label] = true
+		ok = false
+	}
+	if ok {
+		return true
+	}
+	lc.samples++
+	return lc.metric.MissingLabels != config.MissingLabelsDrop
+}
+
+// log warns once per query about the samples missing expected labels, which
+// usually means the query's by clause is wrong
+func (lc *labelCheck) log(apiProxy string) {
+	if lc.samples == 0 {
+		return
+	}
+	missing := make([]string, 0, len(lc.missing))
+	for label := range lc.missing {
+		missing = append(missing, label)
+	}
+	sort.Strings(missing)
+
+	policy := lc.metric.MissingLabels
+	if policy == "" {
+		policy = config.MissingLabelsKeep
+	}
+	slog.Warn("Samples missing expected labels", "metric", lc.metric.Name, "api_proxy", apiProxy,
+		"missing", missing, "samples", lc.samples, "policy", policy)
+}
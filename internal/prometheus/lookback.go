@@ -0,0 +1,42 @@
+package prometheus
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/prometheus/common/model"
+)
+
+// lookbackDeltaKey is the context key carrying a query's lookback delta
+type lookbackDeltaKey struct{}
+
+// withLookbackDelta returns a context whose queries use lookback as the
+// lookback delta; zero leaves the server default
+func withLookbackDelta(ctx context.Context, lookback model.Duration) context.Context {
+	if lookback == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, lookbackDeltaKey{}, lookback)
+}
+
+// lookbackRoundTripper adds the lookback_delta query parameter to requests
+// whose context carries one. The v1 API has no option for it, so it is set on
+// the request directly; Prometheus reads it from the URL for GET and POST.
+type lookbackRoundTripper struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (rt *lookbackRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	lookback, ok := req.Context().Value(lookbackDeltaKey{}).(model.Duration)
+	if !ok {
+		return rt.next.RoundTrip(req)
+	}
+
+	// RoundTrippers must not modify the caller's request
+	req = req.Clone(req.Context())
+	q := req.URL.Query()
+	q.Set("lookback_delta", lookback.String())
+	req.URL.RawQuery = q.Encode()
+	return rt.next.RoundTrip(req)
+}
@@ -0,0 +1,35 @@
+package prometheus
+
+import (
+	"log/slog"
+	"math"
+
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+// applyNonFinite applies the configured policy to a NaN or ±Inf value in r.
+// It reports whether r should be kept and whether the policy affected it.
+func (c *Client) applyNonFinite(r *MetricResult) (keep, affected bool) {
+	if !math.IsNaN(r.Value) && !math.IsInf(r.Value, 0) {
+		return true, false
+	}
+
+	switch c.config.NonFiniteValues {
+	case config.NonFiniteKeep:
+		return true, true
+	case config.NonFiniteZero:
+		r.Value = 0
+		return true, true
+	default:
+		return false, true
+	}
+}
+
+// logNonFinite reports how many samples of a metric had non-finite values
+func (c *Client) logNonFinite(metric string, count int) {
+	if count == 0 {
+		return
+	}
+	slog.Debug("Handled non-finite sample values", "metric", metric,
+		"policy", c.config.NonFiniteValues, "count", count)
+}
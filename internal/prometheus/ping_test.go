@@ -0,0 +1,82 @@
+package prometheus
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPing(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		override string
+		cancel   bool
+		want     string
+		notWant  string
+	}{
+		{
+			name: "answers",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"status":"success","data":{"resultType":"scalar","result":[0,"1"]}}`))
+			},
+		},
+		{
+			name: "unauthorized",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusUnauthorized)
+			},
+			want:    "failed",
+			notWant: "within",
+		},
+		{
+			name:     "timeout",
+			handler:  hang,
+			override: "prometheus: {timeout: 50ms}",
+			want:     "did not answer a test query within 50ms",
+		},
+		{
+			name:    "interrupted",
+			handler: hang,
+			cancel:  true,
+			want:    "interrupted",
+			notWant: "within",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, tt.handler)
+			client, _ := newTestClient(t, srv.URL, tt.override)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				time.AfterFunc(50*time.Millisecond, cancel)
+			}
+			err := client.Ping(ctx)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Ping error = %v, want %q", err, tt.want)
+			}
+			if tt.notWant != "" && strings.Contains(err.Error(), tt.notWant) {
+				t.Errorf("Ping error = %v, must not mention %q", err, tt.notWant)
+			}
+		})
+	}
+}
+
+// hang answers once the client gives up on the request. The body is read
+// first, since the server only notices a closed connection after that.
+func hang(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+	<-r.Context().Done()
+}
@@ -0,0 +1,77 @@
+package prometheus
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLongQueryPost checks that queries are sent in a POST body, so a query
+// of several kilobytes does not hit URL length limits
+func TestLongQueryPost(t *testing.T) {
+	paths := make([]string, 500)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("/api/v%d/orders/items", i)
+	}
+	query := fmt.Sprintf(`sum(rate(requests_total{app="{{.APIProxy}}", path=~"%s"}[5m]))`, strings.Join(paths, "|"))
+	want := strings.ReplaceAll(query, "{{.APIProxy}}", "orders")
+	if len(want) < 8*1024 {
+		t.Fatalf("query is only %d bytes", len(want))
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		respond http.HandlerFunc
+		collect func(c *Client) error
+	}{
+		{"instant", "/api/v1/query", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(emptyVector))
+		}, func(c *Client) error {
+			_, err := c.CollectMetrics(context.Background(), "orders", time.Now())
+			return err
+		}},
+		{"range", "/api/v1/query_range", rangeHandler(t), func(c *Client) error {
+			end := time.Now().Truncate(time.Minute)
+			_, err := c.CollectMetricsRange(context.Background(), "orders", TimeRange{Start: end.Add(-time.Hour), End: end, Step: time.Minute})
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var method, path, rawQuery, body string
+			srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				if err := r.ParseForm(); err != nil {
+					t.Errorf("parse form: %v", err)
+				}
+				// The base metric of newTestClient is queried too
+				if r.PostForm.Get("query") == want {
+					method, path, rawQuery, body = r.Method, r.URL.Path, r.URL.RawQuery, r.PostForm.Get("query")
+				}
+				tt.respond(w, r)
+			})
+
+			override := fmt.Sprintf("prometheus: {metrics: [{name: long, query: %q}]}", query)
+			client, _ := newTestClient(t, srv.URL, override)
+			if err := tt.collect(client); err != nil {
+				t.Fatal(err)
+			}
+			if method != http.MethodPost {
+				t.Errorf("method = %q, want POST", method)
+			}
+			if path != tt.path {
+				t.Errorf("path = %q, want %q", path, tt.path)
+			}
+			if strings.Contains(rawQuery, "query=") {
+				t.Errorf("query sent in the URL (%d bytes)", len(rawQuery))
+			}
+			if body != want {
+				t.Errorf("body query is %d bytes, want the %d byte query", len(body), len(want))
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package prometheus
+
+import (
+	"fmt"
+
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+// ResultProcessor transforms the results of one collection, an instant
+// collection or a range batch, between collection and storage, e.g. to rename
+// labels or derive metrics. Process may return a new slice or modify metrics
+// in place, but must not modify their label maps, which may be shared
+// between results. Only the processors of this package exist; new ones are
+// configured in config.ProcessorConfig and built by NewProcessors.
+type ResultProcessor interface {
+	Process(metrics []MetricResult) ([]MetricResult, error)
+}
+
+// Processors is a chain of ResultProcessors applied in order
+type Processors []ResultProcessor
+
+// NewProcessors builds the chain configured in processors. Entries have been
+// validated by config.LoadConfig.
+func NewProcessors(processors []config.ProcessorConfig) Processors {
+	var chain Processors
+	for _, p := range processors {
+		if len(p.RenameLabels) > 0 {
+			chain = append(chain, RenameLabels(p.RenameLabels))
+		}
+	}
+	return chain
+}
+
+// Process runs metrics through every processor of the chain
+func (p Processors) Process(metrics []MetricResult) ([]MetricResult, error) {
+	for i, processor := range p {
+		var err error
+		if metrics, err = processor.Process(metrics); err != nil {
+			return nil, fmt.Errorf("processors[%d]: %w", i, err)
+		}
+	}
+	return metrics, nil
+}
+
+// RenameLabels renames the labels that are keys of the map to their values.
+// A renamed label replaces a label that already has the new name.
+type RenameLabels map[string]string
+
+// Process implements ResultProcessor
+func (r RenameLabels) Process(metrics []MetricResult) ([]MetricResult, error) {
+	for i := range metrics {
+		metrics[i].Labels = r.rename(metrics[i].Labels)
+	}
+	return metrics, nil
+}
+
+// rename returns labels with the keys of r renamed, as a new map when any of
+// them is present
+func (r RenameLabels) rename(labels map[string]string) map[string]string {
+	found := false
+	for from := range r {
+		if _, ok := labels[from]; ok {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return labels
+	}
+
+	renamed := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if _, ok := r[k]; !ok {
+			renamed[k] = v
+		}
+	}
+	for from, to := range r {
+		if v, ok := labels[from]; ok {
+			renamed[to] = v
+		}
+	}
+	return renamed
+}
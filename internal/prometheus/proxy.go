@@ -0,0 +1,23 @@
+package prometheus
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// proxyFunc returns the transport Proxy function for prometheus.httpProxy:
+// every request goes through the configured proxy, or through the one named
+// by HTTP_PROXY, HTTPS_PROXY and NO_PROXY when none is configured
+func proxyFunc(httpProxy string) (func(*http.Request) (*url.URL, error), error) {
+	if httpProxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	// Validated by config.LoadConfig
+	proxyURL, err := url.Parse(httpProxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	return http.ProxyURL(proxyURL), nil
+}
@@ -0,0 +1,37 @@
+package prometheus
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHTTPProxy(t *testing.T) {
+	var proxied []string
+	proxy := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		// A forward proxy receives the absolute URL of the target
+		proxied = append(proxied, r.URL.Scheme+"://"+r.URL.Host+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(emptyVector))
+	})
+
+	client, _ := newTestClient(t, "http://prometheus.invalid:9090", "prometheus: {httpProxy: "+proxy.URL+"}")
+	if _, err := client.CollectMetrics(context.Background(), "orders", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if len(proxied) != 1 || proxied[0] != "http://prometheus.invalid:9090/api/v1/query" {
+		t.Errorf("proxy received %v, want one query for prometheus.invalid", proxied)
+	}
+}
+
+func TestProxyFuncFromEnvironment(t *testing.T) {
+	proxy, err := proxyFunc("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.ValueOf(proxy).Pointer() != reflect.ValueOf(http.ProxyFromEnvironment).Pointer() {
+		t.Error("proxyFunc without prometheus.httpProxy does not use the environment")
+	}
+}
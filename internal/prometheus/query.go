@@ -0,0 +1,94 @@
+package prometheus
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+// labelValueEscaper escapes characters that are special inside a double-quoted PromQL string
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// queryData holds the values available to metric query templates
+type queryData struct {
+	// APIProxy is the proxy name escaped for use inside a double-quoted label value
+	APIProxy string
+
+	// APIProxyRegex is the proxy name regex-quoted and escaped for use with =~ matchers
+	APIProxyRegex string
+
+	// Selector is the comma-separated list of label matchers for the proxy and
+	// the metric's configured matchers, for use inside {...}
+	Selector string
+}
+
+// renderQuery renders a metric query template for a specific API proxy
+func renderQuery(metric config.MetricConfig, apiProxy string) (string, error) {
+	tmpl, err := template.New("query").Option("missingkey=error").Parse(metric.Query)
+	if err != nil {
+		return "", fmt.Errorf("invalid query template: %w", err)
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, queryData{
+		APIProxy:      escapeLabelValue(apiProxy),
+		APIProxyRegex: escapeLabelValue(regexp.QuoteMeta(apiProxy)),
+		Selector:      buildSelector(metric, apiProxy),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to render query template: %w", err)
+	}
+
+	return buf.String(), nil
+}
+
+// buildSelector renders the proxy matcher followed by the metric's matchers in
+// label order, e.g. `app="checkout", env="prod", region="eu"`
+func buildSelector(metric config.MetricConfig, apiProxy string) string {
+	proxyLabel := metric.ProxyLabel
+	if proxyLabel == "" {
+		proxyLabel = config.DefaultProxyLabel
+	}
+
+	names := make([]string, 0, len(metric.Matchers))
+	for name := range metric.Matchers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	matchers := []string{fmt.Sprintf(`%s="%s"`, proxyLabel, escapeLabelValue(apiProxy))}
+	for _, name := range names {
+		matchers = append(matchers, fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(metric.Matchers[name])))
+	}
+	return strings.Join(matchers, ", ")
+}
+
+// escapeLabelValue escapes a value for use inside a double-quoted PromQL label matcher
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+// ResolvedQuery is a metric query rendered for a specific API proxy
+type ResolvedQuery struct {
+	Name  string
+	Query string
+}
+
+// ResolveQueries renders every configured metric query for apiProxy without executing them
+func (c *Client) ResolveQueries(apiProxy string) ([]ResolvedQuery, error) {
+	metrics := c.config.MetricsFor(apiProxy)
+	queries := make([]ResolvedQuery, 0, len(metrics))
+	for _, metricCfg := range metrics {
+		query, err := renderQuery(metricCfg, apiProxy)
+		if err != nil {
+			return nil, fmt.Errorf("error building query for metric %s: %w", metricCfg.Name, err)
+		}
+		queries = append(queries, ResolvedQuery{Name: metricCfg.Name, Query: query})
+	}
+	return queries, nil
+}
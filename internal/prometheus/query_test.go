@@ -0,0 +1,69 @@
+package prometheus
+
+import (
+	"testing"
+
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+func TestRenderQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		apiProxy string
+		matchers map[string]string
+		want     string
+	}{
+		{
+			name:     "percent sign",
+			query:    `100 * sum(rate(errors_total{app="{{.APIProxy}}"}[5m])) / sum(rate(requests_total{app="{{.APIProxy}}"}[5m])) % 100`,
+			apiProxy: "orders",
+			want:     `100 * sum(rate(errors_total{app="orders"}[5m])) / sum(rate(requests_total{app="orders"}[5m])) % 100`,
+		},
+		{
+			name:     "regex matcher",
+			query:    `sum(up{app=~"{{.APIProxyRegex}}-(blue|green)"})`,
+			apiProxy: "orders.v1+beta",
+			want:     `sum(up{app=~"orders\\.v1\\+beta-(blue|green)"})`,
+		},
+		{
+			name: "multi-line",
+			query: `histogram_quantile(0.99,
+  sum by (le) (
+    rate(latency_bucket{app="{{.APIProxy}}"}[5m])
+  )
+)`,
+			apiProxy: "orders",
+			want: `histogram_quantile(0.99,
+  sum by (le) (
+    rate(latency_bucket{app="orders"}[5m])
+  )
+)`,
+		},
+		{
+			name:     "quotes and backslashes",
+			query:    `up{app="{{.APIProxy}}"}`,
+			apiProxy: `a"b\c`,
+			want:     `up{app="a\"b\\c"}`,
+		},
+		{
+			name:     "selector",
+			query:    `up{ {{.Selector}} }`,
+			apiProxy: "orders",
+			matchers: map[string]string{"region": "eu", "env": "prod"},
+			want:     `up{ app="orders", env="prod", region="eu" }`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metric := config.MetricConfig{Name: "m", Query: tt.query, Matchers: tt.matchers}
+			got, err := renderQuery(metric, tt.apiProxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("renderQuery =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package prometheus
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTimeRangeContains(t *testing.T) {
+	start := time.Date(2025, 4, 7, 0, 0, 0, 0, time.UTC)
+	r := TimeRange{Start: start, End: start.Add(6 * time.Hour)}
+	tests := []struct {
+		t    time.Time
+		want bool
+	}{
+		{start.Add(-time.Millisecond), false},
+		{start, true},
+		{start.Add(6*time.Hour - time.Millisecond), true},
+		{start.Add(6 * time.Hour), false},
+	}
+	for _, tt := range tests {
+		if got := r.Contains(tt.t); got != tt.want {
+			t.Errorf("Contains(%s) = %v, want %v", tt.t.Format(time.RFC3339Nano), got, tt.want)
+		}
+	}
+}
+
+// TestRangeBatchBoundary checks that a sample exactly at the boundary of two
+// adjacent batches, which Prometheus returns for both, is kept only by the
+// batch starting there
+func TestRangeBatchBoundary(t *testing.T) {
+	srv := newTestServer(t, rangeHandler(t))
+	client, _ := newTestClient(t, srv.URL, "")
+
+	start := time.Date(2025, 4, 7, 0, 0, 0, 0, time.UTC)
+	boundary := start.Add(6 * time.Hour)
+	batches := []TimeRange{
+		{Start: start, End: boundary, Step: time.Hour},
+		{Start: boundary, End: boundary.Add(6 * time.Hour), Step: time.Hour},
+	}
+
+	seen := make(map[time.Time]int)
+	for i, batch := range batches {
+		results, err := client.CollectMetricsRange(context.Background(), "orders", batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 6 {
+			t.Errorf("batch %d returned %d samples, want 6", i, len(results))
+		}
+		for _, r := range results {
+			if !batch.Contains(r.Timestamp) {
+				t.Errorf("batch %d returned %s outside its range", i, r.Timestamp)
+			}
+			seen[r.Timestamp.UTC()]++
+		}
+	}
+
+	if seen[boundary] != 1 {
+		t.Errorf("boundary sample appeared %d times, want 1", seen[boundary])
+	}
+	for ts, n := range seen {
+		if n > 1 {
+			t.Errorf("sample at %s appeared %d times", ts, n)
+		}
+	}
+}
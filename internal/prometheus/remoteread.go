@@ -0,0 +1,228 @@
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteReadPath is the Prometheus remote read endpoint
+const remoteReadPath = "/api/v1/read"
+
+// remoteReadRange fetches raw samples for a series selector over a time range
+// using the remote read API. Samples are returned at their original resolution;
+// the range step does not apply.
+func (c *Client) remoteReadRange(ctx context.Context, metricName, selector string, timeRange TimeRange) ([]MetricResult, error) {
+	matchers, err := config.ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	body := snappy.Encode(nil, encodeReadRequest(timeRange.Start.UnixMilli(), timeRange.End.UnixMilli(), matchers))
+
+	var data []byte
+	err = c.withRetry(ctx, "remote read for metric "+metricName, func() error {
+		req, err := http.NewRequest(http.MethodPost, c.client.URL(remoteReadPath, nil).String(), bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("X-Prometheus-Remote-Read-Version", "0.1.0")
+
+		resp, respBody, err := c.client.Do(ctx, req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode/100 != 2 {
+			errType := v1.ErrClient
+			if resp.StatusCode/100 == 5 {
+				errType = v1.ErrServer
+			}
+			return &v1.Error{
+				Type:   errType,
+				Msg:    fmt.Sprintf("remote read returned status %d", resp.StatusCode),
+				Detail: string(respBody),
+			}
+		}
+
+		data = respBody
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	decoded, err := snappy.Decode(nil, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress remote read response: %w", err)
+	}
+
+	return decodeReadResponse(decoded, metricName)
+}
+
+// encodeReadRequest encodes a prometheus.ReadRequest with a single query
+func encodeReadRequest(startMs, endMs int64, matchers []config.LabelMatcher) []byte {
+	var query []byte
+	query = protowire.AppendTag(query, 1, protowire.VarintType)
+	query = protowire.AppendVarint(query, uint64(startMs))
+	query = protowire.AppendTag(query, 2, protowire.VarintType)
+	query = protowire.AppendVarint(query, uint64(endMs))
+
+	for _, m := range matchers {
+		var matcher []byte
+		matcher = protowire.AppendTag(matcher, 1, protowire.VarintType)
+		matcher = protowire.AppendVarint(matcher, uint64(m.Type))
+		matcher = protowire.AppendTag(matcher, 2, protowire.BytesType)
+		matcher = protowire.AppendString(matcher, m.Name)
+		matcher = protowire.AppendTag(matcher, 3, protowire.BytesType)
+		matcher = protowire.AppendString(matcher, m.Value)
+
+		query = protowire.AppendTag(query, 3, protowire.BytesType)
+		query = protowire.AppendBytes(query, matcher)
+	}
+
+	var req []byte
+	req = protowire.AppendTag(req, 1, protowire.BytesType)
+	req = protowire.AppendBytes(req, query)
+	return req
+}
+
+// decodeReadResponse decodes a prometheus.ReadResponse into metric results
+func decodeReadResponse(b []byte, metricName string) ([]MetricResult, error) {
+	var results []MetricResult
+
+	// ReadResponse.results -> QueryResult.timeseries
+	err := walkMessage(b, func(num protowire.Number, _ uint64, queryResult []byte) error {
+		if num != 1 {
+			return nil
+		}
+		return walkMessage(queryResult, func(num protowire.Number, _ uint64, series []byte) error {
+			if num != 1 {
+				return nil
+			}
+			seriesResults, err := decodeTimeSeries(series, metricName)
+			if err != nil {
+				return err
+			}
+			results = append(results, seriesResults...)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode remote read response: %w", err)
+	}
+
+	return results, nil
+}
+
+// decodeTimeSeries decodes a prometheus.TimeSeries into one result per sample
+func decodeTimeSeries(b []byte, metricName string) ([]MetricResult, error) {
+	labels := make(map[string]string)
+	type sample struct {
+		value float64
+		ts    int64
+	}
+	var samples []sample
+
+	err := walkMessage(b, func(num protowire.Number, _ uint64, data []byte) error {
+		switch num {
+		case 1: // Label
+			var name, value string
+			err := walkMessage(data, func(num protowire.Number, _ uint64, data []byte) error {
+				switch num {
+				case 1:
+					name = string(data)
+				case 2:
+					value = string(data)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			labels[name] = value
+		case 2: // Sample
+			var s sample
+			err := walkMessage(data, func(num protowire.Number, v uint64, _ []byte) error {
+				switch num {
+				case 1:
+					s.value = math.Float64frombits(v)
+				case 2:
+					s.ts = int64(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			samples = append(samples, s)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]MetricResult, 0, len(samples))
+	for _, s := range samples {
+		metricResult := MetricResult{
+			Name:      metricName,
+			Timestamp: time.UnixMilli(s.ts),
+			Value:     s.value,
+			Labels:    make(map[string]string, len(labels)),
+		}
+		for k, v := range labels {
+			metricResult.Labels[k] = v
+		}
+		results = append(results, metricResult)
+	}
+
+	return results, nil
+}
+
+// walkMessage calls fn for each field of a protobuf message. Scalar fields are
+// passed as v; length-delimited fields are passed as data.
+func walkMessage(b []byte, fn func(num protowire.Number, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var v uint64
+		var data []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var v32 uint32
+			v32, n = protowire.ConsumeFixed32(b)
+			v = uint64(v32)
+		case protowire.BytesType:
+			data, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := fn(num, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package prometheus
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+// processValue converts a query result into one MetricResult per sample,
+// named metricName and labelled with its series' labels. A string result keeps
+// its raw value in the string_value label and its numeric value when it parses
+// as one.
+func processValue(value model.Value, metricName string) ([]MetricResult, error) {
+	results := make([]MetricResult, 0, sampleCount(value))
+	err := eachResult(value, metricName, func(r MetricResult) error {
+		results = append(results, r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// eachResult is processValue passing each result to emit as it is converted,
+// so a large range result is never copied in full. It stops at the first error
+// returned by emit.
+func eachResult(value model.Value, metricName string, emit func(MetricResult) error) error {
+	switch v := value.(type) {
+	case model.Vector:
+		for _, sample := range v {
+			err := emit(MetricResult{
+				Name:      metricName,
+				Timestamp: sample.Timestamp.Time(),
+				Value:     float64(sample.Value),
+				Labels:    labelMap(sample.Metric),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	case model.Matrix:
+		for _, stream := range v {
+			for _, point := range stream.Values {
+				err := emit(MetricResult{
+					Name:      metricName,
+					Timestamp: point.Timestamp.Time(),
+					Value:     float64(point.Value),
+					Labels:    labelMap(stream.Metric),
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+	case *model.Scalar:
+		return emit(MetricResult{
+			Name:      metricName,
+			Timestamp: v.Timestamp.Time(),
+			Value:     float64(v.Value),
+			Labels:    make(map[string]string),
+		})
+	case *model.String:
+		value, _ := strconv.ParseFloat(v.Value, 64)
+		return emit(MetricResult{
+			Name:      metricName,
+			Timestamp: v.Timestamp.Time(),
+			Value:     value,
+			Labels:    map[string]string{stringValueLabel: v.Value},
+		})
+	default:
+		return fmt.Errorf("unsupported result type for metric %s: %s", metricName, value.Type().String())
+	}
+	return nil
+}
+
+// labelMap copies a series' labels into a new map
+func labelMap(metric model.Metric) map[string]string {
+	labels := make(map[string]string, len(metric))
+	for labelName, labelValue := range metric {
+		labels[string(labelName)] = string(labelValue)
+	}
+	return labels
+}
+
+// resultFilter applies the processing shared by the results of every query of
+// a metric: the expectLabels and missingLabels checks, unit conversion,
+// nonFiniteValues, the source and API proxy names and the collection time
+type resultFilter struct {
+	c        *Client
+	metric   config.MetricConfig
+	apiProxy string
+	labels   *labelCheck
+
+	// collectedAt is when the query ran, recorded on every result with
+	// prometheus.recordCollectedAt
+	collectedAt time.Time
+
+	// nonFinite counts the NaN and Inf values dropped or replaced
+	nonFinite int
+}
+
+// newResultFilter returns the filter for one query of metric for apiProxy
+func (c *Client) newResultFilter(metric config.MetricConfig, apiProxy string) *resultFilter {
+	return &resultFilter{c: c, metric: metric, apiProxy: apiProxy, labels: newLabelCheck(metric)}
+}
+
+// keep processes r in place and reports whether it should be stored
+func (f *resultFilter) keep(r *MetricResult) bool {
+	if !f.labels.keep(*r) {
+		return false
+	}
+	r.Value = f.metric.ConvertValue(r.Value)
+	keep, affected := f.c.applyNonFinite(r)
+	if affected {
+		f.nonFinite++
+	}
+	if !keep {
+		return false
+	}
+	f.c.tagSource(r)
+	r.APIProxy = f.apiProxy
+	r.CollectedAt = f.collectedAt
+	return true
+}
+
+// queried records the current time as the collection time of the results,
+// when prometheus.recordCollectedAt is set
+func (f *resultFilter) queried() {
+	if f.c.config.RecordCollectedAt {
+		f.collectedAt = time.Now()
+	}
+}
+
+// log reports the results the filter dropped or changed
+func (f *resultFilter) log() {
+	f.c.logNonFinite(f.metric.Name, f.nonFinite)
+	f.labels.log(f.apiProxy)
+}
@@ -0,0 +1,108 @@
+package prometheus
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// unsupportedValue is a query result type processValue does not know
+type unsupportedValue struct{}
+
+func (unsupportedValue) Type() model.ValueType { return model.ValNone }
+func (unsupportedValue) String() string        { return "" }
+
+func TestProcessValue(t *testing.T) {
+	ts := model.TimeFromUnix(1712448000)
+	at := ts.Time()
+	orders := model.Metric{"__name__": "requests_total", "app": "orders"}
+	billing := model.Metric{"__name__": "requests_total", "app": "billing"}
+	ordersLabels := map[string]string{"__name__": "requests_total", "app": "orders"}
+	billingLabels := map[string]string{"__name__": "requests_total", "app": "billing"}
+
+	tests := []struct {
+		name  string
+		value model.Value
+		want  []MetricResult
+	}{
+		{
+			name: "vector",
+			value: model.Vector{
+				{Metric: orders, Value: 1.5, Timestamp: ts},
+				{Metric: billing, Value: 2, Timestamp: ts},
+			},
+			want: []MetricResult{
+				{Name: "requests", Timestamp: at, Value: 1.5, Labels: ordersLabels},
+				{Name: "requests", Timestamp: at, Value: 2, Labels: billingLabels},
+			},
+		},
+		{
+			name: "matrix",
+			value: model.Matrix{
+				{Metric: orders, Values: []model.SamplePair{{Timestamp: ts, Value: 1}, {Timestamp: ts.Add(time.Minute), Value: 2}}},
+				{Metric: billing, Values: []model.SamplePair{{Timestamp: ts, Value: 3}}},
+			},
+			want: []MetricResult{
+				{Name: "requests", Timestamp: at, Value: 1, Labels: ordersLabels},
+				{Name: "requests", Timestamp: at.Add(time.Minute), Value: 2, Labels: ordersLabels},
+				{Name: "requests", Timestamp: at, Value: 3, Labels: billingLabels},
+			},
+		},
+		{
+			name:  "empty vector",
+			value: model.Vector{},
+			want:  []MetricResult{},
+		},
+		{
+			name:  "scalar",
+			value: &model.Scalar{Value: 42, Timestamp: ts},
+			want:  []MetricResult{{Name: "requests", Timestamp: at, Value: 42, Labels: map[string]string{}}},
+		},
+		{
+			name:  "numeric string",
+			value: &model.String{Value: "0.25", Timestamp: ts},
+			want:  []MetricResult{{Name: "requests", Timestamp: at, Value: 0.25, Labels: map[string]string{stringValueLabel: "0.25"}}},
+		},
+		{
+			name:  "other string",
+			value: &model.String{Value: "v1.2.3", Timestamp: ts},
+			want:  []MetricResult{{Name: "requests", Timestamp: at, Value: 0, Labels: map[string]string{stringValueLabel: "v1.2.3"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := processValue(tt.value, "requests")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("processValue =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("unsupported", func(t *testing.T) {
+		if _, err := processValue(unsupportedValue{}, "requests"); err == nil || !strings.Contains(err.Error(), "unsupported result type for metric requests") {
+			t.Errorf("processValue error = %v, want an unsupported result type", err)
+		}
+	})
+}
+
+func TestEachResultStops(t *testing.T) {
+	value := model.Matrix{
+		{Metric: model.Metric{"app": "orders"}, Values: []model.SamplePair{{Value: 1}, {Value: 2}, {Value: 3}}},
+	}
+	stop := errors.New("stop")
+	calls := 0
+	err := eachResult(value, "requests", func(MetricResult) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("eachResult = %v after %d calls, want %v after 1", err, calls, stop)
+	}
+}
@@ -0,0 +1,108 @@
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/kiquetal/go-duckdb-ingester/internal/backoff"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+)
+
+// withRetry runs op until it succeeds, returns a non-retryable error, or the
+// configured number of retries is exhausted. Backoff is exponential with
+// jitter and never sleeps past the context deadline. A 429 response is instead
+// retried after the delay in its Retry-After header, capped at maxRetryAfter,
+// and counts against maxThrottledRetries rather than maxRetries: throttling is
+// the server asking to slow down, not a failure.
+func (c *Client) withRetry(ctx context.Context, desc string, op func() error) error {
+	var retries, throttledRetries int
+	for {
+		// Every attempt is a request counted against the rate limit
+		if err := c.waitForRate(ctx); err != nil {
+			return err
+		}
+		err := op()
+		if err == nil || !isRetryable(err) {
+			return err
+		}
+
+		var delay time.Duration
+		if isThrottled(err) {
+			if throttledRetries >= c.config.MaxThrottledRetries {
+				return err
+			}
+			retryAfter, ok := c.retryAfter(err)
+			if !ok {
+				retryAfter = backoff.Delay(c.config.RetryBackoff, throttledRetries)
+			}
+			delay = retryAfter
+			throttledRetries++
+		} else {
+			if retries >= c.config.MaxRetries {
+				return err
+			}
+			delay = backoff.Delay(c.config.RetryBackoff, retries)
+			retries++
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+
+		if isThrottled(err) {
+			slog.Warn("Prometheus is rate limiting requests, waiting before retrying", "operation", desc,
+				"delay", delay, "attempt", throttledRetries, "max_retries", c.config.MaxThrottledRetries)
+		} else {
+			slog.Warn("Retrying Prometheus request", "operation", desc, "delay", delay,
+				"attempt", retries, "max_retries", c.config.MaxRetries, "error", err)
+		}
+
+		if !backoff.Sleep(ctx, delay) {
+			return err
+		}
+	}
+}
+
+// isThrottled reports whether err is a 429 Too Many Requests response
+func isThrottled(err error) bool {
+	var limited *rateLimitedError
+	return errors.As(err, &limited)
+}
+
+// retryAfter returns the delay a 429 response asked for, capped at
+// maxRetryAfter. It reports false when err is not a 429 or the response had no
+// usable Retry-After header, leaving the delay to the exponential backoff.
+func (c *Client) retryAfter(err error) (time.Duration, bool) {
+	var limited *rateLimitedError
+	if !errors.As(err, &limited) || limited.retryAfter <= 0 {
+		return 0, false
+	}
+	return min(limited.retryAfter, c.config.MaxRetryAfter), true
+}
+
+// isRetryable reports whether err is a transient failure worth retrying.
+// Network errors and 5xx responses are retried, while malformed queries and
+// other client-side errors fail fast. 429 Too Many Requests is retried too.
+func isRetryable(err error) bool {
+	if isThrottled(err) {
+		return true
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiErr *v1.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Type {
+		case v1.ErrServer, v1.ErrTimeout, v1.ErrBadResponse:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// Anything else is a transport-level failure (connection refused, reset, DNS)
+	return true
+}
@@ -0,0 +1,83 @@
+package prometheus
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// throttlingServer answers the first throttled requests with 429 and the
+// given Retry-After header and later ones with an empty vector. It returns
+// the server URL and a function listing when each request arrived.
+func throttlingServer(t *testing.T, throttled int, retryAfter string) (string, func() []time.Time) {
+	var mu sync.Mutex
+	var requests []time.Time
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, time.Now())
+		n := len(requests)
+		mu.Unlock()
+		if n <= throttled {
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(emptyVector))
+	})
+	return srv.URL, func() []time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]time.Time(nil), requests...)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter string
+		override   string
+		minWait    time.Duration
+		maxWait    time.Duration
+	}{
+		// maxRetries defaults to 0, which must not disable retries of 429s
+		{"honoured", "1", "", time.Second, 5 * time.Second},
+		{"capped", "30", "prometheus: {maxRetryAfter: 100ms}", 100 * time.Millisecond, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, requests := throttlingServer(t, 1, tt.retryAfter)
+			client, cfg := newTestClient(t, url, tt.override)
+			if cfg.Prometheus.MaxRetries != 0 {
+				t.Fatalf("MaxRetries = %d, want the default 0", cfg.Prometheus.MaxRetries)
+			}
+
+			if _, err := client.CollectMetrics(context.Background(), "orders", time.Now()); err != nil {
+				t.Fatal(err)
+			}
+			got := requests()
+			if len(got) != 2 {
+				t.Fatalf("got %d requests, want the throttled one and its retry", len(got))
+			}
+			if wait := got[1].Sub(got[0]); wait < tt.minWait || wait > tt.maxWait {
+				t.Errorf("retried after %s, want between %s and %s", wait, tt.minWait, tt.maxWait)
+			}
+		})
+	}
+}
+
+func TestThrottledRetriesExhausted(t *testing.T) {
+	url, requests := throttlingServer(t, 100, "0")
+	client, _ := newTestClient(t, url, "prometheus: {maxThrottledRetries: 2, retryBackoff: 1ms}")
+
+	_, err := client.CollectMetrics(context.Background(), "orders", time.Now())
+	if err == nil || !strings.Contains(err.Error(), "429") {
+		t.Fatalf("CollectMetrics error = %v, want a 429", err)
+	}
+	if got := len(requests()); got != 3 {
+		t.Errorf("got %d requests, want 1 and 2 retries", got)
+	}
+}
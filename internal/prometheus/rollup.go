@@ -0,0 +1,71 @@
+package prometheus
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+// Rollup statistics, appended to the metric name of rollup results as <metric>:<stat>
+const (
+	RollupMin   = "min"
+	RollupMax   = "max"
+	RollupAvg   = "avg"
+	RollupCount = "count"
+)
+
+// Rollup summarizes each series over a batch window. Every series yields four
+// results named <metric>:min, <metric>:max, <metric>:avg and <metric>:count,
+// stamped with the window start and carrying the series' labels and source.
+// Results are ordered by series so output is stable across runs.
+func Rollup(metrics []MetricResult, window TimeRange) []MetricResult {
+	series := make(map[string][]MetricResult)
+	var keys []string
+	for _, m := range metrics {
+		key := SeriesKey(m)
+		if _, ok := series[key]; !ok {
+			keys = append(keys, key)
+		}
+		series[key] = append(series[key], m)
+	}
+	sort.Strings(keys)
+
+	// The functions are shared with Downsample and always exist
+	minOf, _ := aggregator(config.DownsampleMin)
+	maxOf, _ := aggregator(config.DownsampleMax)
+	avgOf, _ := aggregator(config.DownsampleAvg)
+
+	results := make([]MetricResult, 0, 4*len(keys))
+	for _, key := range keys {
+		samples := series[key]
+		first := samples[0]
+		stat := func(name string, value float64) MetricResult {
+			return MetricResult{
+				Name:         first.Name + ":" + name,
+				Timestamp:    window.Start,
+				Value:        value,
+				Labels:       first.Labels,
+				Source:       first.Source,
+				APIProxy:     first.APIProxy,
+				CollectedAt:  first.CollectedAt,
+				InvocationID: first.InvocationID,
+			}
+		}
+		results = append(results,
+			stat(RollupMin, minOf(samples)),
+			stat(RollupMax, maxOf(samples)),
+			stat(RollupAvg, avgOf(samples)),
+			stat(RollupCount, float64(len(samples))),
+		)
+	}
+	return results
+}
+
+// RollupMetric returns the name of the metric a rollup result summarizes
+func RollupMetric(name string) string {
+	if i := strings.LastIndexByte(name, ':'); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
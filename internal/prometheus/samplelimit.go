@@ -0,0 +1,80 @@
+package prometheus
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+// maxSamples returns the sample limit of a metric's queries, 0 when unlimited
+func (c *Client) maxSamples(metric config.MetricConfig) int {
+	if metric.MaxSamples > 0 {
+		return metric.MaxSamples
+	}
+	return c.config.MaxSamples
+}
+
+// checkSampleLimit applies prometheus.maxSamplesAction to a result of count
+// samples. It returns the number of samples to keep, or an error when the
+// result must be rejected.
+func (c *Client) checkSampleLimit(metric config.MetricConfig, apiProxy string, count int) (int, error) {
+	limit := c.maxSamples(metric)
+	if limit == 0 || count <= limit {
+		return count, nil
+	}
+
+	if c.config.MaxSamplesAction == config.MaxSamplesTruncate {
+		slog.Warn("Query returned more samples than maxSamples, truncating", "source", c.config.SourceName,
+			"metric", metric.Name, "api_proxy", apiProxy, "samples", count, "max_samples", limit)
+		return limit, nil
+	}
+	slog.Error("Query returned more samples than maxSamples, check it for a missing aggregation",
+		"source", c.config.SourceName, "metric", metric.Name, "api_proxy", apiProxy, "samples", count, "max_samples", limit)
+	return 0, fmt.Errorf("metric %s returned %d samples, more than maxSamples %d", metric.Name, count, limit)
+}
+
+// sampleCount returns the number of float samples in a query result
+func sampleCount(result model.Value) int {
+	switch v := result.(type) {
+	case model.Vector:
+		return len(v)
+	case model.Matrix:
+		count := 0
+		for _, stream := range v {
+			count += len(stream.Values)
+		}
+		return count
+	default:
+		return 1
+	}
+}
+
+// truncateSamples returns result cut to its first limit samples. Matrix series
+// are kept whole until the last one, which is cut short.
+func truncateSamples(result model.Value, limit int) model.Value {
+	switch v := result.(type) {
+	case model.Vector:
+		if len(v) > limit {
+			return v[:limit]
+		}
+	case model.Matrix:
+		kept := make(model.Matrix, 0, len(v))
+		for _, stream := range v {
+			if limit == 0 {
+				break
+			}
+			if len(stream.Values) > limit {
+				cut := *stream
+				cut.Values = stream.Values[:limit]
+				stream = &cut
+			}
+			limit -= len(stream.Values)
+			kept = append(kept, stream)
+		}
+		return kept
+	}
+	return result
+}
@@ -0,0 +1,41 @@
+package prometheus
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestScaleBytesToGigabytes(t *testing.T) {
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"app":"orders"},"value":[1712448000,"5368709120"]}]}}`))
+	})
+	override := `
+prometheus:
+  metrics:
+    - name: heap
+      query: 'sum(heap_bytes{app="{{.APIProxy}}"})'
+      scale: 1e-9
+`
+	client, _ := newTestClient(t, srv.URL, override)
+	metrics, err := client.CollectMetrics(context.Background(), "orders", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The base metric, unscaled, gets the same answer
+	var heap []MetricResult
+	for _, metric := range metrics {
+		if metric.Name == "heap" {
+			heap = append(heap, metric)
+		}
+	}
+	if len(heap) != 1 {
+		t.Fatalf("got %d heap samples, want 1", len(heap))
+	}
+	if want := 5.36870912; math.Abs(heap[0].Value-want) > 1e-9 {
+		t.Errorf("Value = %v, want %v GB", heap[0].Value, want)
+	}
+}
@@ -0,0 +1,78 @@
+package prometheus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+// combinedResults returns what a combined batch holds for an aggregated
+// query: one sample per API proxy at the same timestamp and without labels
+func combinedResults() []MetricResult {
+	ts := time.Date(2025, 4, 7, 0, 0, 0, 0, time.UTC)
+	return []MetricResult{
+		{Name: "requests", Timestamp: ts, Value: 10, Labels: map[string]string{}, APIProxy: "orders"},
+		{Name: "requests", Timestamp: ts, Value: 1000, Labels: map[string]string{}, APIProxy: "billing"},
+	}
+}
+
+// valuesByProxy maps the API proxy of each result to its value, failing on
+// a proxy seen twice
+func valuesByProxy(t *testing.T, metrics []MetricResult) map[string]float64 {
+	t.Helper()
+	values := make(map[string]float64)
+	for _, m := range metrics {
+		if _, ok := values[m.APIProxy]; ok {
+			t.Fatalf("two results for API proxy %s", m.APIProxy)
+		}
+		values[m.APIProxy] = m.Value
+	}
+	return values
+}
+
+func TestSeriesKeyAPIProxy(t *testing.T) {
+	metrics := combinedResults()
+	if SeriesKey(metrics[0]) == SeriesKey(metrics[1]) {
+		t.Fatal("results of different API proxies have the same series key")
+	}
+}
+
+func TestDownsampleAPIProxies(t *testing.T) {
+	got, err := Downsample(combinedResults(), 5*time.Minute, config.DownsampleAvg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := valuesByProxy(t, got)
+	if values["orders"] != 10 || values["billing"] != 1000 {
+		t.Errorf("downsampled values = %v, want orders 10 and billing 1000", values)
+	}
+}
+
+func TestRollupAPIProxies(t *testing.T) {
+	metrics := combinedResults()
+	got := Rollup(metrics, TimeRange{Start: metrics[0].Timestamp, End: metrics[0].Timestamp.Add(time.Hour)})
+
+	byStat := make(map[string][]MetricResult)
+	for _, m := range got {
+		byStat[m.Name] = append(byStat[m.Name], m)
+	}
+	for _, stat := range []string{RollupMin, RollupMax, RollupAvg} {
+		values := valuesByProxy(t, byStat["requests:"+stat])
+		if values["orders"] != 10 || values["billing"] != 1000 {
+			t.Errorf("%s = %v, want orders 10 and billing 1000", stat, values)
+		}
+	}
+	values := valuesByProxy(t, byStat["requests:"+RollupCount])
+	if values["orders"] != 1 || values["billing"] != 1 {
+		t.Errorf("count = %v, want 1 for each API proxy", values)
+	}
+}
+
+func TestDedupAPIProxies(t *testing.T) {
+	got := Dedup(combinedResults())
+	values := valuesByProxy(t, got)
+	if values["orders"] != 10 || values["billing"] != 1000 {
+		t.Errorf("deduplicated values = %v, want orders 10 and billing 1000", values)
+	}
+}
@@ -0,0 +1,44 @@
+package prometheus
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+// streamBufferSize is the number of results buffered between the query
+// goroutines and the consumer of a stream
+const streamBufferSize = 1024
+
+// CollectMetricsRangeStream is like CollectMetricsRange but sends each result
+// on the returned channel as soon as it is decoded instead of buffering the
+// whole batch. If any metric fails, the aggregated error is sent on the error
+// channel before the result channel is closed. Cancel ctx to stop early;
+// prometheus.batchTimeout bounds the whole stream.
+func (c *Client) CollectMetricsRangeStream(ctx context.Context, apiProxy string, timeRange TimeRange) (<-chan MetricResult, <-chan error) {
+	out := make(chan MetricResult, streamBufferSize)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(errc)
+		defer close(out)
+
+		allErrors := c.forEachMetric(ctx, apiProxy, func(ctx context.Context, cfg config.MetricConfig) error {
+			return c.queryRangeMetric(ctx, cfg, apiProxy, timeRange, func(r MetricResult) error {
+				select {
+				case out <- r:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+		})
+
+		if len(allErrors) > 0 {
+			errc <- fmt.Errorf("errors occurred while collecting range metrics: %v", allErrors)
+		}
+	}()
+
+	return out, errc
+}
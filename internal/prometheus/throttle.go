@@ -0,0 +1,68 @@
+package prometheus
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rateLimitedError is returned for a 429 Too Many Requests response, carrying
+// the delay the server asked for in its Retry-After header
+type rateLimitedError struct {
+	// retryAfter is the advertised delay, zero when the header was missing or
+	// could not be parsed
+	retryAfter time.Duration
+}
+
+// Error implements error
+func (e *rateLimitedError) Error() string {
+	if e.retryAfter > 0 {
+		return fmt.Sprintf("rate limited by Prometheus (429 Too Many Requests), retry after %s", e.retryAfter)
+	}
+	return "rate limited by Prometheus (429 Too Many Requests)"
+}
+
+// throttleRoundTripper turns 429 responses into a rateLimitedError. The v1 API
+// reports them as a plain client error and drops the response headers, so the
+// Retry-After header has to be read before the response reaches it.
+type throttleRoundTripper struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (rt *throttleRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		return resp, err
+	}
+
+	// Drain a little of the body so the connection can be reused
+	_, _ = io.CopyN(io.Discard, resp.Body, 4096)
+	resp.Body.Close()
+	return nil, &rateLimitedError{retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+}
+
+// parseRetryAfter parses a Retry-After header, either a number of seconds or
+// an HTTP date, into a delay from now. It returns zero when the header is
+// empty, malformed or in the past.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseInt(header, 10, 64); err == nil {
+		if seconds <= 0 || seconds > int64(1<<62/time.Second) {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		if delay := date.Sub(now); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
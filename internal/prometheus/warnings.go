@@ -0,0 +1,29 @@
+package prometheus
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+)
+
+// checkWarnings reports the warnings Prometheus returned for a metric's query.
+// They are logged with the metric they belong to, or returned as an error when
+// prometheus.warningsAsErrors is set.
+func (c *Client) checkWarnings(metric, apiProxy string, warnings v1.Warnings) error {
+	if len(warnings) == 0 {
+		return nil
+	}
+
+	if c.config.WarningsAsErrors {
+		return fmt.Errorf("query for metric %s returned warnings: %s", metric, strings.Join(warnings, "; "))
+	}
+
+	slog.Warn("Prometheus returned warnings",
+		"source", c.config.SourceName,
+		"api_proxy", apiProxy,
+		"metric", metric,
+		"warnings", []string(warnings))
+	return nil
+}
@@ -0,0 +1,297 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/prometheus/common/model"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go-source/s3v2"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+
+	"github.com/kiquetal/go-duckdb-ingester/internal/prometheus"
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+// CompactResult describes one compacted partition directory
+type CompactResult struct {
+	// Output is the compacted file
+	Output string
+
+	// Inputs are the files read into Output
+	Inputs []string
+
+	// Rows is the number of rows written to Output
+	Rows int
+
+	// Deleted are the inputs removed after Output was written
+	Deleted []string
+}
+
+// Compact rewrites the Parquet files directly inside the partition directory
+// dir into one file named output, sorted by timestamp. Files in
+// subdirectories, such as metric=<name> partitions, are left alone.
+//
+// An existing output is merged again along with the other files, and repeated
+// samples of a series (metric, source, API proxy and labels, see
+// prometheus.SeriesKey) at one timestamp are written once, so compacting a
+// partition twice, with or without deleting the originals, never duplicates
+// rows. With deleteOriginals the merged files and their sidecars are removed
+// once the output is complete. Manifests are only updated by WriteManifests.
+//
+// The whole partition is held in memory, and the files must have been written
+// with the current storage.promoteLabels.
+func (s *ParquetStorage) Compact(ctx context.Context, dir, output string, deleteOriginals bool) (CompactResult, error) {
+	dir = strings.TrimSuffix(dir, "/")
+	res := CompactResult{Output: dir + "/" + output}
+	if s.config.Format != "" && s.config.Format != config.FormatParquet {
+		return res, fmt.Errorf("compaction requires storage.format %q", config.FormatParquet)
+	}
+	if s.schema.series {
+		return res, fmt.Errorf("compaction does not support storage.layout %q", config.LayoutSeries)
+	}
+
+	files, err := s.listParquetFiles(ctx, dir)
+	if err != nil {
+		return res, err
+	}
+	res.Inputs = files
+	if len(files) == 0 || (len(files) == 1 && files[0] == res.Output) {
+		// Nothing to merge
+		return res, nil
+	}
+
+	var metrics []prometheus.MetricResult
+	for _, file := range res.Inputs {
+		read, err := s.readParquetFile(ctx, file)
+		if err != nil {
+			return res, err
+		}
+		metrics = append(metrics, read...)
+	}
+
+	metrics = prometheus.Dedup(metrics)
+
+	// Stable, so rows of one timestamp keep the order they were written in
+	sort.SliceStable(metrics, func(i, j int) bool {
+		return metrics[i].Timestamp.Before(metrics[j].Timestamp)
+	})
+
+	res.Rows, err = s.StoreMetrics(ctx, metrics, res.Output)
+	if err != nil {
+		return res, fmt.Errorf("failed to write %s: %w", res.Output, err)
+	}
+
+	if !deleteOriginals {
+		return res, nil
+	}
+	var errs []error
+	for _, file := range res.Inputs {
+		if file == res.Output {
+			continue
+		}
+		if err := s.deleteFile(ctx, file); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		s.manifests.record(file, nil)
+		if err := s.deleteFile(ctx, file+sidecarSuffix); err != nil {
+			errs = append(errs, err)
+		}
+		res.Deleted = append(res.Deleted, file)
+	}
+	return res, errors.Join(errs...)
+}
+
+// listParquetFiles returns the complete Parquet files directly inside dir in name order
+func (s *ParquetStorage) listParquetFiles(ctx context.Context, dir string) ([]string, error) {
+	var files []string
+	if !isS3Path(dir) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", dir, err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".parquet") {
+				files = append(files, dir+"/"+entry.Name())
+			}
+		}
+		return files, nil
+	}
+
+	bucket, prefix, err := parseS3Path(dir)
+	if err != nil {
+		return nil, err
+	}
+	paginator := s3.NewListObjectsV2Paginator(s.s3Client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucket),
+		Prefix:    aws.String(prefix + "/"),
+		Delimiter: aws.String("/"),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", dir, err)
+		}
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			if strings.HasSuffix(key, ".parquet") {
+				files = append(files, s3Scheme+bucket+"/"+key)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// readParquetFile reads every row of a Parquet file written by this storage
+// back into metrics, restoring promoted labels into the label set
+func (s *ParquetStorage) readParquetFile(ctx context.Context, filename string) ([]prometheus.MetricResult, error) {
+	f, err := s.openParquetFile(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Rows are read into the current columns, which files of other versions do
+	// not have, so check the footer before the reader maps the schema
+	footer := &reader.ParquetReader{PFile: f}
+	if err := footer.ReadFooter(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", filename, err)
+	}
+	version, err := fileSchemaVersion(footer.Footer.KeyValueMetadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", filename, err)
+	}
+	if version != SchemaVersion {
+		return nil, fmt.Errorf("%s has schema version %d, compaction requires version %d", filename, version, SchemaVersion)
+	}
+	if precision := filePrecision(footer.Footer.KeyValueMetadata); precision != s.schema.timestampPrecision() {
+		return nil, fmt.Errorf("%s has timestamp precision %q, storage.timestampPrecision is %q", filename, precision, s.schema.timestampPrecision())
+	}
+
+	pr, err := reader.NewParquetReader(f, s.schema.newObject(), 1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", filename, err)
+	}
+	defer pr.ReadStop()
+
+	// The reader fills as many rows as the slice holds
+	numRows := int(pr.GetNumRows())
+	rows := reflect.New(reflect.SliceOf(s.schema.rowType()))
+	rows.Elem().Set(reflect.MakeSlice(rows.Elem().Type(), numRows, numRows))
+	if err := pr.Read(rows.Interface()); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", filename, err)
+	}
+
+	slice := rows.Elem()
+	metrics := make([]prometheus.MetricResult, 0, slice.Len())
+	for i := 0; i < slice.Len(); i++ {
+		metrics = append(metrics, s.schema.metric(slice.Index(i)))
+	}
+	return metrics, nil
+}
+
+// openParquetFile opens a Parquet file on local disk or in S3 for the reader
+func (s *ParquetStorage) openParquetFile(ctx context.Context, filename string) (source.ParquetFile, error) {
+	if !isS3Path(filename) {
+		f, err := local.NewLocalFileReader(filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %w", filename, err)
+		}
+		return f, nil
+	}
+
+	bucket, key, err := parseS3Path(filename)
+	if err != nil {
+		return nil, err
+	}
+	f, err := s3v2.NewS3FileReaderWithClient(ctx, s.s3Client, bucket, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", filename, err)
+	}
+	return f, nil
+}
+
+// deleteFile removes a file on local disk or in S3; a missing file is not an error
+func (s *ParquetStorage) deleteFile(ctx context.Context, filename string) error {
+	if !isS3Path(filename) {
+		if err := os.Remove(filename); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", filename, err)
+		}
+		return nil
+	}
+
+	bucket, key, err := parseS3Path(filename)
+	if err != nil {
+		return err
+	}
+	// Deleting a missing object succeeds, so there is nothing to check first
+	if _, err := s.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", filename, err)
+	}
+	return nil
+}
+
+// rowType returns the Go type of a row
+func (rs recordSchema) rowType() reflect.Type {
+	if rs.typ == nil {
+		return reflect.TypeOf(MetricRecord{})
+	}
+	return rs.typ
+}
+
+// metric converts a row read back from a file into a metric, the inverse of record
+func (rs recordSchema) metric(row reflect.Value) prometheus.MetricResult {
+	rec := MetricRecord{}
+	base := reflect.ValueOf(&rec).Elem()
+	for i := 0; i < base.NumField(); i++ {
+		if rs.dictionaryLabels && base.Type().Field(i).Name == "Labels" {
+			for _, label := range row.Field(i).Interface().([]dictionaryLabel) {
+				rec.Labels = append(rec.Labels, Label(label))
+			}
+			continue
+		}
+		base.Field(i).Set(row.Field(i))
+	}
+
+	labels := make(map[string]string, len(rec.Labels)+len(rs.promoted))
+	for _, label := range rec.Labels {
+		labels[label.Key] = label.Value
+	}
+	if rec.OriginalName != nil {
+		labels[model.MetricNameLabel] = *rec.OriginalName
+	}
+	for i, label := range rs.promoted {
+		if value := row.Field(base.NumField() + i); !value.IsNil() {
+			labels[label] = value.Elem().String()
+		}
+	}
+
+	metric := prometheus.MetricResult{
+		Name:      rec.MetricName,
+		Timestamp: rs.fromUnixTime(rec.Timestamp),
+		Value:     rec.Value,
+		Labels:    labels,
+		Source:    rec.Source,
+		APIProxy:  rec.ApiProxy,
+
+		InvocationID: rec.InvocationID,
+	}
+	if rec.CollectedAt != nil {
+		metric.CollectedAt = time.UnixMilli(*rec.CollectedAt).UTC()
+	}
+	return metric
+}
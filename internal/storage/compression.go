@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	_ "unsafe" // for go:linkname
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/xitongsys/parquet-go/compress"
+	"github.com/xitongsys/parquet-go/parquet"
+)
+
+// parquetCompressors is parquet-go's codec registry. The library always uses
+// default compression levels and offers no way to configure them, so init
+// wraps its gzip and zstd compressors once, before any writer can read the
+// registry. The symbol is private to the pinned parquet-go version, so a
+// configured level fails NewParquetStorage when an update removes the symbol
+// or the codec's entry instead of being silently ignored.
+//
+//go:linkname parquetCompressors github.com/xitongsys/parquet-go/compress.compressors
+var parquetCompressors map[parquet.CompressionCodec]*compress.Compressor
+
+// leveledCompressor compresses at a configured level
+type leveledCompressor struct {
+	level    int
+	compress func(buf []byte) ([]byte, error)
+}
+
+// compressionLevels holds the compressor of each codec with levels, nil while
+// the codec compresses at its default level. The map itself is never modified.
+var compressionLevels = map[parquet.CompressionCodec]*atomic.Pointer[leveledCompressor]{
+	parquet.CompressionCodec_GZIP: new(atomic.Pointer[leveledCompressor]),
+	parquet.CompressionCodec_ZSTD: new(atomic.Pointer[leveledCompressor]),
+}
+
+// wrappedCodecs holds the codecs whose parquet-go compressor init wrapped.
+// Written only by init.
+var wrappedCodecs = map[parquet.CompressionCodec]bool{}
+
+func init() {
+	for codec, current := range compressionLevels {
+		builtin := parquetCompressors[codec]
+		if builtin == nil {
+			// Codec excluded from the build with parquet-go's build tags, or
+			// the registry was not found
+			continue
+		}
+		wrappedCodecs[codec] = true
+		parquetCompressors[codec] = &compress.Compressor{
+			Compress: func(buf []byte) []byte {
+				c := current.Load()
+				if c == nil {
+					return builtin.Compress(buf)
+				}
+				out, err := c.compress(buf)
+				if err != nil {
+					// parquet-go compressors cannot return errors, so the page
+					// is compressed at the default level and the failure is
+					// reported when the file is finished
+					recordCompressionFailure(fmt.Errorf("%s compression at level %d failed: %w",
+						strings.ToLower(codec.String()), c.level, err))
+					return builtin.Compress(buf)
+				}
+				return out
+			},
+			Uncompress: builtin.Uncompress,
+		}
+	}
+}
+
+// compressionFailures records failed leveled compressions. Compressors are
+// shared by every writer in the process, so a writer fails if any compression
+// failed while it was open; a retry writes the file again.
+var compressionFailures struct {
+	sync.Mutex
+	count uint64
+	last  error
+}
+
+// recordCompressionFailure records a failed compression
+func recordCompressionFailure(err error) {
+	compressionFailures.Lock()
+	defer compressionFailures.Unlock()
+	compressionFailures.count++
+	compressionFailures.last = err
+}
+
+// compressionFailureCount returns the number of compression failures so far
+func compressionFailureCount() uint64 {
+	compressionFailures.Lock()
+	defer compressionFailures.Unlock()
+	return compressionFailures.count
+}
+
+// compressionFailedSince returns the last compression failure if any happened
+// after count failures
+func compressionFailedSince(count uint64) error {
+	compressionFailures.Lock()
+	defer compressionFailures.Unlock()
+	if compressionFailures.count == count {
+		return nil
+	}
+	return compressionFailures.last
+}
+
+// setCompressionLevel makes codec compress at level for every Parquet writer in
+// the process. A level of 0 restores the codec default. Codecs without levels
+// (snappy, lz4, uncompressed) ignore it. Levels are validated by
+// config.LoadConfig.
+func setCompressionLevel(codec parquet.CompressionCodec, level int) error {
+	current, ok := compressionLevels[codec]
+	if !ok {
+		return nil
+	}
+	if level == 0 {
+		current.Store(nil)
+		return nil
+	}
+	if !wrappedCodecs[codec] {
+		return fmt.Errorf("storage.compressionLevel is not supported: parquet-go's %s compressor was not found in its registry",
+			strings.ToLower(codec.String()))
+	}
+
+	var c *leveledCompressor
+	var err error
+	switch codec {
+	case parquet.CompressionCodec_GZIP:
+		c, err = newGzipCompressor(level)
+	case parquet.CompressionCodec_ZSTD:
+		c, err = newZstdCompressor(level)
+	}
+	if err != nil {
+		return err
+	}
+	current.Store(c)
+	return nil
+}
+
+// newGzipCompressor returns a gzip compressor for level
+func newGzipCompressor(level int) (*leveledCompressor, error) {
+	if _, err := gzip.NewWriterLevel(nil, level); err != nil {
+		return nil, fmt.Errorf("invalid gzip compression level: %w", err)
+	}
+	writers := &sync.Pool{
+		New: func() any {
+			// The level was checked above
+			w, _ := gzip.NewWriterLevel(nil, level)
+			return w
+		},
+	}
+	return &leveledCompressor{
+		level: level,
+		compress: func(buf []byte) ([]byte, error) {
+			var res bytes.Buffer
+			w := writers.Get().(*gzip.Writer)
+			w.Reset(&res)
+			if _, err := w.Write(buf); err != nil {
+				return nil, err
+			}
+			if err := w.Close(); err != nil {
+				return nil, err
+			}
+			w.Reset(nil)
+			writers.Put(w)
+			return res.Bytes(), nil
+		},
+	}, nil
+}
+
+// newZstdCompressor returns a zstd compressor for level
+func newZstdCompressor(level int) (*leveledCompressor, error) {
+	enc, err := zstd.NewWriter(nil, zstd.WithZeroFrames(true), zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+	}
+	return &leveledCompressor{
+		level: level,
+		compress: func(buf []byte) ([]byte, error) {
+			return enc.EncodeAll(buf, nil), nil
+		},
+	}, nil
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/xitongsys/parquet-go/parquet"
+)
+
+// TestCompressionLevel checks that levels reach parquet-go's registry: a
+// higher level must not yield a larger file for repetitive data, files read
+// back intact, and level 0 restores the library's default compression
+func TestCompressionLevel(t *testing.T) {
+	metrics := testMetrics(20000)
+
+	for _, tt := range []struct {
+		codec     string
+		low, high int
+	}{
+		{"gzip", 1, 9},
+		{"zstd", 1, 19},
+	} {
+		t.Run(tt.codec, func(t *testing.T) {
+			t.Cleanup(func() { setCompressionLevel(parquetCodec(t, tt.codec), 0) })
+
+			defaultFile := writeTestFile(t, testStorageConfig(t, "compression: "+tt.codec), metrics)
+			low := writeTestFile(t, testStorageConfig(t, "compression: "+tt.codec+", compressionLevel: "+strconv.Itoa(tt.low)), metrics)
+			high := writeTestFile(t, testStorageConfig(t, "compression: "+tt.codec+", compressionLevel: "+strconv.Itoa(tt.high)), metrics)
+			if fileSize(t, high) > fileSize(t, low) {
+				t.Errorf("level %d file is %d bytes, larger than the %d bytes at level %d",
+					tt.high, fileSize(t, high), fileSize(t, low), tt.low)
+			}
+
+			info, err := InspectParquetFile(high, len(metrics))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(info.Sample) != len(metrics) {
+				t.Fatalf("read back %d rows, want %d", len(info.Sample), len(metrics))
+			}
+			for _, column := range info.Columns {
+				if column.Compression != strings.ToUpper(tt.codec) {
+					t.Errorf("column %s is compressed with %s, want %s", column.Path, column.Compression, strings.ToUpper(tt.codec))
+				}
+			}
+			for i, row := range info.Sample {
+				for _, column := range row {
+					if column.Name == "value" && column.Value != metrics[i].Value {
+						t.Fatalf("row %d value = %v, want %v", i, column.Value, metrics[i].Value)
+					}
+				}
+			}
+
+			// Back to the default level, files match those written before any level was set
+			restored := writeTestFile(t, testStorageConfig(t, "compression: "+tt.codec+", compressionLevel: 0"), metrics)
+			if fileSize(t, restored) != fileSize(t, defaultFile) {
+				t.Errorf("level 0 file is %d bytes, want the default %d bytes", fileSize(t, restored), fileSize(t, defaultFile))
+			}
+		})
+	}
+}
+
+// TestCompressionError checks that a failing compressor fails the write
+// instead of producing a corrupt file
+func TestCompressionError(t *testing.T) {
+	cfg := testStorageConfig(t, "compression: gzip")
+	store, err := NewParquetStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	boom := errors.New("boom")
+	compressionLevels[parquet.CompressionCodec_GZIP].Store(&leveledCompressor{
+		level:    5,
+		compress: func([]byte) ([]byte, error) { return nil, boom },
+	})
+	t.Cleanup(func() { setCompressionLevel(parquet.CompressionCodec_GZIP, 0) })
+
+	filename := filepath.Join(cfg.OutputDir, "metrics.parquet")
+	_, err = store.StoreMetrics(context.Background(), testMetrics(100), filename)
+	if !errors.Is(err, boom) {
+		t.Fatalf("StoreMetrics error = %v, want %v", err, boom)
+	}
+	if _, statErr := os.Stat(filename); !errors.Is(statErr, os.ErrNotExist) {
+		t.Errorf("failed file was left behind: %v", statErr)
+	}
+}
+
+// TestCompressionLevelUnwrapped checks that a configured level fails
+// NewParquetStorage when the codec's parquet-go compressor was not wrapped,
+// as after an update that moves the registry
+func TestCompressionLevelUnwrapped(t *testing.T) {
+	delete(wrappedCodecs, parquet.CompressionCodec_ZSTD)
+	t.Cleanup(func() { wrappedCodecs[parquet.CompressionCodec_ZSTD] = true })
+
+	if _, err := NewParquetStorage(testStorageConfig(t, "compression: zstd, compressionLevel: 3")); err == nil ||
+		!strings.Contains(err.Error(), "compressionLevel is not supported") {
+		t.Fatalf("NewParquetStorage error = %v, want compressionLevel is not supported", err)
+	}
+	// The default level needs no wrapping
+	if _, err := NewParquetStorage(testStorageConfig(t, "compression: zstd")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// parquetCodec maps a codec name to its Parquet codec
+func parquetCodec(t *testing.T, name string) parquet.CompressionCodec {
+	t.Helper()
+	codec, err := compressionCodec(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return codec
+}
@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/kiquetal/go-duckdb-ingester/internal/prometheus"
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+	"github.com/marcboeker/go-duckdb"
+)
+
+// duckDBTable is the table metrics are appended to
+const duckDBTable = "metrics"
+
+// createMetricsTable mirrors the MetricRecord Parquet schema. Columns added
+// later are appended at the end so existing databases can be migrated in place.
+const createMetricsTable = `CREATE TABLE IF NOT EXISTS ` + duckDBTable + ` (
+	timestamp      TIMESTAMP,
+	metric_name    VARCHAR,
+	value          DOUBLE,
+	api_proxy      VARCHAR,
+	labels         MAP(VARCHAR, VARCHAR),
+	date           DATE,
+	source         VARCHAR,
+	original_name  VARCHAR,
+	schema_version INTEGER,
+	collected_at   TIMESTAMP,
+	invocation_id  VARCHAR
+)`
+
+// migrateMetricsTable adds columns missing from databases created by older versions
+var migrateMetricsTable = []string{
+	`ALTER TABLE ` + duckDBTable + ` ADD COLUMN IF NOT EXISTS source VARCHAR`,
+	`ALTER TABLE ` + duckDBTable + ` ADD COLUMN IF NOT EXISTS original_name VARCHAR`,
+	`ALTER TABLE ` + duckDBTable + ` ADD COLUMN IF NOT EXISTS schema_version INTEGER`,
+	`ALTER TABLE ` + duckDBTable + ` ADD COLUMN IF NOT EXISTS collected_at TIMESTAMP`,
+	`ALTER TABLE ` + duckDBTable + ` ADD COLUMN IF NOT EXISTS invocation_id VARCHAR`,
+}
+
+// nullString converts a nullable string for the appender, which takes NULL as nil
+func nullString(v *string) any {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+// nullTime converts an optional time for the appender, passing the zero time as NULL
+func nullTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
+
+// DuckDBStorage writes metrics directly into a DuckDB database file
+type DuckDBStorage struct {
+	config config.StorageConfig
+	db     *sql.DB
+
+	// labels filters the labels stored in the labels map
+	labels labelFilter
+
+	// location is the storage.timezone the date column follows
+	location *time.Location
+}
+
+// NewDuckDBStorage opens (or creates) the DuckDB database and ensures the metrics table exists
+func NewDuckDBStorage(cfg config.StorageConfig) (*DuckDBStorage, error) {
+	if err := mkdirAll(filepath.Dir(cfg.DuckDBPath), dirPerm(cfg)); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %w", err)
+	}
+
+	connector, err := duckdb.NewConnector(cfg.DuckDBPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open duckdb database: %w", err)
+	}
+
+	db := sql.OpenDB(connector)
+	if _, err := db.Exec(createMetricsTable); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create metrics table: %w", err)
+	}
+	for _, migration := range migrateMetricsTable {
+		if _, err := db.Exec(migration); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to migrate metrics table: %w", err)
+		}
+	}
+
+	return &DuckDBStorage{config: cfg, db: db, labels: newLabelFilter(cfg), location: storageLocation(cfg)}, nil
+}
+
+// StoreMetrics appends metrics to the metrics table using the DuckDB appender API
+// and returns the number of rows appended. The target is only used to identify
+// the batch in error messages.
+func (s *DuckDBStorage) StoreMetrics(ctx context.Context, metrics []prometheus.MetricResult, target string) (int, error) {
+	return s.appendRows(ctx, target, func(write func(prometheus.MetricResult) error) error {
+		for _, metric := range metrics {
+			if err := write(metric); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// StoreMetricsStream appends metrics to the metrics table as they arrive on the stream
+func (s *DuckDBStorage) StoreMetricsStream(ctx context.Context, metrics <-chan prometheus.MetricResult, errs <-chan error, target string) (int, error) {
+	return s.appendRows(ctx, target, func(write func(prometheus.MetricResult) error) error {
+		return drainStream(ctx, metrics, errs, write)
+	})
+}
+
+// appendRows appends every metric produced by produce inside a single
+// transaction, so a failed batch leaves no rows behind
+func (s *DuckDBStorage) appendRows(ctx context.Context, target string, produce func(write func(prometheus.MetricResult) error) error) (int, error) {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get duckdb connection: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "BEGIN TRANSACTION"); err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	rows := 0
+	err = conn.Raw(func(driverConn any) error {
+		appender, err := duckdb.NewAppenderFromConn(driverConn.(driver.Conn), "", duckDBTable)
+		if err != nil {
+			return fmt.Errorf("failed to create appender: %w", err)
+		}
+
+		err = produce(func(metric prometheus.MetricResult) error {
+			if err := ctx.Err(); err != nil {
+				return fmt.Errorf("write of %s interrupted: %w", target, err)
+			}
+
+			labels := make(duckdb.Map, len(metric.Labels))
+			for k, v := range metric.Labels {
+				if s.labels.keep(k) {
+					labels[k] = v
+				}
+			}
+
+			ts := metric.Timestamp.UTC()
+			// DATE values carry no zone, so pass the local day as midnight UTC
+			year, month, day := metric.Timestamp.In(s.location).Date()
+			err := appender.AppendRow(
+				ts,
+				metric.Name,
+				metric.Value,
+				apiProxyOf(metric, s.config.ApiProxyLabelKeys),
+				labels,
+				time.Date(year, month, day, 0, 0, 0, 0, time.UTC),
+				metric.Source,
+				nullString(originalName(metric.Labels)),
+				int32(SchemaVersion),
+				nullTime(metric.CollectedAt),
+				invocationOf(metric, s.config.InvocationID),
+			)
+			if err != nil {
+				return fmt.Errorf("append error for %s: %w", target, err)
+			}
+			rows++
+			return nil
+		})
+		if err != nil {
+			appender.Close()
+			return err
+		}
+
+		if err := appender.Close(); err != nil {
+			return fmt.Errorf("failed to flush rows for %s: %w", target, err)
+		}
+		return nil
+	})
+	if err != nil {
+		// Use a fresh context since the write context may already be cancelled
+		conn.ExecContext(context.Background(), "ROLLBACK")
+		return 0, err
+	}
+
+	if _, err := conn.ExecContext(ctx, "COMMIT"); err != nil {
+		return 0, fmt.Errorf("failed to commit rows for %s: %w", target, err)
+	}
+	return rows, nil
+}
+
+// Exists always reports false: rows are appended to one table, so there is no
+// per-batch output to detect
+func (s *DuckDBStorage) Exists(ctx context.Context, target string) (bool, error) {
+	return false, nil
+}
+
+// StoreEmpty does nothing; DuckDB has no per-batch output to record
+func (s *DuckDBStorage) StoreEmpty(ctx context.Context, target string) error {
+	return nil
+}
+
+// WriteReport writes name below storage.outputDir on local disk
+func (s *DuckDBStorage) WriteReport(ctx context.Context, name string, data []byte) error {
+	if err := mkdirAll(s.config.OutputDir, dirPerm(s.config)); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	filename := filepath.Join(s.config.OutputDir, name)
+	if err := writeLocalFile(filename, data, filePerm(s.config)); err != nil {
+		return fmt.Errorf("failed to write %s: %w", filename, err)
+	}
+	return nil
+}
+
+// MarkPartition does nothing; DuckDB output has no partition directories
+func (s *DuckDBStorage) MarkPartition(ctx context.Context, dir string, complete bool) error {
+	return nil
+}
+
+// WriteManifests does nothing; DuckDB output has no day= directories
+func (s *DuckDBStorage) WriteManifests(ctx context.Context) error {
+	return nil
+}
+
+// Close closes the underlying database
+func (s *DuckDBStorage) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,27 @@
+package storage
+
+import "testing"
+
+// BenchmarkDictionaryEncoding writes the same samples with and without
+// dictionary encoding and reports the file size, e.g.
+//
+//	go test ./internal/storage -run '^$' -bench DictionaryEncoding
+func BenchmarkDictionaryEncoding(b *testing.B) {
+	metrics := testMetrics(100000)
+	for _, bb := range []struct {
+		name    string
+		storage string
+	}{
+		{"plain", "dictionaryEncoding: false"},
+		{"dictionary", "dictionaryEncoding: true"},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			cfg := testStorageConfig(b, bb.storage)
+			var size int64
+			for i := 0; i < b.N; i++ {
+				size = fileSize(b, writeTestFile(b, cfg, metrics))
+			}
+			b.ReportMetric(float64(size), "bytes/file")
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/common"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+// FileInfo describes a Parquet file for the inspect command
+type FileInfo struct {
+	Rows      int64
+	RowGroups int
+	CreatedBy string
+
+	// SchemaVersion is read from the footer metadata, 0 when it has none
+	SchemaVersion int
+
+	// Metadata is the footer key-value metadata
+	Metadata map[string]string
+
+	Columns []ColumnInfo
+
+	// Sample holds the first rows
+	Sample [][]SampleColumn
+}
+
+// SampleColumn is a top-level column of a sample row. Groups such as the
+// labels list are maps and slices keyed by column name.
+type SampleColumn struct {
+	Name  string
+	Value any
+}
+
+// ColumnInfo describes one leaf column of a Parquet file. Sizes and encodings
+// are summed over the row groups.
+type ColumnInfo struct {
+	// Path is the dotted column path, e.g. labels.list.element.key
+	Path              string
+	Type              string
+	ConvertedType     string
+	Repetition        string
+	Compression       string
+	Encodings         []string
+	CompressedBytes   int64
+	UncompressedBytes int64
+
+	// TimestampUnit is MILLIS, MICROS or NANOS for timestamp columns, from the
+	// converted or the logical type, and empty otherwise
+	TimestampUnit string
+}
+
+// InspectParquetFile reads the footer of a local Parquet file and its first
+// sampleRows rows. The file does not need to match the current configuration.
+func InspectParquetFile(filename string, sampleRows int) (FileInfo, error) {
+	var info FileInfo
+	f, err := local.NewLocalFileReader(filename)
+	if err != nil {
+		return info, fmt.Errorf("failed to open %s: %w", filename, err)
+	}
+	defer f.Close()
+
+	// Read the footer on its own, since the row reader renames its columns to
+	// Go field names
+	fr := &reader.ParquetReader{PFile: f}
+	if err := fr.ReadFooter(); err != nil {
+		return info, fmt.Errorf("failed to read %s: %w", filename, err)
+	}
+	footer := fr.Footer
+	info.Rows = footer.NumRows
+	info.RowGroups = len(footer.RowGroups)
+	info.CreatedBy = footer.GetCreatedBy()
+	info.Metadata = make(map[string]string, len(footer.KeyValueMetadata))
+	for _, kv := range footer.KeyValueMetadata {
+		info.Metadata[kv.Key] = kv.GetValue()
+	}
+	if info.SchemaVersion, err = fileSchemaVersion(footer.KeyValueMetadata); err != nil {
+		return info, fmt.Errorf("failed to read %s: %w", filename, err)
+	}
+	info.Columns = columnInfos(footer)
+
+	n := int(min(int64(sampleRows), info.Rows))
+	if n <= 0 {
+		return info, nil
+	}
+
+	// Without an object the reader uses the schema stored in the file
+	pr, err := reader.NewParquetReader(f, nil, 1)
+	if err != nil {
+		return info, fmt.Errorf("failed to read %s: %w", filename, err)
+	}
+	defer pr.ReadStop()
+
+	rows, err := pr.ReadByNumber(n)
+	if err != nil {
+		return info, fmt.Errorf("failed to read rows of %s: %w", filename, err)
+	}
+	names := columnNames(pr.SchemaHandler.Infos)
+	for _, row := range rows {
+		v := reflect.ValueOf(row)
+		columns := make([]SampleColumn, v.NumField())
+		for i := range columns {
+			name := names[v.Type().Field(i).Name]
+			columns[i] = SampleColumn{
+				Name:  name,
+				Value: sampleValue(v.Field(i), names, info.timestampUnit(name)),
+			}
+		}
+		info.Sample = append(info.Sample, columns)
+	}
+	return info, nil
+}
+
+// timestampUnit returns the unit of the timestamps the top-level column name
+// holds, directly or as list elements, 0 when it holds none
+func (info FileInfo) timestampUnit(name string) time.Duration {
+	for _, c := range info.Columns {
+		if c.Path == name || strings.HasPrefix(c.Path, name+".") {
+			switch c.TimestampUnit {
+			case "MILLIS":
+				return time.Millisecond
+			case "MICROS":
+				return time.Microsecond
+			case "NANOS":
+				return time.Nanosecond
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// elementTimestampUnit returns the unit of a timestamp schema element, empty when
+// it is not one
+func elementTimestampUnit(element *parquet.SchemaElement) string {
+	if element.IsSetLogicalType() && element.LogicalType.IsSetTIMESTAMP() {
+		ts := element.LogicalType.TIMESTAMP
+		switch unit := ts.GetUnit(); {
+		case unit.IsSetMILLIS():
+			return "MILLIS"
+		case unit.IsSetMICROS():
+			return "MICROS"
+		case unit.IsSetNANOS():
+			return "NANOS"
+		}
+	}
+	switch element.GetConvertedType() {
+	case parquet.ConvertedType_TIMESTAMP_MILLIS:
+		return "MILLIS"
+	case parquet.ConvertedType_TIMESTAMP_MICROS:
+		return "MICROS"
+	}
+	return ""
+}
+
+// columnInfos lists the leaf columns of a file in schema order
+func columnInfos(footer *parquet.FileMetaData) []ColumnInfo {
+	var columns []ColumnInfo
+	index := make(map[string]int)
+
+	// The first element is the root; leaves have no children. Walk the tree
+	// to build each leaf's path.
+	type level struct {
+		name      string
+		remaining int32
+	}
+	var stack []level
+	for i, element := range footer.Schema {
+		if i == 0 {
+			stack = append(stack, level{remaining: element.GetNumChildren()})
+			continue
+		}
+		for len(stack) > 0 && stack[len(stack)-1].remaining == 0 {
+			stack = stack[:len(stack)-1]
+		}
+		stack[len(stack)-1].remaining--
+
+		if element.GetNumChildren() > 0 {
+			stack = append(stack, level{name: element.Name, remaining: element.GetNumChildren()})
+			continue
+		}
+
+		var path []string
+		for _, l := range stack[1:] {
+			path = append(path, l.name)
+		}
+		path = append(path, element.Name)
+
+		column := ColumnInfo{
+			Path:       strings.Join(path, "."),
+			Repetition: element.GetRepetitionType().String(),
+		}
+		if element.Type != nil {
+			column.Type = element.Type.String()
+		}
+		if element.ConvertedType != nil {
+			column.ConvertedType = element.ConvertedType.String()
+		}
+		column.TimestampUnit = elementTimestampUnit(element)
+		index[column.Path] = len(columns)
+		columns = append(columns, column)
+	}
+
+	for _, group := range footer.RowGroups {
+		for _, chunk := range group.Columns {
+			meta := chunk.GetMetaData()
+			i, ok := index[strings.Join(meta.GetPathInSchema(), ".")]
+			if !ok {
+				continue
+			}
+			column := &columns[i]
+			column.Compression = meta.Codec.String()
+			column.CompressedBytes += meta.TotalCompressedSize
+			column.UncompressedBytes += meta.TotalUncompressedSize
+			for _, encoding := range meta.Encodings {
+				if name := encoding.String(); !slices.Contains(column.Encodings, name) {
+					column.Encodings = append(column.Encodings, name)
+				}
+			}
+		}
+	}
+	return columns
+}
+
+// columnNames maps the Go field names of the reader's generated row type back
+// to the column names in the file
+func columnNames(infos []*common.Tag) map[string]string {
+	names := make(map[string]string, len(infos))
+	for _, info := range infos {
+		names[info.InName] = info.ExName
+	}
+	return names
+}
+
+// sampleValue converts a value read by the generic reader into maps, slices
+// and scalars for printing. Non-finite floats become strings, as in JSONL
+// output, since JSON has no literal for them. With a non-zero unit, integers
+// are timestamps in that unit and are shown in RFC 3339 with its precision.
+func sampleValue(v reflect.Value, names map[string]string, unit time.Duration) any {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return sampleValue(v.Elem(), names, unit)
+	case reflect.Struct:
+		fields := make(map[string]any, v.NumField())
+		for i := 0; i < v.NumField(); i++ {
+			name := v.Type().Field(i).Name
+			if ex, ok := names[name]; ok {
+				name = ex
+			}
+			fields[name] = sampleValue(v.Field(i), names, unit)
+		}
+		return fields
+	case reflect.Slice:
+		items := make([]any, v.Len())
+		for i := range items {
+			items[i] = sampleValue(v.Index(i), names, unit)
+		}
+		return items
+	case reflect.Int64:
+		if unit > 0 {
+			return time.Unix(0, v.Int()*int64(unit)).UTC().Format(timestampFormat(unit))
+		}
+		return v.Interface()
+	case reflect.Float32, reflect.Float64:
+		if f := v.Float(); math.IsNaN(f) || math.IsInf(f, 0) {
+			return formatValue(f)
+		}
+		return v.Interface()
+	default:
+		return v.Interface()
+	}
+}
+
+// timestampFormat is RFC 3339 with the fractional digits of unit
+func timestampFormat(unit time.Duration) string {
+	switch unit {
+	case time.Microsecond:
+		return "2006-01-02T15:04:05.000000Z07:00"
+	case time.Nanosecond:
+		return "2006-01-02T15:04:05.000000000Z07:00"
+	default:
+		return textTimeFormat
+	}
+}
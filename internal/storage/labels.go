@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+// labelFilter decides which labels are stored with a sample, following
+// storage.includeLabels and storage.excludeLabels
+type labelFilter struct {
+	// include is nil when every label not excluded is kept
+	include map[string]bool
+	exclude map[string]bool
+}
+
+func newLabelFilter(cfg config.StorageConfig) labelFilter {
+	f := labelFilter{exclude: make(map[string]bool, len(cfg.ExcludeLabels))}
+	for _, label := range cfg.ExcludeLabels {
+		f.exclude[label] = true
+	}
+	if len(cfg.IncludeLabels) > 0 {
+		f.include = make(map[string]bool, len(cfg.IncludeLabels))
+		for _, label := range cfg.IncludeLabels {
+			f.include[label] = true
+		}
+	}
+	return f
+}
+
+// keep reports whether the label is stored; exclusion wins over inclusion
+func (f labelFilter) keep(label string) bool {
+	if f.exclude[label] {
+		return false
+	}
+	return f.include == nil || f.include[label]
+}
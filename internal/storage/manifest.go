@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+// ManifestName is the file written into every day= directory with
+// storage.writeManifest
+const ManifestName = "manifest.json"
+
+// ManifestVersion is the version of the manifest schema. Fields are only ever
+// added within a version; a change that breaks readers increments it.
+const ManifestVersion = 1
+
+// Manifest lists the output files below a day= directory, so a catalog can be
+// built without opening every file
+type Manifest struct {
+	// Version is the ManifestVersion the manifest was written with
+	Version int `json:"version"`
+
+	// UpdatedAt is when the manifest was last written
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// Files are sorted by path
+	Files []ManifestFile `json:"files"`
+}
+
+// ManifestFile describes one output file of a manifest
+type ManifestFile struct {
+	// Path is relative to the manifest's directory, e.g. "app=x/metrics.parquet"
+	Path string `json:"path"`
+
+	Rows  int   `json:"rows"`
+	Bytes int64 `json:"bytes"`
+
+	// MinTimestamp and MaxTimestamp bound the sample timestamps in the file
+	MinTimestamp time.Time `json:"min_timestamp"`
+	MaxTimestamp time.Time `json:"max_timestamp"`
+}
+
+// manifests collects the files written and removed since the manifests were
+// last written, keyed by manifest directory and then by relative path. A nil
+// entry marks a removed file.
+type manifests struct {
+	mu      sync.Mutex
+	pending map[string]map[string]*ManifestFile
+}
+
+// newManifests returns the collector for storage.writeManifest, or nil when
+// manifests are disabled
+func newManifests(cfg config.StorageConfig) *manifests {
+	if !cfg.WriteManifest {
+		return nil
+	}
+	return &manifests{pending: make(map[string]map[string]*ManifestFile)}
+}
+
+// record notes a completed file, or its removal when stats is nil
+func (m *manifests) record(filename string, stats *fileStats) {
+	if m == nil {
+		return
+	}
+	dir := manifestDir(filename)
+	path := strings.TrimPrefix(filename, dir+"/")
+	var entry *ManifestFile
+	if stats != nil {
+		entry = &ManifestFile{
+			Path:         path,
+			Rows:         stats.Rows,
+			Bytes:        stats.Bytes,
+			MinTimestamp: stats.MinTimestamp,
+			MaxTimestamp: stats.MaxTimestamp,
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.add(dir, path, entry)
+}
+
+// add sets one pending entry; the caller holds mu
+func (m *manifests) add(dir, path string, entry *ManifestFile) {
+	if m.pending[dir] == nil {
+		m.pending[dir] = make(map[string]*ManifestFile)
+	}
+	m.pending[dir][path] = entry
+}
+
+// take returns the pending entries and starts collecting anew
+func (m *manifests) take() map[string]map[string]*ManifestFile {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pending := m.pending
+	m.pending = make(map[string]map[string]*ManifestFile)
+	return pending
+}
+
+// restore puts back the entries of a manifest that failed to be written, so
+// the next attempt includes them. Entries recorded since take are newer and
+// win.
+func (m *manifests) restore(dir string, entries map[string]*ManifestFile) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for path, entry := range entries {
+		if _, ok := m.pending[dir][path]; !ok {
+			m.add(dir, path, entry)
+		}
+	}
+}
+
+// manifestDir returns the day= directory holding filename, or the file's own
+// directory when its path has no day= segment
+func manifestDir(filename string) string {
+	dir := PartitionDir(filename)
+	segments := strings.Split(dir, "/")
+	for i := len(segments) - 1; i >= 0; i-- {
+		if strings.HasPrefix(segments[i], "day=") {
+			return strings.Join(segments[:i+1], "/")
+		}
+	}
+	return dir
+}
+
+// WriteManifests merges the files written and removed since the last call
+// into the manifest.json of their day= directories. Each manifest is replaced
+// atomically: a reader sees either the previous or the updated version.
+func (s *ParquetStorage) WriteManifests(ctx context.Context) error {
+	if s.manifests == nil {
+		return nil
+	}
+	pending := s.manifests.take()
+	dirs := make([]string, 0, len(pending))
+	for dir := range pending {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	var errs []error
+	for _, dir := range dirs {
+		if err := s.updateManifest(ctx, dir, pending[dir]); err != nil {
+			slog.Error("Failed to update manifest", "dir", dir, "error", err)
+			errs = append(errs, fmt.Errorf("manifest: %w", err))
+			s.manifests.restore(dir, pending[dir])
+		}
+	}
+	slog.Debug("Updated manifests", "manifests", len(dirs), "failed", len(errs))
+	return errors.Join(errs...)
+}
+
+// updateManifest applies entries to the manifest in dir, creating it if needed
+func (s *ParquetStorage) updateManifest(ctx context.Context, dir string, entries map[string]*ManifestFile) error {
+	filename := dir + "/" + ManifestName
+	manifest, err := s.readManifest(ctx, filename)
+	if err != nil {
+		return err
+	}
+
+	files := make(map[string]ManifestFile, len(manifest.Files)+len(entries))
+	for _, f := range manifest.Files {
+		files[f.Path] = f
+	}
+	for path, entry := range entries {
+		if entry == nil {
+			delete(files, path)
+		} else {
+			files[path] = *entry
+		}
+	}
+
+	manifest = Manifest{Version: ManifestVersion, UpdatedAt: time.Now().UTC(), Files: make([]ManifestFile, 0, len(files))}
+	for _, f := range files {
+		manifest.Files = append(manifest.Files, f)
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Path < manifest.Files[j].Path })
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", filename, err)
+	}
+
+	if isS3Path(filename) {
+		// An S3 object only becomes visible once its upload completes
+		if err := s.putFile(ctx, filename, data); err != nil {
+			return fmt.Errorf("failed to write %s: %w", filename, err)
+		}
+		return nil
+	}
+	tmp := filename + tmpSuffix
+	if err := writeLocalFile(tmp, data, filePerm(s.config)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %w", filename, err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to move %s into place: %w", filename, err)
+	}
+	return nil
+}
+
+// readManifest reads an existing manifest; a missing one is empty
+func (s *ParquetStorage) readManifest(ctx context.Context, filename string) (Manifest, error) {
+	var manifest Manifest
+	data, err := s.readSmallFile(ctx, filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return manifest, nil
+	}
+	if err != nil {
+		return manifest, err
+	}
+
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("failed to parse %s: %w", filename, err)
+	}
+	if manifest.Version > ManifestVersion {
+		return manifest, fmt.Errorf("%s has version %d, newer than the supported version %d", filename, manifest.Version, ManifestVersion)
+	}
+	return manifest, nil
+}
+
+// readSmallFile reads a file written by putFile on local disk or in S3. A
+// missing file returns an error matching os.ErrNotExist.
+func (s *ParquetStorage) readSmallFile(ctx context.Context, filename string) ([]byte, error) {
+	if !isS3Path(filename) {
+		return os.ReadFile(filename)
+	}
+
+	bucket, key, err := parseS3Path(filename)
+	if err != nil {
+		return nil, err
+	}
+	out, err := s.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil, fmt.Errorf("%s: %w", filename, os.ErrNotExist)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", filename, err)
+	}
+	defer out.Body.Close()
+
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", filename, err)
+	}
+	return data, nil
+}
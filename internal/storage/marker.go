@@ -0,0 +1,25 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// MarkPartition writes an empty storage.successMarker file into dir, on local
+// disk or in S3, or removes it when the partition is incomplete
+func (s *ParquetStorage) MarkPartition(ctx context.Context, dir string, complete bool) error {
+	if s.config.SuccessMarker == "" {
+		return nil
+	}
+
+	filename := strings.TrimSuffix(dir, "/") + "/" + s.config.SuccessMarker
+	if complete {
+		if err := s.putFile(ctx, filename, nil); err != nil {
+			return fmt.Errorf("failed to write %s: %w", filename, err)
+		}
+		return nil
+	}
+
+	return s.deleteFile(ctx, filename)
+}
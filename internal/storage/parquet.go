@@ -1,15 +1,28 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/kiquetal/go-duckdb-ingester/internal/prometheus"
 	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
 	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go-source/s3v2"
 	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/source"
 	"github.com/xitongsys/parquet-go/writer"
 )
 
@@ -18,98 +31,527 @@ type Label struct {
 	Value string `parquet:"name=value, type=BYTE_ARRAY, convertedtype=UTF8"`
 }
 
+// MetricRecord is a row of the Parquet files. SchemaVersion is the
+// SchemaVersion the row was written with. CollectedAt is when the sample's
+// query ran, NULL unless prometheus.recordCollectedAt is set. InvocationID is
+// the UUID of the ingester invocation that collected the row. OriginalName
+// holds the series' __name__ label and is NULL when the result has none, e.g.
+// after rate().
 type MetricRecord struct {
-	Timestamp  int64   `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
-	MetricName string  `parquet:"name=metric_name, type=BYTE_ARRAY, convertedtype=UTF8"`
-	Value      float64 `parquet:"name=value, type=DOUBLE"`
-	ApiProxy   string  `parquet:"name=api_proxy, type=BYTE_ARRAY, convertedtype=UTF8"`
-	Labels     []Label `parquet:"name=labels, type=LIST, convertedtype=LIST"`
-	Date       string  `parquet:"name=date, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Timestamp     int64   `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	MetricName    string  `parquet:"name=metric_name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Value         float64 `parquet:"name=value, type=DOUBLE"`
+	ApiProxy      string  `parquet:"name=api_proxy, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Source        string  `parquet:"name=source, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Labels        []Label `parquet:"name=labels, type=LIST, convertedtype=LIST"`
+	Date          string  `parquet:"name=date, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SchemaVersion int32   `parquet:"name=schema_version, type=INT32"`
+	CollectedAt   *int64  `parquet:"name=collected_at, type=INT64, convertedtype=TIMESTAMP_MILLIS, repetitiontype=OPTIONAL"`
+	InvocationID  string  `parquet:"name=invocation_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	OriginalName  *string `parquet:"name=original_name, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
 }
 
 type ParquetStorage struct {
 	config config.StorageConfig
+	schema recordSchema
+
+	// s3Client is set when OutputDir is an s3:// location
+	s3Client *s3.Client
+
+	// manifests collects the files for the day= manifests; nil unless
+	// storage.writeManifest is set
+	manifests *manifests
+
+	// pool bounds the files open for writing; nil when
+	// storage.maxOpenFiles is unlimited
+	pool *writerPool
 }
 
 func NewParquetStorage(cfg config.StorageConfig) (*ParquetStorage, error) {
-	if err := os.MkdirAll(cfg.OutputDir, 0755); err != nil {
+	codec, err := compressionCodec(cfg.Compression)
+	if err != nil {
+		return nil, err
+	}
+	if err := setCompressionLevel(codec, cfg.CompressionLevel); err != nil {
+		return nil, err
+	}
+	schema := newRecordSchema(cfg)
+	if err := schema.checkPromoted(); err != nil {
+		return nil, err
+	}
+
+	if isS3Path(cfg.OutputDir) {
+		if _, _, err := parseS3Path(cfg.OutputDir); err != nil {
+			return nil, err
+		}
+		client, err := newS3Client(context.Background(), cfg.S3)
+		if err != nil {
+			return nil, err
+		}
+		return &ParquetStorage{config: cfg, schema: schema, s3Client: client, manifests: newManifests(cfg), pool: newWriterPool(cfg.MaxOpenFiles)}, nil
+	}
+
+	if err := mkdirAll(cfg.OutputDir, dirPerm(cfg)); err != nil {
 		return nil, fmt.Errorf("failed to create output directory: %w", err)
 	}
-	return &ParquetStorage{config: cfg}, nil
+	if err := checkWritable(cfg.OutputDir); err != nil {
+		return nil, err
+	}
+	return &ParquetStorage{config: cfg, schema: schema, manifests: newManifests(cfg), pool: newWriterPool(cfg.MaxOpenFiles)}, nil
 }
 
-func (s *ParquetStorage) StoreMetrics(metrics []prometheus.MetricResult, filename string) error {
-	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
+// checkWritable creates and removes a file in dir, so an existing but
+// read-only output directory fails at startup instead of at the first write
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".write-probe-*")
+	if err != nil {
+		return fmt.Errorf("output directory %s is not writable: %w", dir, err)
 	}
+	name := f.Name()
+	f.Close()
+	if err := os.Remove(name); err != nil {
+		return fmt.Errorf("output directory %s is not writable: %w", dir, err)
+	}
+	return nil
+}
 
-	fw, err := local.NewLocalFileWriter(filename)
+// StoreMetrics writes metrics to a Parquet file and returns the number of rows
+// written. If ctx is cancelled or any step fails, the partially written file is
+// removed so no corrupt output is left behind. No file is written when metrics is empty.
+func (s *ParquetStorage) StoreMetrics(ctx context.Context, metrics []prometheus.MetricResult, filename string) (int, error) {
+	if len(metrics) == 0 {
+		slog.Debug("Skipping write of empty Parquet file", "path", filename)
+		return 0, nil
+	}
+
+	rows, err := s.storeWithRetry(ctx, metrics, filename)
+	if err != nil && ctx.Err() == nil && s.config.FailedDir != "" {
+		err = s.spoolFailed(metrics, filename, err)
+	}
+	return rows, err
+}
+
+// storeMetricsOnce makes a single attempt at writing metrics to filename
+func (s *ParquetStorage) storeMetricsOnce(ctx context.Context, metrics []prometheus.MetricResult, filename string) (int, error) {
+	stats, err := s.writeFile(ctx, filename, func(write func(prometheus.MetricResult) error) error {
+		for _, metric := range metrics {
+			if err := write(metric); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return stats.Rows, err
+	}
+	return stats.Rows, s.finishFile(ctx, filename, stats)
+}
+
+// StoreMetricsStream writes metrics to a Parquet file as they arrive on the
+// stream and returns the number of rows written. If the stream reports an
+// error, or no rows arrive, the file is removed.
+func (s *ParquetStorage) StoreMetricsStream(ctx context.Context, metrics <-chan prometheus.MetricResult, errs <-chan error, filename string) (int, error) {
+	stats, err := s.writeFile(ctx, filename, func(write func(prometheus.MetricResult) error) error {
+		return drainStream(ctx, metrics, errs, write)
+	})
 	if err != nil {
-		return fmt.Errorf("failed to create file writer: %w", err)
+		return stats.Rows, err
+	}
+	if stats.Rows == 0 {
+		s.removeFile(filename)
+		return 0, nil
 	}
-	defer fw.Close()
+	return stats.Rows, s.finishFile(ctx, filename, stats)
+}
 
-	pw, err := writer.NewParquetWriter(fw, new(MetricRecord), 4)
+// StoreEmpty writes a file without rows to filename. A metric without samples
+// in a batch otherwise leaves no file behind, and the batch would be collected
+// again because its outputs look incomplete.
+func (s *ParquetStorage) StoreEmpty(ctx context.Context, filename string) error {
+	stats, err := s.writeFile(ctx, filename, func(func(prometheus.MetricResult) error) error {
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to create parquet writer: %w", err)
+		return err
 	}
+	return s.finishFile(ctx, filename, stats)
+}
 
-	// Configure writer
-	pw.RowGroupSize = 128 * 1024 * 1024
-	pw.PageSize = 8 * 1024
-	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+// finishFile records a completed file for its manifest and writes its
+// metadata sidecar when enabled
+func (s *ParquetStorage) finishFile(ctx context.Context, filename string, stats fileStats) error {
+	s.manifests.record(filename, &stats)
+	if !s.config.WriteSidecar {
+		return nil
+	}
+	return s.writeSidecar(ctx, filename, stats)
+}
 
-	// Batch processing
-	batchSize := 1000
-	for i := 0; i < len(metrics); i += batchSize {
-		end := i + batchSize
-		if end > len(metrics) {
-			end = len(metrics)
-		}
-
-		for _, metric := range metrics[i:end] {
-			// Extract API proxy from labels if available
-			apiProxy := ""
-			if val, ok := metric.Labels["apiproxy"]; ok {
-				apiProxy = val
-			} else if val, ok := metric.Labels["app"]; ok { // Fallback to "app" label
-				apiProxy = val
-			}
+// tmpSuffix marks a local Parquet file that is still being written
+const tmpSuffix = ".tmp"
 
-			record := MetricRecord{
-				Timestamp:  metric.Timestamp.UnixMilli(),
-				MetricName: metric.Name,
-				Value:      metric.Value,
-				ApiProxy:   apiProxy,
-				Labels:     convertLabels(metric.Labels),
-				Date:       metric.Timestamp.UTC().Format(time.DateOnly),
+// writeFile creates a Parquet file and writes every metric produced by produce
+// into it, returning the row count and time bounds of what was written.
+// Local files are written under a temporary name and renamed into place only
+// once complete, so readers never see a partial file; S3 objects become
+// visible only when their upload completes.
+func (s *ParquetStorage) writeFile(ctx context.Context, filename string, produce func(write func(prometheus.MetricResult) error) error) (stats fileStats, err error) {
+	target := filename
+	if !isS3Path(filename) {
+		target = filename + tmpSuffix
+	}
+
+	// Local files take their slot in the pool when created
+	if isS3Path(target) {
+		if err := s.pool.pin(ctx); err != nil {
+			return stats, err
+		}
+		// Deferred first, so the slot is freed only once the upload is complete
+		defer s.pool.unpin()
+	}
+
+	// Aborting the file's context stops an S3 upload blocked on the network
+	fileCtx, abort := context.WithCancel(ctx)
+	defer abort()
+	created, err := s.createFile(fileCtx, target)
+	if err != nil {
+		return stats, err
+	}
+	fw := &stoppableFile{ParquetFile: created, abort: abort}
+	defer func() {
+		// Closing flushes local files and completes S3 uploads
+		if closeErr := fw.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("failed to close %s: %w", filename, closeErr)
+		}
+		stats.Bytes = fw.written.Load()
+		if err == nil && target != filename {
+			if renameErr := os.Rename(target, filename); renameErr != nil {
+				err = fmt.Errorf("failed to move %s into place: %w", filename, renameErr)
 			}
-			if err := pw.Write(record); err != nil {
-				return fmt.Errorf("write error: %w", err)
+		}
+		if err != nil {
+			s.removeFile(target)
+		}
+	}()
+
+	w, err := s.newRowWriter(fw)
+	if err != nil {
+		return stats, err
+	}
+
+	// Check for cancellation every batchSize rows
+	batchSize := 1000
+	err = produce(func(metric prometheus.MetricResult) error {
+		if stats.Rows%batchSize == 0 {
+			if err := ctx.Err(); err != nil {
+				return fmt.Errorf("write interrupted: %w", err)
 			}
 		}
+
+		if err := w.write(metric); err != nil {
+			return fmt.Errorf("write error: %w", err)
+		}
+		stats.observe(s.schema.stored(metric.Timestamp))
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	return stats, w.finish()
+}
+
+// rowWriter encodes metrics into an open output file in the configured format
+type rowWriter interface {
+	write(metric prometheus.MetricResult) error
+
+	// finish flushes buffered rows and completes the file
+	finish() error
+}
+
+// newRowWriter returns the writer for the configured storage.format
+func (s *ParquetStorage) newRowWriter(fw *stoppableFile) (rowWriter, error) {
+	switch s.config.Format {
+	case config.FormatJSONL:
+		return newJSONLRowWriter(fw, s.schema), nil
+	case config.FormatCSV:
+		return newCSVRowWriter(fw, s.schema)
+	default:
+		w, err := s.newParquetRowWriter(fw)
+		if err != nil {
+			return nil, err
+		}
+		if s.schema.series {
+			return newSeriesRowWriter(w), nil
+		}
+		return w, nil
+	}
+}
+
+// errFileStopped is returned by writes to a stoppableFile after stop
+var errFileStopped = errors.New("file was stopped")
+
+// stoppableFile is an output file whose writes can be cut off from another
+// goroutine, so a writer that overran its deadline fails on its next write
+// instead of touching the file after it was closed
+type stoppableFile struct {
+	source.ParquetFile
+
+	// abort cancels the context the file was created with
+	abort func()
+
+	mu      sync.Mutex
+	stopped bool
+
+	// written counts the bytes written to the file
+	written atomic.Int64
+}
+
+func (f *stoppableFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stopped {
+		return 0, errFileStopped
+	}
+	n, err := f.ParquetFile.Write(p)
+	f.written.Add(int64(n))
+	return n, err
+}
+
+// stop aborts the file and fails every later write. It waits for a write in
+// progress, which the abort unblocks for S3 uploads.
+func (f *stoppableFile) stop() {
+	f.abort()
+	f.mu.Lock()
+	f.stopped = true
+	f.mu.Unlock()
+}
+
+// parquetRowWriter writes rows with parquet-go
+type parquetRowWriter struct {
+	pw          *writer.ParquetWriter
+	file        *stoppableFile
+	schema      recordSchema
+	stopTimeout time.Duration
+	// failures is the compression failure count when the writer was created
+	failures uint64
+}
+
+// newParquetRowWriter creates a Parquet writer configured from the storage settings
+func (s *ParquetStorage) newParquetRowWriter(fw *stoppableFile) (*parquetRowWriter, error) {
+	failures := compressionFailureCount()
+	pw, err := writer.NewParquetWriter(fw, s.schema.newObject(), 4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create parquet writer: %w", err)
+	}
+
+	codec, err := compressionCodec(s.config.Compression)
+	if err != nil {
+		return nil, err
 	}
 
-	// Finalization with timeout
-	done := make(chan struct{})
-	var writeStopErr error
+	// Configure writer
+	pw.RowGroupSize = s.config.RowGroupSize
+	pw.PageSize = s.config.PageSize
+	pw.CompressionType = codec
+	pw.Footer.KeyValueMetadata = s.schema.metadata()
+	s.schema.annotate(pw.SchemaHandler)
+
+	return &parquetRowWriter{pw: pw, file: fw, schema: s.schema, stopTimeout: s.config.WriteStopTimeout, failures: failures}, nil
+}
+
+func (w *parquetRowWriter) write(metric prometheus.MetricResult) error {
+	return w.pw.Write(w.schema.record(metric))
+}
+
+// finish writes the Parquet footer, bounded by storage.writeStopTimeout. On
+// timeout the file is stopped: WriteStop can no longer write to it and fails
+// on its own, so finish does not wait for it. Stopping waits for a write in
+// progress, which gets at most another writeStopTimeout before finish gives
+// up on it too, so a hung disk cannot block the caller.
+func (w *parquetRowWriter) finish() error {
+	done := make(chan error, 1)
 	go func() {
-		defer close(done)
-		writeStopErr = pw.WriteStop()
+		done <- w.pw.WriteStop()
 	}()
 
+	timer := time.NewTimer(w.stopTimeout)
+	defer timer.Stop()
+
 	select {
-	case <-done:
-		return writeStopErr
-	case <-time.After(s.config.WriteStopTimeout):
-		return fmt.Errorf("parquet finalization timed out after %s", s.config.WriteStopTimeout)
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+		return compressionFailedSince(w.failures)
+	case <-timer.C:
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		w.file.stop()
+		close(stopped)
+	}()
+	timer.Reset(w.stopTimeout)
+	select {
+	case <-stopped:
+	case <-timer.C:
+		slog.Warn("Parquet write did not return after the file was stopped", "timeout", w.stopTimeout)
+	}
+	return fmt.Errorf("parquet finalization timed out after %s", w.stopTimeout)
+}
+
+// createFile opens a Parquet destination on local disk or, for s3:// paths, in S3
+func (s *ParquetStorage) createFile(ctx context.Context, filename string) (source.ParquetFile, error) {
+	if isS3Path(filename) {
+		bucket, key, err := parseS3Path(filename)
+		if err != nil {
+			return nil, err
+		}
+		fw, err := s3v2.NewS3FileWriterWithClient(ctx, s.s3Client, bucket, key, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create S3 file writer: %w", err)
+		}
+		return fw, nil
+	}
+
+	if err := mkdirAll(filepath.Dir(filename), dirPerm(s.config)); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	if s.pool != nil {
+		return s.pool.create(ctx, filename, filePerm(s.config))
+	}
+	fw, err := local.NewLocalFileWriter(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file writer: %w", err)
 	}
+	// The writer creates files subject to the umask; the rename keeps the mode
+	if err := os.Chmod(filename, filePerm(s.config)); err != nil {
+		fw.Close()
+		return nil, fmt.Errorf("failed to set permissions of %s: %w", filename, err)
+	}
+	return fw, nil
+}
+
+// parquetMagic begins and ends every complete Parquet file
+const parquetMagic = "PAR1"
+
+// Exists reports whether filename is a complete output file. A Parquet file
+// must be larger than the header and footer magic and end with the footer
+// magic that is written last; JSONL and CSV files must not be empty.
+func (s *ParquetStorage) Exists(ctx context.Context, filename string) (bool, error) {
+	var tail []byte
+	if !isS3Path(filename) {
+		f, err := os.Open(filename)
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to open %s: %w", filename, err)
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil {
+			return false, fmt.Errorf("failed to stat %s: %w", filename, err)
+		}
+		if s.config.Format != "" && s.config.Format != config.FormatParquet {
+			return info.Size() > 0, nil
+		}
+		if info.Size() <= 2*int64(len(parquetMagic)) {
+			return false, nil
+		}
+
+		tail = make([]byte, len(parquetMagic))
+		if _, err := f.ReadAt(tail, info.Size()-int64(len(tail))); err != nil {
+			return false, fmt.Errorf("failed to read %s: %w", filename, err)
+		}
+		return string(tail) == parquetMagic, nil
+	}
+
+	bucket, key, err := parseS3Path(filename)
+	if err != nil {
+		return false, err
+	}
+	head, err := s.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check %s: %w", filename, err)
+	}
+	if s.config.Format != "" && s.config.Format != config.FormatParquet {
+		return aws.ToInt64(head.ContentLength) > 0, nil
+	}
+	if aws.ToInt64(head.ContentLength) <= 2*int64(len(parquetMagic)) {
+		return false, nil
+	}
+
+	out, err := s.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=-%d", len(parquetMagic))),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", filename, err)
+	}
+	defer out.Body.Close()
+
+	tail, err = io.ReadAll(out.Body)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", filename, err)
+	}
+	return string(tail) == parquetMagic, nil
 }
 
+// removeFile deletes a partially written output so readers never see it
+func (s *ParquetStorage) removeFile(filename string) {
+	if !isS3Path(filename) {
+		os.Remove(filename)
+		return
+	}
+
+	bucket, key, err := parseS3Path(filename)
+	if err != nil {
+		return
+	}
+	// Use a fresh context since the write context may already be cancelled
+	s.s3Client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+}
+
+// convertLabels returns labels as a list sorted by key, so identical data is
+// always written as identical files
 func convertLabels(labels map[string]string) []Label {
 	result := make([]Label, 0, len(labels))
 	for k, v := range labels {
 		result = append(result, Label{Key: k, Value: v})
 	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
 	return result
 }
+
+// compressionCodec maps a configured compression name to its Parquet codec.
+// An empty name selects snappy, matching the config default.
+func compressionCodec(name string) (parquet.CompressionCodec, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "snappy":
+		return parquet.CompressionCodec_SNAPPY, nil
+	case "gzip":
+		return parquet.CompressionCodec_GZIP, nil
+	case "zstd":
+		return parquet.CompressionCodec_ZSTD, nil
+	case "lz4":
+		return parquet.CompressionCodec_LZ4, nil
+	case "uncompressed", "none":
+		return parquet.CompressionCodec_UNCOMPRESSED, nil
+	default:
+		return parquet.CompressionCodec_UNCOMPRESSED, fmt.Errorf("unsupported compression codec %q (supported: snappy, gzip, zstd, lz4, uncompressed)", name)
+	}
+}
@@ -0,0 +1,290 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/go-duckdb-ingester/internal/prometheus"
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+// testStorageConfig loads a configuration writing to a temporary directory,
+// with storage holding extra settings of the storage block as YAML flow
+// mapping entries, e.g. "compression: gzip"
+func testStorageConfig(t testing.TB, storage string) config.StorageConfig {
+	t.Helper()
+	dir := t.TempDir()
+	content := fmt.Sprintf(`
+apiProxies: [orders]
+prometheus:
+  url: http://prometheus:9090
+  metrics:
+    - name: requests
+      query: 'sum(rate(requests_total{app="{{.APIProxy}}"}[5m]))'
+storage: {outputDir: %q, %s}
+`, filepath.Join(dir, "data"), storage)
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg.Storage
+}
+
+// testMetrics returns n samples of one series, a minute apart
+func testMetrics(n int) []prometheus.MetricResult {
+	start := time.Date(2025, 4, 7, 0, 0, 0, 0, time.UTC)
+	metrics := make([]prometheus.MetricResult, n)
+	for i := range metrics {
+		metrics[i] = prometheus.MetricResult{
+			Name:      "requests",
+			Timestamp: start.Add(time.Duration(i) * time.Minute),
+			Value:     float64(i % 10),
+			Labels:    map[string]string{"__name__": "requests_total", "app": "orders", "instance": "10.0.0.1:8080"},
+			APIProxy:  "orders",
+		}
+	}
+	return metrics
+}
+
+// writeTestFile stores metrics with cfg and returns the file written
+func writeTestFile(t testing.TB, cfg config.StorageConfig, metrics []prometheus.MetricResult) string {
+	t.Helper()
+	store, err := NewParquetStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(cfg.OutputDir, "metrics.parquet")
+	rows, err := store.StoreMetrics(context.Background(), metrics, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != len(metrics) {
+		t.Fatalf("StoreMetrics wrote %d rows, want %d", rows, len(metrics))
+	}
+	return filename
+}
+
+// fileSize returns the size of filename
+func fileSize(t testing.TB, filename string) int64 {
+	t.Helper()
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestStoreMetricsRowGroupSize(t *testing.T) {
+	metrics := testMetrics(5000)
+
+	info, err := InspectParquetFile(writeTestFile(t, testStorageConfig(t, ""), metrics), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.RowGroups != 1 {
+		t.Errorf("default row group size: got %d row groups, want 1", info.RowGroups)
+	}
+
+	info, err = InspectParquetFile(writeTestFile(t, testStorageConfig(t, "rowGroupSize: 16384, pageSize: 1024"), metrics), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.RowGroups < 2 {
+		t.Errorf("16KB row groups: got %d row groups, want several", info.RowGroups)
+	}
+	if info.Rows != int64(len(metrics)) {
+		t.Errorf("got %d rows, want %d", info.Rows, len(metrics))
+	}
+}
+
+func TestStoreEmpty(t *testing.T) {
+	cfg := testStorageConfig(t, "")
+	store, err := NewParquetStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(cfg.OutputDir, "metric=requests", "metrics.parquet")
+	if err := store.StoreEmpty(context.Background(), filename); err != nil {
+		t.Fatal(err)
+	}
+
+	exists, err := store.Exists(context.Background(), filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Error("Exists = false for a file without rows")
+	}
+	info, err := InspectParquetFile(filename, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Rows != 0 {
+		t.Errorf("Rows = %d, want 0", info.Rows)
+	}
+}
+
+func TestDateColumnTimezone(t *testing.T) {
+	rs := newRecordSchema(testStorageConfig(t, "timezone: Europe/Berlin"))
+	tests := []struct {
+		ts   time.Time
+		want string
+	}{
+		// Berlin is UTC+2 in April
+		{time.Date(2025, 4, 6, 21, 59, 59, 0, time.UTC), "2025-04-06"},
+		{time.Date(2025, 4, 6, 22, 0, 0, 0, time.UTC), "2025-04-07"},
+		{time.Date(2025, 4, 6, 23, 30, 0, 0, time.UTC), "2025-04-07"},
+	}
+	for _, tt := range tests {
+		if got := rs.metricRecord(prometheus.MetricResult{Timestamp: tt.ts}).Date; got != tt.want {
+			t.Errorf("date of %s = %s, want %s", tt.ts.Format(time.RFC3339), got, tt.want)
+		}
+	}
+}
+
+func TestOriginalNameColumn(t *testing.T) {
+	metrics := testMetrics(2)
+	delete(metrics[1].Labels, "__name__")
+	info, err := InspectParquetFile(writeTestFile(t, testStorageConfig(t, ""), metrics), len(metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Added columns are appended, so existing columns keep their positions
+	if last := info.Columns[len(info.Columns)-1].Path; last != "original_name" {
+		t.Errorf("last column = %s, want original_name", last)
+	}
+	for i, want := range []any{"requests_total", nil} {
+		row := info.Sample[i]
+		if got := row[len(row)-1]; got.Name != "original_name" || got.Value != want {
+			t.Errorf("row %d original_name = %v (%s), want %v", i, got.Value, got.Name, want)
+		}
+	}
+}
+
+// TestConvertLabelsOrder checks that the labels list is sorted by key on every
+// invocation, whatever order the map is iterated in
+func TestConvertLabelsOrder(t *testing.T) {
+	labels := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		labels[fmt.Sprintf("label_%02d", i)] = fmt.Sprint(i)
+	}
+
+	want := convertLabels(labels)
+	for i := range want {
+		if key := fmt.Sprintf("label_%02d", i); want[i].Key != key || want[i].Value != fmt.Sprint(i) {
+			t.Fatalf("label %d = %s=%s, want %s=%d", i, want[i].Key, want[i].Value, key, i)
+		}
+	}
+	for n := 0; n < 100; n++ {
+		got := convertLabels(labels)
+		if !slices.Equal(got, want) {
+			t.Fatalf("invocation %d returned %v, want %v", n, got, want)
+		}
+	}
+}
+
+// TestSeriesLayoutAPIProxies checks that unlabelled results of different API
+// proxies in one combined file are written as separate series
+func TestSeriesLayoutAPIProxies(t *testing.T) {
+	metrics := testMetrics(2)
+	for i, proxy := range []string{"orders", "billing"} {
+		metrics[i].Timestamp = metrics[0].Timestamp
+		metrics[i].Labels = map[string]string{}
+		metrics[i].APIProxy = proxy
+	}
+
+	info, err := InspectParquetFile(writeTestFile(t, testStorageConfig(t, "layout: series"), metrics), len(metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Rows != 2 {
+		t.Fatalf("got %d series rows, want one per API proxy", info.Rows)
+	}
+	for i, row := range info.Sample {
+		for _, column := range row {
+			if column.Name == "api_proxy" && column.Value != metrics[i].APIProxy {
+				t.Errorf("row %d api_proxy = %v, want %s", i, column.Value, metrics[i].APIProxy)
+			}
+		}
+	}
+}
+
+// TestCompactAPIProxies compacts a combined partition holding two unlabelled
+// API proxies, written twice. Only the repeated rows may be dropped; samples
+// of different proxies at one timestamp are distinct series.
+func TestCompactAPIProxies(t *testing.T) {
+	var metrics []prometheus.MetricResult
+	for _, proxy := range []string{"orders", "billing"} {
+		for _, m := range testMetrics(3) {
+			m.Labels = map[string]string{}
+			m.APIProxy = proxy
+			metrics = append(metrics, m)
+		}
+	}
+	cfg := testStorageConfig(t, "")
+	store, err := NewParquetStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, name := range []string{"batch-1.parquet", "batch-2.parquet"} {
+		if _, err := store.StoreMetrics(ctx, metrics, filepath.Join(cfg.OutputDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := store.Compact(ctx, cfg.OutputDir, "compacted.parquet", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Rows != len(metrics) || len(res.Deleted) != 2 {
+		t.Fatalf("compacted %d rows and deleted %v, want %d rows and both inputs", res.Rows, res.Deleted, len(metrics))
+	}
+	read, err := store.readParquetFile(ctx, res.Output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := map[string]int{}
+	for _, m := range read {
+		rows[m.APIProxy]++
+	}
+	if rows["orders"] != 3 || rows["billing"] != 3 {
+		t.Errorf("compacted rows per API proxy = %v, want 3 each", rows)
+	}
+}
+
+func TestNewParquetStorageRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		storage string
+		want    string
+	}{
+		{"promoted timestamp", "promoteLabels: [timestamp]", `storage.promoteLabels: "timestamp" conflicts with a built-in column`},
+		{"promoted invocation_id", "promoteLabels: [invocation_id]", `storage.promoteLabels: "invocation_id" conflicts with a built-in column`},
+		{"promoted value of the series layout", "layout: series, promoteLabels: [value]", `storage.promoteLabels: "value" conflicts with a built-in column`},
+		{"promoted series samples", "layout: series, promoteLabels: [values]", `storage.promoteLabels: "values" conflicts with a built-in column`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewParquetStorage(testStorageConfig(t, tt.storage))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("NewParquetStorage error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+	// Outside the series layout, values is an ordinary label
+	if _, err := NewParquetStorage(testStorageConfig(t, "promoteLabels: [values]")); err != nil {
+		t.Fatal(err)
+	}
+}
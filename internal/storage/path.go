@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// PathData holds the values available to the storage path template
+type PathData struct {
+	// Year, Month and Day are the zero-padded partition date
+	Year  string
+	Month string
+	Day   string
+
+	// App is the API proxy name, empty when proxies are combined into one file
+	App string
+
+	// Source is the Prometheus source name, empty unless sources are configured
+	Source string
+
+	// MetricName is set when files are split per metric
+	MetricName string
+
+	// BatchStart and BatchEnd bound a range batch; both are zero for instant collections
+	BatchStart time.Time
+	BatchEnd   time.Time
+
+	// RunID identifies the collection cycle (UTC start time, e.g. 20250407T000000Z)
+	RunID string
+}
+
+// PathTemplate renders output file paths below the storage output directory
+type PathTemplate struct {
+	outputDir string
+	tmpl      *template.Template
+
+	// perMetric is set when the template references .MetricName
+	perMetric bool
+
+	// separate holds the metrics written to their own metric=<name> directory
+	// below the shared file
+	separate map[string]bool
+}
+
+// NewPathTemplate parses a storage path template. The rendered path is
+// relative to outputDir and must stay inside it. Metrics listed in separate
+// are written to their own file instead of the shared one.
+func NewPathTemplate(outputDir, text string, separate []string) (*PathTemplate, error) {
+	tmpl, err := template.New("path").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse storage.pathTemplate: %w", err)
+	}
+	p := &PathTemplate{outputDir: strings.TrimSuffix(outputDir, "/"), tmpl: tmpl, separate: make(map[string]bool, len(separate))}
+	for _, name := range separate {
+		p.separate[name] = true
+	}
+
+	// Render sample data up front so template errors surface at startup, and
+	// detect whether files are split per metric
+	sample := PathData{
+		Year: "2006", Month: "01", Day: "02", App: "app", Source: "source", RunID: "20060102T150405Z",
+		BatchStart: time.Date(2006, 1, 2, 0, 0, 0, 0, time.UTC),
+		BatchEnd:   time.Date(2006, 1, 2, 6, 0, 0, 0, time.UTC),
+	}
+	sample.MetricName = "metric_a"
+	first, err := p.Render(sample)
+	if err != nil {
+		return nil, err
+	}
+	sample.MetricName = "metric_b"
+	second, err := p.Render(sample)
+	if err != nil {
+		return nil, err
+	}
+	p.perMetric = first != second
+
+	return p, nil
+}
+
+// PerMetric reports whether the template writes a separate file per metric
+func (p *PathTemplate) PerMetric() bool {
+	return p.perMetric
+}
+
+// Split reports whether a collection may be written to more than one file,
+// because of the template or because some metrics are written separately
+func (p *PathTemplate) Split() bool {
+	return p.perMetric || len(p.separate) > 0
+}
+
+// RenderMetric returns the full output path for the samples of one metric.
+// A metric configured with separateFile goes to a metric=<name> directory
+// next to the shared file, e.g. .../app=x/metric=name/metrics.parquet.
+func (p *PathTemplate) RenderMetric(data PathData, metric string) (string, error) {
+	if p.perMetric {
+		data.MetricName = metric
+		return p.Render(data)
+	}
+
+	shared, err := p.Render(data)
+	if err != nil || !p.separate[metric] {
+		return shared, err
+	}
+	dir, file := path.Split(shared)
+	return dir + "metric=" + pathSegment(metric) + "/" + file, nil
+}
+
+// pathSegmentEscaper escapes characters that would split a value into several
+// path segments
+var pathSegmentEscaper = strings.NewReplacer("/", "%2F", "\\", "%5C")
+
+// pathSegment makes value safe to use as (part of) a single path segment
+func pathSegment(value string) string {
+	if value == "." || value == ".." {
+		return strings.ReplaceAll(value, ".", "%2E")
+	}
+	return pathSegmentEscaper.Replace(value)
+}
+
+// Render returns the full output path for data. Name fields are escaped so
+// they cannot introduce extra directories or leave the output directory.
+func (p *PathTemplate) Render(data PathData) (string, error) {
+	data.App = pathSegment(data.App)
+	data.Source = pathSegment(data.Source)
+	data.MetricName = pathSegment(data.MetricName)
+
+	var buf bytes.Buffer
+	if err := p.tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render storage.pathTemplate: %w", err)
+	}
+
+	rel := path.Clean(strings.TrimSpace(buf.String()))
+	if rel == "." || strings.HasPrefix(rel, "/") || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("storage.pathTemplate rendered %q, which is not a file path inside the output directory", buf.String())
+	}
+	return p.outputDir + "/" + rel, nil
+}
+
+// PartitionDir returns the directory of an output path. Paths may be s3://
+// locations, which path.Dir would mangle.
+func PartitionDir(filename string) string {
+	if i := strings.LastIndexByte(filename, '/'); i >= 0 {
+		return filename[:i]
+	}
+	return "."
+}
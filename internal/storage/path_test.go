@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+func TestPathTemplateEscapesNames(t *testing.T) {
+	tmpl, err := NewPathTemplate("/data", config.DefaultPathTemplate, []string{"a/b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := PathData{Year: "2025", Month: "04", Day: "07"}
+
+	tests := []struct {
+		name string
+		app  string
+		want string
+	}{
+		{"slash", "orders/v1", "/data/year=2025/month=04/day=07/app=orders%2Fv1/"},
+		{"backslash", `orders\v1`, "/data/year=2025/month=04/day=07/app=orders%5Cv1/"},
+		{"parent directory", "..", "/data/year=2025/month=04/day=07/app=%2E%2E/"},
+		{"space", "orders v1", "/data/year=2025/month=04/day=07/app=orders v1/"},
+		{"unicode", "заказы", "/data/year=2025/month=04/day=07/app=заказы/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data.App = tt.app
+			got, err := tmpl.Render(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(got, tt.want) {
+				t.Errorf("Render = %q, want prefix %q", got, tt.want)
+			}
+		})
+	}
+
+	data.App = "orders"
+	got, err := tmpl.RenderMetric(data, "a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/data/year=2025/month=04/day=07/app=orders/metric=a%2Fb/"; !strings.HasPrefix(got, want) {
+		t.Errorf("RenderMetric = %q, want prefix %q", got, want)
+	}
+}
+
+func TestPartitionDir(t *testing.T) {
+	for filename, want := range map[string]string{
+		"/data/day=07/metrics.parquet":            "/data/day=07",
+		"s3://bucket/data/day=07/metrics.parquet": "s3://bucket/data/day=07",
+		"metrics.parquet":                         ".",
+	} {
+		if got := PartitionDir(filename); got != want {
+			t.Errorf("PartitionDir(%q) = %q, want %q", filename, got, want)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+// dirPerm returns storage.dirMode, or the default when the configuration was
+// not loaded by LoadConfig
+func dirPerm(cfg config.StorageConfig) os.FileMode {
+	if cfg.DirPerm == 0 {
+		return 0755
+	}
+	return cfg.DirPerm
+}
+
+// filePerm returns storage.fileMode, or the default when the configuration
+// was not loaded by LoadConfig
+func filePerm(cfg config.StorageConfig) os.FileMode {
+	if cfg.FilePerm == 0 {
+		return 0644
+	}
+	return cfg.FilePerm
+}
+
+// mkdirAll is os.MkdirAll giving every directory it creates exactly perm,
+// whatever the process umask. Existing directories are left as they are.
+func mkdirAll(dir string, perm os.FileMode) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if parent := filepath.Dir(dir); parent != dir {
+		if err := mkdirAll(parent, perm); err != nil {
+			return err
+		}
+	}
+
+	err := os.Mkdir(dir, perm)
+	if errors.Is(err, os.ErrExist) {
+		// Created concurrently, e.g. by another API proxy's write
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chmod(dir, perm)
+}
+
+// writeLocalFile is os.WriteFile giving the file exactly perm, whatever the
+// process umask
+func writeLocalFile(filename string, data []byte, perm os.FileMode) error {
+	if err := os.WriteFile(filename, data, perm); err != nil {
+		return err
+	}
+	return os.Chmod(filename, perm)
+}
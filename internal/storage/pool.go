@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/xitongsys/parquet-go/source"
+)
+
+// writerPool keeps at most storage.maxOpenFiles output files open, keyed by
+// path. A local file only needs its descriptor while it is written to: when
+// another file needs one and the pool is full, the least recently used idle
+// file is closed, and reopened for appending on its next write.
+// Parquet, JSONL and CSV writers only ever append, so they do not notice. S3
+// uploads cannot be reopened and hold their slot until they finish. Writes
+// wait while every slot is held by a file in the middle of a write or by an
+// upload.
+type writerPool struct {
+	limit int
+
+	mu sync.Mutex
+	// lru holds the local files with an open descriptor, least recently
+	// used first; files maps their paths to their elements
+	lru   *list.List
+	files map[string]*list.Element
+	// pinned counts the S3 uploads holding a slot
+	pinned int
+	// waiting counts the writes waiting for a slot, and freed is closed when
+	// one may have become available
+	waiting int
+	freed   chan struct{}
+}
+
+// newWriterPool returns the pool for storage.maxOpenFiles, nil when unlimited
+func newWriterPool(limit int) *writerPool {
+	if limit <= 0 {
+		return nil
+	}
+	return &writerPool{limit: limit, lru: list.New(), files: make(map[string]*list.Element), freed: make(chan struct{})}
+}
+
+// create creates the local file filename with perm. Its descriptor is
+// managed by the pool from then on.
+func (p *writerPool) create(ctx context.Context, filename string, perm os.FileMode) (*pooledFile, error) {
+	f := &pooledFile{pool: p, ctx: ctx, name: filename}
+	// Locked so the file cannot be evicted before it is opened
+	f.mu.Lock()
+	if err := p.acquire(ctx, f); err != nil {
+		f.mu.Unlock()
+		return nil, err
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		p.release(f)
+		f.mu.Unlock()
+		return nil, fmt.Errorf("failed to create file writer: %w", err)
+	}
+	f.file = file
+	f.mu.Unlock()
+	// The file was created subject to the umask; the rename keeps the mode
+	if err := os.Chmod(filename, perm); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to set permissions of %s: %w", filename, err)
+	}
+	return f, nil
+}
+
+// acquire blocks until f may open its descriptor, evicting the least
+// recently used idle file when the pool is full, or until ctx is done
+func (p *writerPool) acquire(ctx context.Context, f *pooledFile) error {
+	return p.wait(ctx, func() {
+		p.files[f.name] = p.lru.PushBack(f)
+	})
+}
+
+// pin blocks until an S3 upload may start, or until ctx is done
+func (p *writerPool) pin(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	return p.wait(ctx, func() { p.pinned++ })
+}
+
+// unpin frees the slot of an upload started by pin
+func (p *writerPool) unpin() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pinned--
+	p.signal()
+}
+
+// wait calls take under the lock once a slot is free
+func (p *writerPool) wait(ctx context.Context, take func()) error {
+	p.mu.Lock()
+	for p.lru.Len()+p.pinned >= p.limit && !p.evict() {
+		p.waiting++
+		freed := p.freed
+		p.mu.Unlock()
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			p.mu.Lock()
+			p.waiting--
+			p.mu.Unlock()
+			return fmt.Errorf("waiting for an open file slot: %w", ctx.Err())
+		}
+		p.mu.Lock()
+		p.waiting--
+	}
+	take()
+	p.mu.Unlock()
+	return nil
+}
+
+// evict closes the descriptor of the least recently used file that is not
+// being written to. It reports false when every open file is busy. The
+// caller holds p.mu.
+func (p *writerPool) evict() bool {
+	for e := p.lru.Front(); e != nil; e = e.Next() {
+		f := e.Value.(*pooledFile)
+		// A busy file locks itself before the pool, so only try its lock
+		if !f.mu.TryLock() {
+			continue
+		}
+		err := f.file.Close()
+		f.file = nil
+		f.closeErr = err
+		p.lru.Remove(e)
+		delete(p.files, f.name)
+		f.mu.Unlock()
+		slog.Debug("Closed least recently used output file", "path", f.name, "max_open_files", p.limit)
+		return true
+	}
+	return false
+}
+
+// touch marks f as the most recently used file and wakes writes waiting for
+// an idle file to evict
+func (p *writerPool) touch(f *pooledFile) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.files[f.name]; ok {
+		p.lru.MoveToBack(e)
+	}
+	p.signal()
+}
+
+// release frees the slot of f
+func (p *writerPool) release(f *pooledFile) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.files[f.name]; ok {
+		p.lru.Remove(e)
+		delete(p.files, f.name)
+	}
+	p.signal()
+}
+
+// signal wakes the writes waiting for a slot. The caller holds p.mu.
+func (p *writerPool) signal() {
+	if p.waiting > 0 {
+		close(p.freed)
+		p.freed = make(chan struct{})
+	}
+}
+
+// errFileClosed is returned by writes to a pooledFile after Close
+var errFileClosed = errors.New("file is closed")
+
+// pooledFile is a local output file whose descriptor its pool closes while it
+// is idle. It supports writing only.
+type pooledFile struct {
+	pool *writerPool
+	// ctx bounds the wait for a slot when the file is reopened
+	ctx  context.Context
+	name string
+
+	// mu is held while the file is written to, so it cannot be evicted
+	mu sync.Mutex
+	// file is nil while the file is evicted
+	file *os.File
+	// closeErr is the error of the last eviction, reported by the next
+	// write or Close since the bytes written before may be lost
+	closeErr error
+	closed   bool
+}
+
+func (f *pooledFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, errFileClosed
+	}
+	if f.closeErr != nil {
+		return 0, fmt.Errorf("failed to close %s when evicting it: %w", f.name, f.closeErr)
+	}
+	if f.file == nil {
+		if err := f.pool.acquire(f.ctx, f); err != nil {
+			return 0, err
+		}
+		file, err := os.OpenFile(f.name, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			f.pool.release(f)
+			return 0, fmt.Errorf("failed to reopen %s: %w", f.name, err)
+		}
+		f.file = file
+	}
+	n, err := f.file.Write(p)
+	f.pool.touch(f)
+	return n, err
+}
+
+// Close closes the descriptor if it is open and frees the file's slot
+func (f *pooledFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	err := f.closeErr
+	if f.file != nil {
+		err = f.file.Close()
+		f.file = nil
+		f.pool.release(f)
+	}
+	return err
+}
+
+func (f *pooledFile) Seek(int64, int) (int64, error) {
+	return 0, errors.New("pooled output files do not support seeking")
+}
+
+func (f *pooledFile) Read([]byte) (int, error) {
+	return 0, errors.New("pooled output files do not support reading")
+}
+
+func (f *pooledFile) Open(string) (source.ParquetFile, error) {
+	return nil, errors.New("pooled output files do not support opening other files")
+}
+
+func (f *pooledFile) Create(string) (source.ParquetFile, error) {
+	return nil, errors.New("pooled output files do not support creating other files")
+}
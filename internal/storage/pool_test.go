@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kiquetal/go-duckdb-ingester/internal/prometheus"
+)
+
+// TestWriterPoolInterleaved streams to more files than storage.maxOpenFiles
+// at once, feeding them in turns. The least recently used file must be closed
+// for another to be written, and reopened when its turn comes again.
+func TestWriterPoolInterleaved(t *testing.T) {
+	const files, rows, chunk = 3, 5000, 500
+	cfg := testStorageConfig(t, "maxOpenFiles: 2, rowGroupSize: 16384, pageSize: 1024")
+	store, err := NewParquetStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	metrics := testMetrics(rows)
+	streams := make([]chan prometheus.MetricResult, files)
+	filenames := make([]string, files)
+	done := make(chan error, files)
+	for i := range streams {
+		streams[i] = make(chan prometheus.MetricResult)
+		filenames[i] = filepath.Join(cfg.OutputDir, fmt.Sprintf("day=%02d", i+1), "metrics.parquet")
+		errs := make(chan error)
+		close(errs)
+		go func() {
+			n, err := store.StoreMetricsStream(ctx, streams[i], errs, filenames[i])
+			if err == nil && n != rows {
+				err = fmt.Errorf("%s: wrote %d rows, want %d", filenames[i], n, rows)
+			}
+			done <- err
+		}()
+	}
+
+	for start := 0; start < rows; start += chunk {
+		for _, stream := range streams {
+			for _, metric := range metrics[start : start+chunk] {
+				select {
+				case stream <- metric:
+				case <-ctx.Done():
+					t.Fatal("writes to more files than maxOpenFiles blocked each other")
+				}
+			}
+			store.pool.mu.Lock()
+			open := store.pool.lru.Len()
+			store.pool.mu.Unlock()
+			if open > cfg.MaxOpenFiles {
+				t.Fatalf("%d files open, want at most %d", open, cfg.MaxOpenFiles)
+			}
+		}
+	}
+	for _, stream := range streams {
+		close(stream)
+	}
+	for range streams {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, filename := range filenames {
+		info, err := InspectParquetFile(filename, rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Rows != rows {
+			t.Errorf("%s has %d rows, want %d", filename, info.Rows, rows)
+		}
+		for i, row := range info.Sample {
+			for _, column := range row {
+				if column.Name == "value" && column.Value != metrics[i].Value {
+					t.Fatalf("%s row %d value = %v, want %v", filename, i, column.Value, metrics[i].Value)
+				}
+			}
+		}
+	}
+	if open := store.pool.lru.Len(); open != 0 {
+		t.Errorf("%d files still open after every write finished", open)
+	}
+}
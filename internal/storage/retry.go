@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/kiquetal/go-duckdb-ingester/internal/backoff"
+	"github.com/kiquetal/go-duckdb-ingester/internal/prometheus"
+)
+
+// failedSuffix is appended to the path of a batch spooled to storage.failedDir
+const failedSuffix = ".failed.jsonl"
+
+// storeWithRetry writes metrics to filename, writing the whole file again up
+// to storage.writeRetries times when writing or finalizing it fails. The
+// partial file of a failed attempt has already been removed, and the metrics
+// are still in memory, so every attempt starts from scratch.
+func (s *ParquetStorage) storeWithRetry(ctx context.Context, metrics []prometheus.MetricResult, filename string) (int, error) {
+	for attempt := 0; ; attempt++ {
+		rows, err := s.storeMetricsOnce(ctx, metrics, filename)
+		if err == nil || ctx.Err() != nil {
+			return rows, err
+		}
+		if attempt >= s.config.WriteRetries {
+			if attempt > 0 {
+				err = fmt.Errorf("%w (gave up after %d retries)", err, attempt)
+			}
+			return rows, err
+		}
+
+		delay := backoff.Delay(s.config.WriteRetryBackoff, attempt)
+
+		slog.Warn("Retrying file write", "path", filename, "delay", delay,
+			"attempt", attempt+1, "max_retries", s.config.WriteRetries, "error", err)
+
+		if !backoff.Sleep(ctx, delay) {
+			return rows, err
+		}
+	}
+}
+
+// spoolFailed saves the metrics of a batch that could not be written to
+// storage.failedDir as JSON lines, with every label in the labels object, and
+// returns writeErr annotated with where they went
+func (s *ParquetStorage) spoolFailed(metrics []prometheus.MetricResult, filename string, writeErr error) error {
+	spool := filepath.Join(s.config.FailedDir, filepath.FromSlash(s.relativePath(filename))+failedSuffix)
+	if err := s.writeSpool(spool, metrics); err != nil {
+		slog.Error("Failed to spool records of failed batch", "path", spool, "rows", len(metrics), "error", err)
+		return writeErr
+	}
+	slog.Warn("Spooled records of failed batch", "path", spool, "rows", len(metrics))
+	return fmt.Errorf("%w; records saved to %s", writeErr, spool)
+}
+
+// relativePath returns filename relative to the output directory, or its base
+// name when it lies elsewhere
+func (s *ParquetStorage) relativePath(filename string) string {
+	prefix := strings.TrimSuffix(s.config.OutputDir, "/") + "/"
+	if rel, ok := strings.CutPrefix(filename, prefix); ok {
+		return rel
+	}
+	return path.Base(filename)
+}
+
+// writeSpool writes metrics to a local JSONL file, replacing an earlier spool
+// of the same batch
+func (s *ParquetStorage) writeSpool(filename string, metrics []prometheus.MetricResult) (err error) {
+	if err := mkdirAll(filepath.Dir(filename), dirPerm(s.config)); err != nil {
+		return err
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := f.Chmod(filePerm(s.config)); err != nil {
+		f.Close()
+		os.Remove(filename)
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(filename)
+		}
+	}()
+
+	w := newJSONLRowWriter(f, recordSchema{})
+	for _, metric := range metrics {
+		if err := w.write(metric); err != nil {
+			return err
+		}
+	}
+	return w.finish()
+}
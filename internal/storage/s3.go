@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+// s3Scheme prefixes output locations that should be written to S3
+const s3Scheme = "s3://"
+
+// isS3Path reports whether p refers to an S3 location
+func isS3Path(p string) bool {
+	return strings.HasPrefix(p, s3Scheme)
+}
+
+// parseS3Path splits an s3://bucket/key location into bucket and key
+func parseS3Path(p string) (bucket, key string, err error) {
+	rest := strings.TrimPrefix(p, s3Scheme)
+	bucket, key, _ = strings.Cut(rest, "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("invalid S3 location %q: missing bucket", p)
+	}
+
+	// Collapse duplicate slashes so the partition layout matches local paths
+	key = strings.TrimPrefix(path.Clean("/"+key), "/")
+	return bucket, key, nil
+}
+
+// newS3Client builds an S3 client from the storage S3 settings, falling back to
+// the default AWS credential chain when no static credentials are configured
+func newS3Client(ctx context.Context, cfg config.S3Config) (*s3.Client, error) {
+	var opts []func(*awsconfig.LoadOptions) error
+	if cfg.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(cfg.Region))
+	}
+	if cfg.AccessKeyID != "" {
+		opts = append(opts, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(cfg.AccessKeyID, cfg.SecretAccessKey, cfg.SessionToken)))
+	}
+
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS configuration: %w", err)
+	}
+
+	return s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+		o.UsePathStyle = cfg.ForcePathStyle
+	}), nil
+}
@@ -0,0 +1,433 @@
+package storage
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/xitongsys/parquet-go/common"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/schema"
+
+	"github.com/kiquetal/go-duckdb-ingester/internal/prometheus"
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+// recordSchema describes the Parquet row layout: the MetricRecord columns plus
+// one optional string column per promoted label. Rows use a struct type built
+// at runtime so the columns and their encodings can vary by configuration.
+//
+// In the series layout a row holds every sample of one series in a file: the
+// value column is replaced by timestamps and values lists, and timestamp is
+// the first sample's.
+type recordSchema struct {
+	promoted []string
+
+	// labels filters the labels stored in the labels list
+	labels labelFilter
+
+	// location is the storage.timezone the date column follows
+	location *time.Location
+
+	// dateFormat is the storage.dateFormat layout of the date column
+	dateFormat string
+
+	// series is set for the storage.layout "series" rows
+	series bool
+
+	// apiProxyKeys are the storage.apiProxyLabelKeys
+	apiProxyKeys []string
+
+	// precision is the storage.timestampPrecision of the timestamp columns
+	precision string
+
+	// invocationID is the storage.InvocationID rows are written with
+	invocationID string
+
+	// typ is the generated row type, nil when the MetricRecord layout is used
+	typ reflect.Type
+
+	// dictionaryLabels is set when the labels list uses dictionaryLabel elements
+	dictionaryLabels bool
+}
+
+// SchemaVersion identifies the set of MetricRecord columns. It is written to
+// every row's schema_version column and to the schema_version key of each
+// Parquet file's footer metadata, so readers of files from different releases
+// can tell them apart. Bump it whenever a MetricRecord column is added,
+// removed, renamed or changes type.
+//
+// Files written before versioning have neither and count as version 0.
+const SchemaVersion = 3
+
+// schemaVersionKey is the Parquet footer metadata key holding SchemaVersion
+const schemaVersionKey = "schema_version"
+
+// precisionKey is the Parquet footer metadata key holding the
+// storage.timestampPrecision a file was written with
+const precisionKey = "timestamp_precision"
+
+// metadata returns the footer key-value metadata of a Parquet file
+func (rs recordSchema) metadata() []*parquet.KeyValue {
+	version := strconv.Itoa(SchemaVersion)
+	precision := rs.timestampPrecision()
+	return []*parquet.KeyValue{
+		{Key: schemaVersionKey, Value: &version},
+		{Key: precisionKey, Value: &precision},
+	}
+}
+
+// fileSchemaVersion returns the SchemaVersion recorded in a Parquet file's
+// footer metadata, 0 when it has none
+func fileSchemaVersion(metadata []*parquet.KeyValue) (int, error) {
+	for _, kv := range metadata {
+		if kv.Key != schemaVersionKey || kv.Value == nil {
+			continue
+		}
+		version, err := strconv.Atoi(*kv.Value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s metadata %q", schemaVersionKey, *kv.Value)
+		}
+		return version, nil
+	}
+	return 0, nil
+}
+
+// filePrecision returns the timestamp precision recorded in a Parquet file's
+// footer metadata; files without one are in milliseconds
+func filePrecision(metadata []*parquet.KeyValue) string {
+	for _, kv := range metadata {
+		if kv.Key == precisionKey && kv.Value != nil {
+			return *kv.Value
+		}
+	}
+	return config.PrecisionMillis
+}
+
+// dictionaryLabel is a Label written with dictionary encoded keys and values
+type dictionaryLabel struct {
+	Key   string `parquet:"name=key, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Value string `parquet:"name=value, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+}
+
+// dictionaryTag is appended to the tag of dictionary encoded columns
+const dictionaryTag = ", encoding=PLAIN_DICTIONARY"
+
+// newRecordSchema builds the row layout for the promoted labels and column
+// encodings of cfg
+func newRecordSchema(cfg config.StorageConfig) recordSchema {
+	promote := cfg.PromoteLabels
+	rs := recordSchema{
+		promoted: promote,
+		labels:   newLabelFilter(cfg),
+		location: storageLocation(cfg),
+		series:   cfg.Layout == config.LayoutSeries,
+
+		apiProxyKeys: cfg.ApiProxyLabelKeys,
+		precision:    cfg.TimestampPrecision,
+		invocationID: cfg.InvocationID,
+		dateFormat:   cfg.DateFormat,
+	}
+
+	base := reflect.TypeOf(MetricRecord{})
+	fields := make([]reflect.StructField, 0, base.NumField()+len(promote)+1)
+	custom := len(promote) > 0 || rs.series || rs.timestampPrecision() != config.PrecisionMillis
+	for i := 0; i < base.NumField(); i++ {
+		field := base.Field(i)
+		column := parquetColumn(field)
+		if column == "value" && rs.series {
+			continue
+		}
+		if column == "timestamp" {
+			field.Tag = reflect.StructTag(`parquet:"name=timestamp, type=INT64, ` + rs.timestampType("") + `"`)
+		}
+		isString := field.Type.Kind() == reflect.String || field.Type == reflect.TypeOf((*string)(nil))
+		if isString && cfg.DictionaryEncoded(column) {
+			field.Tag = reflect.StructTag(fmt.Sprintf(`parquet:"%s%s"`, field.Tag.Get("parquet"), dictionaryTag))
+			custom = true
+		}
+		if column == "labels" && cfg.DictionaryEncoded(column) {
+			field.Type = reflect.TypeOf([]dictionaryLabel(nil))
+			rs.dictionaryLabels = true
+			custom = true
+		}
+		fields = append(fields, field)
+	}
+	if !custom {
+		return rs
+	}
+
+	for i, label := range promote {
+		tag := fmt.Sprintf("name=%s, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL", label)
+		if cfg.DictionaryEncoded(label) {
+			tag += dictionaryTag
+		}
+		fields = append(fields, reflect.StructField{
+			Name: fmt.Sprintf("Promoted%d", i),
+			Type: reflect.TypeOf((*string)(nil)),
+			Tag:  reflect.StructTag(`parquet:"` + tag + `"`),
+		})
+	}
+
+	if rs.series {
+		fields = append(fields,
+			reflect.StructField{
+				Name: "Timestamps",
+				Type: reflect.TypeOf([]int64(nil)),
+				Tag:  reflect.StructTag(`parquet:"name=timestamps, type=LIST, valuetype=INT64` + rs.listTimestampType() + `"`),
+			},
+			reflect.StructField{
+				Name: "Values",
+				Type: reflect.TypeOf([]float64(nil)),
+				Tag:  `parquet:"name=values, type=LIST, valuetype=DOUBLE"`,
+			},
+		)
+	}
+
+	rs.typ = reflect.StructOf(fields)
+	return rs
+}
+
+// checkPromoted returns an error when a promoted label has the name of a
+// MetricRecord column or of a column the row layout adds, which it would shadow
+func (rs recordSchema) checkPromoted() error {
+	for _, typ := range []reflect.Type{reflect.TypeOf(MetricRecord{}), rs.rowType()} {
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if strings.HasPrefix(field.Name, "Promoted") {
+				continue
+			}
+			if column := parquetColumn(field); slices.Contains(rs.promoted, column) {
+				return fmt.Errorf("storage.promoteLabels: %q conflicts with a built-in column", column)
+			}
+		}
+	}
+	return nil
+}
+
+// timestampPrecision returns storage.timestampPrecision, milliseconds when unset
+func (rs recordSchema) timestampPrecision() string {
+	if rs.precision == "" {
+		return config.PrecisionMillis
+	}
+	return rs.precision
+}
+
+// timestampType returns the tag annotating an INT64 column with the timestamp
+// precision. Nanoseconds have no converted type and use the logical type.
+func (rs recordSchema) timestampType(prefix string) string {
+	switch rs.timestampPrecision() {
+	case config.PrecisionMicros:
+		return prefix + "convertedtype=TIMESTAMP_MICROS"
+	case config.PrecisionNanos:
+		return prefix + "logicaltype=TIMESTAMP, " + prefix + "logicaltype.isadjustedtoutc=true, " + prefix + "logicaltype.unit=NANOS"
+	default:
+		return prefix + "convertedtype=TIMESTAMP_MILLIS"
+	}
+}
+
+// listTimestampType returns the tag suffix annotating the elements of the
+// timestamps list. The writer ignores logical types of list elements, so
+// nanoseconds are left unannotated here and set by annotate.
+func (rs recordSchema) listTimestampType() string {
+	if rs.timestampPrecision() == config.PrecisionNanos {
+		return ""
+	}
+	return ", " + rs.timestampType("value")
+}
+
+// annotate sets the annotations the parquet tags cannot express on the schema
+// of a writer: the nanosecond logical type of the timestamps list elements
+func (rs recordSchema) annotate(sh *schema.SchemaHandler) {
+	if !rs.series || rs.timestampPrecision() != config.PrecisionNanos {
+		return
+	}
+	path := common.PathToStr([]string{sh.GetRootInName(), "Timestamps", "List", "Element"})
+	index, ok := sh.MapIndex[path]
+	if !ok {
+		return
+	}
+	logical := parquet.NewLogicalType()
+	logical.TIMESTAMP = parquet.NewTimestampType()
+	logical.TIMESTAMP.IsAdjustedToUTC = true
+	logical.TIMESTAMP.Unit = parquet.NewTimeUnit()
+	logical.TIMESTAMP.Unit.NANOS = parquet.NewNanoSeconds()
+	sh.SchemaElements[index].LogicalType = logical
+}
+
+// unixTime converts t into a value of the timestamp columns
+func (rs recordSchema) unixTime(t time.Time) int64 {
+	switch rs.timestampPrecision() {
+	case config.PrecisionMicros:
+		return t.UnixMicro()
+	case config.PrecisionNanos:
+		return t.UnixNano()
+	default:
+		return t.UnixMilli()
+	}
+}
+
+// fromUnixTime converts a value of the timestamp columns back into a time,
+// the inverse of unixTime
+func (rs recordSchema) fromUnixTime(v int64) time.Time {
+	switch rs.timestampPrecision() {
+	case config.PrecisionMicros:
+		return time.UnixMicro(v).UTC()
+	case config.PrecisionNanos:
+		return time.Unix(0, v).UTC()
+	default:
+		return time.UnixMilli(v).UTC()
+	}
+}
+
+// stored returns t truncated to the timestamp precision, as read back from a file
+func (rs recordSchema) stored(t time.Time) time.Time {
+	return rs.fromUnixTime(rs.unixTime(t))
+}
+
+// parquetColumn returns the column name in the parquet tag of a MetricRecord field
+func parquetColumn(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("parquet"), ",")
+	return strings.TrimPrefix(name, "name=")
+}
+
+// newObject returns a value describing the schema to the Parquet writer
+func (rs recordSchema) newObject() interface{} {
+	if rs.typ == nil {
+		return new(MetricRecord)
+	}
+	return reflect.New(rs.typ).Interface()
+}
+
+// record converts a metric into a row. Promoted labels move to their own
+// columns (NULL when absent) and are left out of the labels list.
+func (rs recordSchema) record(metric prometheus.MetricResult) interface{} {
+	rec := rs.metricRecord(metric)
+	if rs.typ == nil {
+		return rec
+	}
+	return rs.row(rec, metric.Labels).Interface()
+}
+
+// seriesRecord converts the samples of one series, in timestamp order, into a
+// row of the series layout
+func (rs recordSchema) seriesRecord(samples []prometheus.MetricResult) interface{} {
+	timestamps := make([]int64, len(samples))
+	values := make([]float64, len(samples))
+	for i, sample := range samples {
+		timestamps[i] = rs.unixTime(sample.Timestamp)
+		values[i] = sample.Value
+	}
+
+	row := rs.row(rs.metricRecord(samples[0]), samples[0].Labels)
+	row.FieldByName("Timestamps").Set(reflect.ValueOf(timestamps))
+	row.FieldByName("Values").Set(reflect.ValueOf(values))
+	return row.Interface()
+}
+
+// metricRecord converts a metric into the fixed columns
+func (rs recordSchema) metricRecord(metric prometheus.MetricResult) MetricRecord {
+	labels := rs.listLabels(metric.Labels)
+	return MetricRecord{
+		Timestamp:     rs.unixTime(metric.Timestamp),
+		MetricName:    metric.Name,
+		Value:         metric.Value,
+		ApiProxy:      apiProxyOf(metric, rs.apiProxyKeys),
+		Source:        metric.Source,
+		Labels:        convertLabels(labels),
+		Date:          rs.date(metric.Timestamp),
+		SchemaVersion: SchemaVersion,
+		CollectedAt:   collectedAt(metric),
+		InvocationID:  invocationOf(metric, rs.invocationID),
+		OriginalName:  originalName(metric.Labels),
+	}
+}
+
+// collectedAt returns the collection time of a metric in milliseconds, whatever
+// the timestamp precision, nil when it was not recorded
+func collectedAt(metric prometheus.MetricResult) *int64 {
+	if metric.CollectedAt.IsZero() {
+		return nil
+	}
+	ms := metric.CollectedAt.UnixMilli()
+	return &ms
+}
+
+// date returns the date column of t: its calendar day in storage.timezone,
+// formatted with storage.dateFormat
+func (rs recordSchema) date(t time.Time) string {
+	layout := rs.dateFormat
+	if layout == "" {
+		layout = time.DateOnly
+	}
+	if rs.location == nil {
+		return t.UTC().Format(layout)
+	}
+	return t.In(rs.location).Format(layout)
+}
+
+// storageLocation returns the zone loaded from storage.timezone, UTC when unset
+func storageLocation(cfg config.StorageConfig) *time.Location {
+	if cfg.Location == nil {
+		return time.UTC
+	}
+	return cfg.Location
+}
+
+// originalName returns the __name__ label of a series, nil when it has none
+func originalName(labels map[string]string) *string {
+	if name, ok := labels[model.MetricNameLabel]; ok {
+		return &name
+	}
+	return nil
+}
+
+// listLabels returns the labels written to the labels list: those the label
+// filter keeps, without the promoted ones
+func (rs recordSchema) listLabels(labels map[string]string) map[string]string {
+	list := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if rs.labels.keep(k) && !slices.Contains(rs.promoted, k) {
+			list[k] = v
+		}
+	}
+	return list
+}
+
+// row copies rec into a row of the generated type and fills the promoted
+// columns from labels
+func (rs recordSchema) row(rec MetricRecord, labels map[string]string) reflect.Value {
+	row := reflect.New(rs.typ).Elem()
+	base := reflect.ValueOf(rec)
+	for i := 0; i < base.NumField(); i++ {
+		name := base.Type().Field(i).Name
+		field := row.FieldByName(name)
+		switch {
+		case !field.IsValid():
+			// The series layout has no value column
+		case rs.dictionaryLabels && name == "Labels":
+			field.Set(reflect.ValueOf(toDictionaryLabels(rec.Labels)))
+		default:
+			field.Set(base.Field(i))
+		}
+	}
+	for i, label := range rs.promoted {
+		if value, ok := labels[label]; ok {
+			row.FieldByName(fmt.Sprintf("Promoted%d", i)).Set(reflect.ValueOf(&value))
+		}
+	}
+	return row
+}
+
+// toDictionaryLabels converts labels to their dictionary encoded form
+func toDictionaryLabels(labels []Label) []dictionaryLabel {
+	result := make([]dictionaryLabel, len(labels))
+	for i, label := range labels {
+		result[i] = dictionaryLabel(label)
+	}
+	return result
+}
@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"sort"
+
+	"github.com/kiquetal/go-duckdb-ingester/internal/prometheus"
+)
+
+// seriesRowWriter writes the storage.layout "series" rows. Samples are held
+// until finish, which writes one row per series in the order the series were
+// first seen.
+type seriesRowWriter struct {
+	*parquetRowWriter
+
+	series map[string][]prometheus.MetricResult
+	order  []string
+}
+
+func newSeriesRowWriter(w *parquetRowWriter) *seriesRowWriter {
+	return &seriesRowWriter{parquetRowWriter: w, series: make(map[string][]prometheus.MetricResult)}
+}
+
+func (w *seriesRowWriter) write(metric prometheus.MetricResult) error {
+	key := prometheus.SeriesKey(metric)
+	if _, ok := w.series[key]; !ok {
+		w.order = append(w.order, key)
+	}
+	w.series[key] = append(w.series[key], metric)
+	return nil
+}
+
+// finish writes the buffered series and completes the file
+func (w *seriesRowWriter) finish() error {
+	for _, key := range w.order {
+		samples := w.series[key]
+		sort.SliceStable(samples, func(i, j int) bool {
+			return samples[i].Timestamp.Before(samples[j].Timestamp)
+		})
+		if err := w.pw.Write(w.schema.seriesRecord(samples)); err != nil {
+			return err
+		}
+	}
+	return w.parquetRowWriter.finish()
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// sidecarSuffix is appended to a Parquet file name to form its metadata sidecar
+const sidecarSuffix = ".meta.json"
+
+// fileStats summarizes the rows written to a Parquet file
+type fileStats struct {
+	Rows         int
+	Bytes        int64
+	MinTimestamp time.Time
+	MaxTimestamp time.Time
+}
+
+// observe updates the stats with a written row's timestamp, as stored in the file
+func (st *fileStats) observe(ts time.Time) {
+	if st.Rows == 0 || ts.Before(st.MinTimestamp) {
+		st.MinTimestamp = ts
+	}
+	if st.Rows == 0 || ts.After(st.MaxTimestamp) {
+		st.MaxTimestamp = ts
+	}
+	st.Rows++
+}
+
+// sidecar is the JSON document written next to each Parquet file for auditing
+type sidecar struct {
+	File         string    `json:"file"`
+	Rows         int       `json:"rows"`
+	Bytes        int64     `json:"bytes"`
+	MinTimestamp time.Time `json:"min_timestamp"`
+	MaxTimestamp time.Time `json:"max_timestamp"`
+	SHA256       string    `json:"sha256"`
+}
+
+// writeSidecar reads back a finished Parquet file, hashes it, and writes its
+// row count, size, time bounds and checksum to filename + ".meta.json"
+func (s *ParquetStorage) writeSidecar(ctx context.Context, filename string, stats fileStats) error {
+	r, err := s.openFile(ctx, filename)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return fmt.Errorf("failed to read %s for checksum: %w", filename, err)
+	}
+
+	data, err := json.MarshalIndent(sidecar{
+		File:         filename,
+		Rows:         stats.Rows,
+		Bytes:        size,
+		MinTimestamp: stats.MinTimestamp,
+		MaxTimestamp: stats.MaxTimestamp,
+		SHA256:       hex.EncodeToString(h.Sum(nil)),
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode sidecar for %s: %w", filename, err)
+	}
+
+	if err := s.putFile(ctx, filename+sidecarSuffix, data); err != nil {
+		return fmt.Errorf("failed to write sidecar for %s: %w", filename, err)
+	}
+	return nil
+}
+
+// openFile opens a written output on local disk or in S3 for reading
+func (s *ParquetStorage) openFile(ctx context.Context, filename string) (io.ReadCloser, error) {
+	if !isS3Path(filename) {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %w", filename, err)
+		}
+		return f, nil
+	}
+
+	bucket, key, err := parseS3Path(filename)
+	if err != nil {
+		return nil, err
+	}
+	out, err := s.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", filename, err)
+	}
+	return out.Body, nil
+}
+
+// putFile writes a small file on local disk or in S3
+func (s *ParquetStorage) putFile(ctx context.Context, filename string, data []byte) error {
+	if !isS3Path(filename) {
+		return writeLocalFile(filename, data, filePerm(s.config))
+	}
+
+	bucket, key, err := parseS3Path(filename)
+	if err != nil {
+		return err
+	}
+	_, err = s.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(contentType(filename)),
+	})
+	return err
+}
+
+// contentType returns the S3 content type of a small file written by putFile
+func contentType(filename string) string {
+	if strings.HasSuffix(filename, ".json") {
+		return "application/json"
+	}
+	return "application/octet-stream"
+}
+
+// WriteReport writes name below the output directory, on local disk or in S3
+func (s *ParquetStorage) WriteReport(ctx context.Context, name string, data []byte) error {
+	filename := strings.TrimSuffix(s.config.OutputDir, "/") + "/" + name
+	if err := s.putFile(ctx, filename, data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kiquetal/go-duckdb-ingester/internal/prometheus"
+	"github.com/kiquetal/go-duckdb-ingester/pkg/config"
+)
+
+// Storage persists collected metrics. The meaning of target depends on the
+// backend: a file path for Parquet, and a batch identifier for DuckDB.
+type Storage interface {
+	// StoreMetrics stores metrics and returns the number of rows stored
+	StoreMetrics(ctx context.Context, metrics []prometheus.MetricResult, target string) (int, error)
+
+	// StoreMetricsStream stores metrics as they arrive until the stream is
+	// closed and returns the number of rows stored. A non-nil error on errs
+	// discards everything stored from the stream.
+	StoreMetricsStream(ctx context.Context, metrics <-chan prometheus.MetricResult, errs <-chan error, target string) (int, error)
+
+	// Exists reports whether target already holds a complete output from an
+	// earlier run. Backends without per-target outputs always report false.
+	Exists(ctx context.Context, target string) (bool, error)
+
+	// StoreEmpty records that a range batch returned no rows for target, so
+	// Exists reports it as written. Backends without per-target outputs do
+	// nothing.
+	StoreEmpty(ctx context.Context, target string) error
+
+	// WriteReport writes a small file named name directly below the storage
+	// output directory, e.g. a run summary
+	WriteReport(ctx context.Context, name string, data []byte) error
+
+	// MarkPartition writes the storage.successMarker file into the partition
+	// directory dir when complete is set and removes it otherwise. Backends
+	// without partition directories, or with markers disabled, do nothing.
+	MarkPartition(ctx context.Context, dir string, complete bool) error
+
+	// WriteManifests updates the manifest.json of every day= directory
+	// written since the last call when storage.writeManifest is set. Backends
+	// without output files do nothing.
+	WriteManifests(ctx context.Context) error
+}
+
+// Compile-time checks that each backend satisfies Storage
+var (
+	_ Storage = (*ParquetStorage)(nil)
+	_ Storage = (*DuckDBStorage)(nil)
+)
+
+// New creates the storage backend selected by cfg.Type
+func New(cfg config.StorageConfig) (Storage, error) {
+	switch cfg.Type {
+	case "", config.StorageTypeParquet:
+		return NewParquetStorage(cfg)
+	case config.StorageTypeDuckDB:
+		return NewDuckDBStorage(cfg)
+	default:
+		return nil, fmt.Errorf("unsupported storage type %q", cfg.Type)
+	}
+}
+
+// apiProxyOf returns the api_proxy column of a sample: the value of the first
+// of keys among its labels, or the API proxy it was collected for when none is
+func apiProxyOf(metric prometheus.MetricResult, keys []string) string {
+	for _, key := range keys {
+		if val, ok := metric.Labels[key]; ok {
+			return val
+		}
+	}
+	return metric.APIProxy
+}
+
+// invocationOf returns the invocation_id column of a sample: the invocation
+// it was read back with, or own, the storage.InvocationID of this ingester
+func invocationOf(metric prometheus.MetricResult, own string) string {
+	if metric.InvocationID != "" {
+		return metric.InvocationID
+	}
+	return own
+}
+
+// drainStream passes each streamed metric to write until the stream closes,
+// then returns the error reported by the producer, if any
+func drainStream(ctx context.Context, metrics <-chan prometheus.MetricResult, errs <-chan error, write func(prometheus.MetricResult) error) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("write interrupted: %w", ctx.Err())
+		case metric, ok := <-metrics:
+			if !ok {
+				return <-errs
+			}
+			if err := write(metric); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/kiquetal/go-duckdb-ingester/internal/prometheus"
+)
+
+// textColumns are the columns of JSONL and CSV rows, matching MetricRecord;
+// promoted labels follow as extra columns
+var textColumns = []string{"timestamp", "metric_name", "value", "api_proxy", "source", "labels", "date", "schema_version", "collected_at", "invocation_id", "original_name"}
+
+// textRow is one row of a JSONL or CSV file: the MetricRecord columns with
+// promoted labels split out of labels into their own columns
+type textRow struct {
+	timestamp    string
+	metricName   string
+	originalName *string
+	value        float64
+	apiProxy     string
+	source       string
+	labels       map[string]string
+	date         string
+
+	// collectedAt is formatted like timestamp, nil when not recorded
+	collectedAt *string
+
+	invocationID string
+
+	// promoted holds the promoted label values, nil when absent
+	promoted []*string
+}
+
+// textTimeFormat is RFC 3339 with the millisecond precision Parquet files store
+const textTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// textRow converts a metric into a row for the text formats. Timestamps are
+// RFC 3339 in UTC with the millisecond precision Parquet files store.
+func (rs recordSchema) textRow(metric prometheus.MetricResult) textRow {
+	ts := time.UnixMilli(metric.Timestamp.UnixMilli()).UTC()
+	row := textRow{
+		timestamp:    ts.Format(textTimeFormat),
+		metricName:   metric.Name,
+		originalName: originalName(metric.Labels),
+		value:        metric.Value,
+		apiProxy:     apiProxyOf(metric, rs.apiProxyKeys),
+		source:       metric.Source,
+		labels:       rs.listLabels(metric.Labels),
+		date:         rs.date(ts),
+		invocationID: invocationOf(metric, rs.invocationID),
+	}
+	if !metric.CollectedAt.IsZero() {
+		collected := metric.CollectedAt.UTC().Format(textTimeFormat)
+		row.collectedAt = &collected
+	}
+	if len(rs.promoted) == 0 {
+		return row
+	}
+
+	row.promoted = make([]*string, len(rs.promoted))
+	for i, label := range rs.promoted {
+		if value, ok := metric.Labels[label]; ok {
+			row.promoted[i] = &value
+		}
+	}
+	return row
+}
+
+// formatValue renders a sample value; non-finite values use the Prometheus
+// spelling (NaN, +Inf, -Inf) since JSON has no literal for them
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// jsonlRowWriter writes one JSON object per line
+type jsonlRowWriter struct {
+	w      *bufio.Writer
+	schema recordSchema
+}
+
+func newJSONLRowWriter(w io.Writer, schema recordSchema) *jsonlRowWriter {
+	return &jsonlRowWriter{w: bufio.NewWriter(w), schema: schema}
+}
+
+func (jw *jsonlRowWriter) write(metric prometheus.MetricResult) error {
+	row := jw.schema.textRow(metric)
+
+	// Non-finite values cannot be JSON numbers, so they are written as strings
+	var value any = row.value
+	if math.IsNaN(row.value) || math.IsInf(row.value, 0) {
+		value = formatValue(row.value)
+	}
+
+	values := []any{row.timestamp, row.metricName, value, row.apiProxy, row.source, row.labels, row.date, SchemaVersion, row.collectedAt, row.invocationID, row.originalName}
+	columns := textColumns
+	if len(row.promoted) > 0 {
+		columns = append(append([]string(nil), textColumns...), jw.schema.promoted...)
+		for _, v := range row.promoted {
+			values = append(values, v)
+		}
+	}
+
+	// Encode field by field to keep the column order stable
+	jw.w.WriteByte('{')
+	for i, column := range columns {
+		if i > 0 {
+			jw.w.WriteByte(',')
+		}
+		key, _ := json.Marshal(column)
+		val, err := json.Marshal(values[i])
+		if err != nil {
+			return err
+		}
+		jw.w.Write(key)
+		jw.w.WriteByte(':')
+		jw.w.Write(val)
+	}
+	jw.w.WriteByte('}')
+	return jw.w.WriteByte('\n')
+}
+
+func (jw *jsonlRowWriter) finish() error {
+	return jw.w.Flush()
+}
+
+// csvRowWriter writes rows as CSV with a header line. Labels are flattened
+// into a JSON object string; absent promoted labels are empty.
+type csvRowWriter struct {
+	w      *csv.Writer
+	schema recordSchema
+}
+
+func newCSVRowWriter(w io.Writer, schema recordSchema) (*csvRowWriter, error) {
+	cw := &csvRowWriter{w: csv.NewWriter(w), schema: schema}
+	header := append(append([]string(nil), textColumns...), schema.promoted...)
+	if err := cw.w.Write(header); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *csvRowWriter) write(metric prometheus.MetricResult) error {
+	row := cw.schema.textRow(metric)
+
+	labels, err := json.Marshal(row.labels)
+	if err != nil {
+		return err
+	}
+
+	record := []string{row.timestamp, row.metricName, formatValue(row.value), row.apiProxy, row.source, string(labels), row.date, strconv.Itoa(SchemaVersion), derefString(row.collectedAt), row.invocationID, derefString(row.originalName)}
+	for _, v := range row.promoted {
+		record = append(record, derefString(v))
+	}
+	return cw.w.Write(record)
+}
+
+// derefString returns the string v points to, or "" for a NULL column
+func derefString(v *string) string {
+	if v == nil {
+		return ""
+	}
+	return *v
+}
+
+func (cw *csvRowWriter) finish() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
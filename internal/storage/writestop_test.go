@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xitongsys/parquet-go/source"
+)
+
+// hangingFile accepts writes until hang is called; later writes block until
+// release is called and then fail
+type hangingFile struct {
+	source.ParquetFile
+
+	mu      sync.Mutex
+	hanging bool
+	release chan struct{}
+}
+
+func (f *hangingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	hanging := f.hanging
+	f.mu.Unlock()
+	if hanging {
+		<-f.release
+		return 0, os.ErrClosed
+	}
+	return len(p), nil
+}
+
+func (f *hangingFile) Close() error {
+	return nil
+}
+
+func (f *hangingFile) hang() {
+	f.mu.Lock()
+	f.hanging = true
+	f.mu.Unlock()
+}
+
+// TestWriteStopTimeout checks that a timed out file is removed and that
+// nothing touches it afterwards; run it with -race
+func TestWriteStopTimeout(t *testing.T) {
+	cfg := testStorageConfig(t, "writeStopTimeout: 1ns")
+	store, err := NewParquetStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename := cfg.OutputDir + "/metrics.parquet"
+	_, err = store.StoreMetrics(context.Background(), testMetrics(20000), filename)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("StoreMetrics error = %v, want a timeout", err)
+	}
+	entries, err := os.ReadDir(cfg.OutputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("%s left behind after the timeout", entry.Name())
+	}
+}
+
+// TestWriteStopHungWrite checks that finish returns when a write never
+// completes, instead of waiting for it
+func TestWriteStopHungWrite(t *testing.T) {
+	cfg := testStorageConfig(t, "writeStopTimeout: 50ms")
+	store, err := NewParquetStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := &hangingFile{release: make(chan struct{})}
+	defer close(file.release)
+	w, err := store.newParquetRowWriter(&stoppableFile{ParquetFile: file, abort: func() {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, metric := range testMetrics(100) {
+		if err := w.write(metric); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file.hang()
+	start := time.Now()
+	err = w.finish()
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("finish error = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("finish took %s with a hung write", elapsed)
+	}
+}
@@ -0,0 +1,48 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// lastSuccessTime is the Unix time in nanoseconds of the last successful
+// collection cycle, or 0 before the first one
+var lastSuccessTime atomic.Int64
+
+// ServeHealth exposes Kubernetes-style probes on addr until ctx is cancelled.
+// /healthz always succeeds while the process runs; /readyz succeeds only if a
+// collection cycle completed successfully within maxAge. It returns
+// immediately; listen errors are logged.
+func ServeHealth(ctx context.Context, addr string, maxAge time.Duration) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := ready(maxAge); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	slog.Info("Serving health probes", "address", addr, "paths", []string{"/healthz", "/readyz"}, "max_age", maxAge)
+	serve(ctx, addr, "Health", mux)
+}
+
+// ready reports why the ingester is not ready, or nil if the last successful
+// collection is recent enough
+func ready(maxAge time.Duration) error {
+	last := lastSuccessTime.Load()
+	if last == 0 {
+		return fmt.Errorf("no successful collection yet")
+	}
+	if age := time.Since(time.Unix(0, last)); age > maxAge {
+		return fmt.Errorf("last successful collection was %s ago, more than %s", age.Round(time.Second), maxAge)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// namespace prefixes every metric exposed by the ingester
+const namespace = "ingester"
+
+// shutdownTimeout bounds how long the metrics server waits for in-flight scrapes on shutdown
+const shutdownTimeout = 5 * time.Second
+
+var (
+	registry = prometheus.NewRegistry()
+
+	lastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_collection_success_timestamp_seconds",
+		Help:      "Unix time of the last collection cycle that completed without errors.",
+	})
+
+	lastDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_collection_duration_seconds",
+		Help:      "Duration of the last collection cycle.",
+	})
+
+	collections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "collections_total",
+		Help:      "Collection cycles run, by result (success or failure).",
+	}, []string{"result"})
+
+	rowsWritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rows_written_total",
+		Help:      "Rows written to storage, by API proxy.",
+	}, []string{"api_proxy"})
+
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "query_duration_seconds",
+		Help:      "Time spent collecting metrics from Prometheus for one API proxy or batch, by query type.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"type"})
+
+	queryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "query_errors_total",
+		Help:      "Failed Prometheus collections, by API proxy.",
+	}, []string{"api_proxy"})
+
+	storageErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "storage_errors_total",
+		Help:      "Failed writes to storage, by API proxy.",
+	}, []string{"api_proxy"})
+
+	backfillProgress = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "backfill_progress_ratio",
+		Help:      "Share of the range batches of the current backfill processed so far, by API proxy (0 to 1).",
+	}, []string{"api_proxy"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		lastSuccess,
+		lastDuration,
+		collections,
+		rowsWritten,
+		queryDuration,
+		queryErrors,
+		storageErrors,
+		backfillProgress,
+	)
+}
+
+// ObserveCollection records the outcome and duration of a collection cycle
+func ObserveCollection(duration time.Duration, err error) {
+	lastDuration.Set(duration.Seconds())
+	if err != nil {
+		collections.WithLabelValues("failure").Inc()
+		return
+	}
+	collections.WithLabelValues("success").Inc()
+	lastSuccess.SetToCurrentTime()
+	lastSuccessTime.Store(time.Now().UnixNano())
+}
+
+// ObserveQuery records the duration of collecting one API proxy or batch;
+// queryType is "instant" or "range"
+func ObserveQuery(queryType string, duration time.Duration) {
+	queryDuration.WithLabelValues(queryType).Observe(duration.Seconds())
+}
+
+// AddRowsWritten records rows written to storage for an API proxy
+func AddRowsWritten(apiProxy string, rows int) {
+	rowsWritten.WithLabelValues(apiProxy).Add(float64(rows))
+}
+
+// IncQueryErrors records a failed Prometheus collection for an API proxy
+func IncQueryErrors(apiProxy string) {
+	queryErrors.WithLabelValues(apiProxy).Inc()
+}
+
+// IncStorageErrors records a failed write to storage for an API proxy
+func IncStorageErrors(apiProxy string) {
+	storageErrors.WithLabelValues(apiProxy).Inc()
+}
+
+// SetBackfillProgress records that done of total range batches of an API
+// proxy were processed
+func SetBackfillProgress(apiProxy string, done, total int) {
+	if total > 0 {
+		backfillProgress.WithLabelValues(apiProxy).Set(float64(done) / float64(total))
+	}
+}
+
+// Serve exposes the ingester's own metrics on addr at /metrics until ctx is
+// cancelled. It returns immediately; listen errors are logged.
+func Serve(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry}))
+
+	slog.Info("Serving ingester metrics", "address", addr, "path", "/metrics")
+	serve(ctx, addr, "Metrics", mux)
+}
+
+// serve runs an HTTP server for handler on addr in the background and shuts
+// it down when ctx is cancelled; name identifies the server in logs
+func serve(ctx context.Context, addr, name string, handler http.Handler) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error(name+" server failed", "address", addr, "error", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+}
@@ -0,0 +1,87 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// defaultServiceName is the service.name of the spans unless configured or set
+// through OTEL_SERVICE_NAME
+const defaultServiceName = "go-duckdb-ingester"
+
+// tracer creates the ingester's spans. Until StartTracing installs an exporter
+// the global provider is a no-op, so spans cost next to nothing.
+var tracer = otel.Tracer("github.com/kiquetal/go-duckdb-ingester")
+
+// StartTracing exports spans over OTLP/HTTP to endpoint, or to the endpoint in
+// the standard OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT
+// environment variables when endpoint is empty. Without any endpoint tracing
+// stays disabled. The returned function flushes the buffered spans and stops
+// the exporter.
+func StartTracing(ctx context.Context, endpoint, serviceName string) (func(), error) {
+	if endpoint == "" && os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func() {}, nil
+	}
+
+	// Other exporter settings, e.g. headers, come from the OTEL_EXPORTER_OTLP_*
+	// environment variables
+	var opts []otlptracehttp.Option
+	if endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+	}
+
+	if serviceName == "" && os.Getenv("OTEL_SERVICE_NAME") == "" {
+		serviceName = defaultServiceName
+	}
+	res := resource.Default()
+	if serviceName != "" {
+		res, err = resource.Merge(res, resource.NewSchemaless(attribute.String("service.name", serviceName)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to build trace resource: %w", err)
+		}
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		slog.Warn("Failed to export traces", "error", err)
+	}))
+	slog.Info("Exporting traces", "endpoint", endpoint)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			slog.Error("Failed to flush traces", "error", err)
+		}
+	}, nil
+}
+
+// StartSpan starts a span named name as a child of the span in ctx, if any
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// EndSpan adds attrs to span and ends it, marking it failed when err is not nil
+func EndSpan(span trace.Span, err error, attrs ...attribute.KeyValue) {
+	span.SetAttributes(attrs...)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,230 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// APIProxyConfig is one entry of apiProxies. In YAML it is either a bare name
+// or a mapping with the name and metric overrides for that API proxy.
+type APIProxyConfig struct {
+	// Name of the API proxy, used as its partition directory (app=<name>)
+	Name string `yaml:"name"`
+
+	// Metrics adjusts prometheus.metrics for this API proxy. An entry named
+	// like a global metric overrides the fields it sets, e.g. the query or
+	// enabled: false to skip it; an entry with a new name adds a metric.
+	// Without overrides the API proxy collects the global metrics.
+	Metrics []MetricConfig `yaml:"metrics,omitempty"`
+}
+
+// UnmarshalYAML accepts both a bare API proxy name and a mapping
+func (p *APIProxyConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*p = APIProxyConfig{Name: value.Value}
+		return nil
+	}
+
+	// The plain type avoids recursing into this method
+	type plain APIProxyConfig
+	return value.Decode((*plain)(p))
+}
+
+// MarshalYAML writes API proxies without overrides back as bare names
+func (p APIProxyConfig) MarshalYAML() (interface{}, error) {
+	if len(p.Metrics) == 0 {
+		return p.Name, nil
+	}
+	type plain APIProxyConfig
+	return plain(p), nil
+}
+
+// APIProxyNames returns the names of the configured API proxies in order
+func (c *Config) APIProxyNames() []string {
+	names := make([]string, 0, len(c.APIProxies))
+	for _, proxy := range c.APIProxies {
+		names = append(names, proxy.Name)
+	}
+	return names
+}
+
+// MetricsFor returns the enabled metrics of an API proxy: its resolved
+// overrides if it has any, and the global metrics otherwise
+func (p PrometheusConfig) MetricsFor(apiProxy string) []MetricConfig {
+	metrics, ok := p.ProxyMetrics[apiProxy]
+	if !ok {
+		return p.EnabledMetrics()
+	}
+	return enabledMetrics(metrics)
+}
+
+// AllMetrics returns the metrics enabled for any API proxy, the global ones
+// first, each name once
+func (p PrometheusConfig) AllMetrics() []MetricConfig {
+	all := p.EnabledMetrics()
+	seen := make(map[string]bool, len(all))
+	for _, metric := range all {
+		seen[metric.Name] = true
+	}
+
+	proxies := make([]string, 0, len(p.ProxyMetrics))
+	for proxy := range p.ProxyMetrics {
+		proxies = append(proxies, proxy)
+	}
+	// Map order is random; sort so path templates are built the same way every run
+	sort.Strings(proxies)
+
+	for _, proxy := range proxies {
+		for _, metric := range enabledMetrics(p.ProxyMetrics[proxy]) {
+			if !seen[metric.Name] {
+				seen[metric.Name] = true
+				all = append(all, metric)
+			}
+		}
+	}
+	return all
+}
+
+// resolveProxyMetrics applies the metric overrides of every API proxy that has
+// any to the global metrics, keyed by API proxy name
+func resolveProxyMetrics(proxies []APIProxyConfig, global []MetricConfig) map[string][]MetricConfig {
+	var resolved map[string][]MetricConfig
+	for _, proxy := range proxies {
+		if len(proxy.Metrics) == 0 {
+			continue
+		}
+
+		metrics := append([]MetricConfig(nil), global...)
+		for _, override := range proxy.Metrics {
+			i := indexMetric(metrics, override.Name)
+			if i < 0 {
+				if override.ProxyLabel == "" {
+					override.ProxyLabel = DefaultProxyLabel
+				}
+				metrics = append(metrics, override)
+				continue
+			}
+			metrics[i] = metrics[i].withOverride(override)
+		}
+
+		if resolved == nil {
+			resolved = make(map[string][]MetricConfig)
+		}
+		resolved[proxy.Name] = metrics
+	}
+	return resolved
+}
+
+// withOverride returns m with the fields set in override replacing its own
+func (m MetricConfig) withOverride(override MetricConfig) MetricConfig {
+	if override.Enabled != nil {
+		m.Enabled = override.Enabled
+	}
+	if override.Query != "" {
+		m.Query = override.Query
+	}
+	if override.ProxyLabel != "" {
+		m.ProxyLabel = override.ProxyLabel
+	}
+	if override.Matchers != nil {
+		m.Matchers = override.Matchers
+	}
+	if override.SeparateFile {
+		m.SeparateFile = true
+	}
+	if override.Timeout != 0 {
+		m.Timeout = override.Timeout
+	}
+	if override.LookbackDelta != 0 {
+		m.LookbackDelta = override.LookbackDelta
+	}
+	if override.Labels != nil {
+		m.Labels = override.Labels
+	}
+	if override.Scale != 0 {
+		m.Scale = override.Scale
+	}
+	if override.Offset != 0 {
+		m.Offset = override.Offset
+	}
+	if override.ExpectLabels != nil {
+		m.ExpectLabels = override.ExpectLabels
+	}
+	if override.MissingLabels != "" {
+		m.MissingLabels = override.MissingLabels
+	}
+	if override.MaxSamples != 0 {
+		m.MaxSamples = override.MaxSamples
+	}
+	return m
+}
+
+// indexMetric returns the position of the metric named name, or -1
+func indexMetric(metrics []MetricConfig, name string) int {
+	for i, metric := range metrics {
+		if metric.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// validateProxyOverrides checks the metric overrides of one API proxy entry
+// and the metrics they resolve to
+func validateProxyOverrides(i int, proxy APIProxyConfig, resolved []MetricConfig) error {
+	if len(proxy.Metrics) == 0 {
+		return nil
+	}
+
+	var errs []error
+	seen := make(map[string]bool, len(proxy.Metrics))
+	for j, override := range proxy.Metrics {
+		prefix := fmt.Sprintf("apiProxies[%d].metrics[%d]", i, j)
+		if override.Name == "" {
+			errs = append(errs, fmt.Errorf("%s: name is required", prefix))
+		} else if seen[override.Name] {
+			errs = append(errs, fmt.Errorf("%s: duplicate metric name %q", prefix, override.Name))
+		}
+		seen[override.Name] = true
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	return validateMetrics(fmt.Sprintf("apiProxies[%d] (%s) metrics", i, proxy.Name), resolved)
+}
+
+// validateSeparateFiles checks that every metric is written to its own file
+// for all API proxies collecting it or for none. Output paths are split by
+// metric name alone, so a separateFile override for some proxies cannot be
+// honoured.
+func validateSeparateFiles(p PrometheusConfig, proxies []APIProxyConfig) error {
+	separate := make(map[string]bool)
+	definedBy := make(map[string]string)
+	var errs []error
+	check := func(where string, metrics []MetricConfig) {
+		for _, metric := range metrics {
+			first, ok := definedBy[metric.Name]
+			if !ok {
+				separate[metric.Name] = metric.SeparateFile
+				definedBy[metric.Name] = where
+				continue
+			}
+			if metric.SeparateFile != separate[metric.Name] {
+				errs = append(errs, fmt.Errorf("%s: metric %q has separateFile %t, but %t in %s; it must be the same for every API proxy",
+					where, metric.Name, metric.SeparateFile, separate[metric.Name], first))
+			}
+		}
+	}
+
+	check("prometheus.metrics", p.EnabledMetrics())
+	for i, proxy := range proxies {
+		if _, ok := p.ProxyMetrics[proxy.Name]; ok {
+			check(fmt.Sprintf("apiProxies[%d] (%s)", i, proxy.Name), p.MetricsFor(proxy.Name))
+		}
+	}
+	return errors.Join(errs...)
+}
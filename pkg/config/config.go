@@ -1,31 +1,179 @@
 package config
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
-	"gopkg.in/yaml.v3"
+	"log/slog"
+	"math"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
 	"time"
+	"unicode"
 )
 
+// apiProxyPlaceholder is substituted for the API proxy when validating query templates
+const apiProxyPlaceholder = "__api_proxy_placeholder__"
+
+// DefaultProxyLabel is the label {{.Selector}} matches the API proxy on by default
+const DefaultProxyLabel = "app"
+
 // Config represents the application configuration
 type Config struct {
-	// Debug mode enables more verbose logging and shorter collection intervals
+	// Debug mode shortens the default collection interval to one minute
 	Debug bool `yaml:"debug"`
 
-	// APIProxies is a list of API proxy names to collect metrics for
-	APIProxies []string `yaml:"apiProxies"`
+	// LogLevel is the minimum level logged: debug, info, warn or error (default info)
+	LogLevel string `yaml:"logLevel,omitempty"`
+
+	// LogFormat selects the log output format: json or text (default json)
+	LogFormat string `yaml:"logFormat,omitempty"`
+
+	// OneShot runs a single collection and exits instead of collecting periodically
+	OneShot bool `yaml:"oneShot,omitempty"`
+
+	// FailFast aborts a collection cycle at the first query or storage error
+	// instead of collecting the remaining API proxies and batches
+	FailFast bool `yaml:"failFast,omitempty"`
+
+	// CollectionInterval is how often metrics are collected (default 24h)
+	CollectionInterval time.Duration `yaml:"collectionInterval,omitempty"`
+
+	// APIProxies is a list of API proxies to collect metrics for, each a bare
+	// name or a name with metric overrides
+	APIProxies []APIProxyConfig `yaml:"apiProxies"`
+
+	// MaxConcurrentProxies is the number of API proxies collected in parallel (default 1)
+	MaxConcurrentProxies int `yaml:"maxConcurrentProxies,omitempty"`
+
+	// SoftMemoryLimit is the Go runtime's soft memory limit in bytes, which
+	// makes garbage collection more frequent as the heap approaches it
+	// (0 keeps the GOMEMLIMIT environment variable or no limit)
+	SoftMemoryLimit int64 `yaml:"softMemoryLimit,omitempty"`
 
 	// Prometheus configuration
 	Prometheus PrometheusConfig `yaml:"prometheus"`
 
+	// Sources lists several Prometheus servers to collect from in one run. Each
+	// source has its own connection settings; metrics and query settings are
+	// shared from Prometheus. When set, prometheus.url must be left empty.
+	Sources []SourceConfig `yaml:"sources,omitempty"`
+
 	// Storage configuration
 	Storage StorageConfig `yaml:"storage"`
 
+	// Downsample aggregates range samples into fixed time buckets before storage
+	Downsample DownsampleConfig `yaml:"downsample,omitempty"`
+
+	// Rollup writes a min/max/avg/count summary of every series per range batch
+	Rollup RollupConfig `yaml:"rollup,omitempty"`
+
+	// Processors transform the collected samples in order before rollups,
+	// downsampling and storage
+	Processors []ProcessorConfig `yaml:"processors,omitempty"`
+
+	// Telemetry configures the ingester's own /metrics endpoint
+	Telemetry TelemetryConfig `yaml:"telemetry,omitempty"`
+
+	// Health configures the /healthz and /readyz probe endpoints
+	Health HealthConfig `yaml:"health,omitempty"`
+
+	// Tracing exports OpenTelemetry spans for collections, queries and writes
+	Tracing TracingConfig `yaml:"tracing,omitempty"`
+
+	// CheckpointFile records the range batches already written so an interrupted
+	// backfill can resume; empty disables checkpointing
+	CheckpointFile string `yaml:"checkpointFile,omitempty"`
+
 	// StartTime is the start time for range queries (set via command line)
 	StartTime time.Time `yaml:"-"`
 
 	// EndTime is the end time for range queries (set via command line)
 	EndTime time.Time `yaml:"-"`
+
+	// EvaluationTime pins the time instant queries are evaluated at; zero means
+	// the current time (set via command line)
+	EvaluationTime time.Time `yaml:"-"`
+
+	// DryRun logs what would be collected and written without querying or writing (set via command line)
+	DryRun bool `yaml:"-"`
+}
+
+// Supported log formats
+const (
+	LogFormatJSON = "json"
+	LogFormatText = "text"
+)
+
+// DownsampleConfig contains settings for aggregating range samples before storage
+type DownsampleConfig struct {
+	// Interval is the bucket width, e.g. 5m (0 disables downsampling)
+	Interval time.Duration `yaml:"interval,omitempty"`
+
+	// Function aggregates the samples in a bucket: avg, sum, min, max or last (default avg)
+	Function string `yaml:"function,omitempty"`
+}
+
+// Supported downsample functions
+const (
+	DownsampleAvg  = "avg"
+	DownsampleSum  = "sum"
+	DownsampleMin  = "min"
+	DownsampleMax  = "max"
+	DownsampleLast = "last"
+)
+
+// ProcessorConfig configures one entry of the processors chain; exactly one
+// processor must be set
+type ProcessorConfig struct {
+	// RenameLabels renames the labels that are its keys to its values
+	RenameLabels map[string]string `yaml:"renameLabels,omitempty"`
+}
+
+// RollupConfig contains settings for summarizing each series per range batch
+type RollupConfig struct {
+	// Enabled turns rollups on
+	Enabled bool `yaml:"enabled,omitempty"`
+
+	// OutputDir is the root of the rollup files, laid out by storage.pathTemplate
+	// like storage.outputDir; required for Parquet storage. DuckDB storage
+	// appends rollup rows to the metrics table instead.
+	OutputDir string `yaml:"outputDir,omitempty"`
+}
+
+// TelemetryConfig contains settings for the ingester's own metrics endpoint
+type TelemetryConfig struct {
+	// Disabled turns off the /metrics HTTP server
+	Disabled bool `yaml:"disabled,omitempty"`
+
+	// ListenAddress is the address the /metrics server listens on (default ":9101")
+	ListenAddress string `yaml:"listenAddress,omitempty"`
+}
+
+// HealthConfig contains settings for the liveness and readiness probes
+type HealthConfig struct {
+	// ListenAddress is the address the probe server listens on (e.g. ":8081");
+	// the probes are disabled when empty
+	ListenAddress string `yaml:"listenAddress,omitempty"`
+}
+
+// TracingConfig contains settings for exporting OpenTelemetry traces
+type TracingConfig struct {
+	// Endpoint is the OTLP/HTTP URL spans are sent to, e.g.
+	// "http://otel-collector:4318". When empty, the standard
+	// OTEL_EXPORTER_OTLP_ENDPOINT and OTEL_EXPORTER_OTLP_TRACES_ENDPOINT
+	// environment variables are used; without either, tracing is disabled.
+	Endpoint string `yaml:"endpoint,omitempty"`
+
+	// ServiceName is the service.name of the spans (default OTEL_SERVICE_NAME,
+	// then "go-duckdb-ingester")
+	ServiceName string `yaml:"serviceName,omitempty"`
 }
 
 // PrometheusConfig contains Prometheus connection settings
@@ -33,21 +181,196 @@ type PrometheusConfig struct {
 	// URL is the Prometheus server URL
 	URL string `yaml:"url"`
 
-	// Timeout for Prometheus API requests
+	// SourceName identifies this Prometheus server in the stored source column
+	// (default: the host of URL)
+	SourceName string `yaml:"sourceName,omitempty"`
+
+	// Timeout for Prometheus API requests, also sent to the server as the query
+	// evaluation timeout
 	Timeout time.Duration `yaml:"timeout"`
 
+	// BatchTimeout bounds the total time spent collecting all metrics of one API
+	// proxy in a cycle or range batch; queries still running when it elapses are
+	// cancelled (0 disables the limit)
+	BatchTimeout time.Duration `yaml:"batchTimeout,omitempty"`
+
+	// LookbackDelta is how far back queries look for the latest sample of a
+	// series; 0 uses the server default (5m)
+	LookbackDelta time.Duration `yaml:"lookbackDelta,omitempty"`
+
 	// BasicAuth credentials if required
 	Username string `yaml:"username,omitempty"`
 	Password string `yaml:"password,omitempty"`
 
+	// BearerToken is sent as an Authorization: Bearer header if set
+	BearerToken string `yaml:"bearerToken,omitempty"`
+
+	// BearerTokenFile is read for the bearer token and periodically re-read to pick up rotations
+	BearerTokenFile string `yaml:"bearerTokenFile,omitempty"`
+
+	// TLS settings for HTTPS endpoints
+	TLS TLSConfig `yaml:"tls,omitempty"`
+
+	// HTTPProxy is the URL of the proxy Prometheus requests are sent through,
+	// shared by all sources. When empty, HTTP_PROXY, HTTPS_PROXY and NO_PROXY apply.
+	HTTPProxy string `yaml:"httpProxy,omitempty"`
+
 	// Metrics is a list of Prometheus metrics to collect
 	Metrics []MetricConfig `yaml:"metrics"`
 
+	// ProxyMetrics holds the metrics of the API proxies with overrides in
+	// apiProxies, resolved against Metrics by LoadConfig
+	ProxyMetrics map[string][]MetricConfig `yaml:"-"`
+
+	// DiscoverProxies adds the API proxies found in Prometheus to apiProxies at
+	// the start of every collection
+	DiscoverProxies ProxyDiscoveryConfig `yaml:"discoverProxies,omitempty"`
+
+	// QueryMode selects how range data is fetched: "query" uses the HTTP query API,
+	// "remote_read" streams raw samples via the remote read endpoint
+	QueryMode string `yaml:"queryMode,omitempty"`
+
 	// UseRangeQuery determines whether to use range queries
 	UseRangeQuery bool `yaml:"useRangeQuery,omitempty"`
 
 	// RangeStep is the step interval for range queries (e.g., "1h")
 	RangeStep time.Duration `yaml:"rangeStep,omitempty"`
+
+	// AlignStep starts each range query at a multiple of RangeStep since the
+	// Unix epoch, so samples fall on wall-clock boundaries such as full hours
+	// instead of steps counted from the batch start. Steps of a day or more
+	// require storage.timezone UTC.
+	AlignStep bool `yaml:"alignStep,omitempty"`
+
+	// BatchDuration is the size of the windows a range query is split into (default 6h)
+	BatchDuration time.Duration `yaml:"batchDuration,omitempty"`
+
+	// PipelineDepth is the number of queried range batches that may wait for
+	// their write while the next batch is queried (0 = query each batch after
+	// the previous one is written)
+	PipelineDepth int `yaml:"pipelineDepth,omitempty"`
+
+	// MaxConcurrentQueries caps the number of in-flight Prometheus queries (0 means unlimited)
+	MaxConcurrentQueries int `yaml:"maxConcurrentQueries,omitempty"`
+
+	// QueriesPerSecond caps the rate of requests sent to each Prometheus server,
+	// across all API proxies, metrics and retries (0 means unlimited)
+	QueriesPerSecond float64 `yaml:"queriesPerSecond,omitempty"`
+
+	// MaxRetries is the number of times a failed query is retried (0 disables retries)
+	MaxRetries int `yaml:"maxRetries,omitempty"`
+
+	// RetryBackoff is the initial delay between retries, doubled on each attempt
+	// up to one minute
+	RetryBackoff time.Duration `yaml:"retryBackoff,omitempty"`
+
+	// MaxRetryAfter caps the wait before retrying a request rejected with 429
+	// Too Many Requests, whose Retry-After header is honoured up to this limit
+	MaxRetryAfter time.Duration `yaml:"maxRetryAfter,omitempty"`
+
+	// MaxThrottledRetries is the number of times a request rejected with 429
+	// Too Many Requests is retried, separately from MaxRetries (default 5)
+	MaxThrottledRetries int `yaml:"maxThrottledRetries,omitempty"`
+
+	// WarningsAsErrors fails a metric's query when Prometheus returns warnings
+	// for it instead of only logging them
+	WarningsAsErrors bool `yaml:"warningsAsErrors,omitempty"`
+
+	// RecordCollectedAt stores the time each query ran in the collected_at
+	// column, which is NULL otherwise
+	RecordCollectedAt bool `yaml:"recordCollectedAt,omitempty"`
+
+	// NonFiniteValues selects how NaN and ±Inf sample values are handled:
+	// "drop" (default), "zero" or "keep"
+	NonFiniteValues string `yaml:"nonFiniteValues,omitempty"`
+
+	// MaxSamples caps the samples one metric's query may return, guarding
+	// against accidental high-cardinality queries (0 = no limit). Metrics may
+	// override it.
+	MaxSamples int `yaml:"maxSamples,omitempty"`
+
+	// MaxSamplesAction is what happens to a result over its limit: "error"
+	// (default) fails the metric's query and "truncate" keeps the first
+	// samples up to the limit; both log the sample count
+	MaxSamplesAction string `yaml:"maxSamplesAction,omitempty"`
+}
+
+// ProxyDiscoveryConfig contains settings for discovering API proxies from the
+// values of a label
+type ProxyDiscoveryConfig struct {
+	// Enabled turns discovery on
+	Enabled bool `yaml:"enabled,omitempty"`
+
+	// Label holds the API proxy name (default "app")
+	Label string `yaml:"label,omitempty"`
+
+	// Match is a regular expression a label value must fully match to be
+	// collected (default: every value)
+	Match string `yaml:"match,omitempty"`
+
+	// Selectors are series selectors passed as match[], limiting discovery to
+	// proxies with matching series (default: any series carrying the label)
+	Selectors []string `yaml:"selectors,omitempty"`
+
+	// Lookback limits discovery to proxies with series in the last Lookback
+	// (default: the server's default range); range backfills use their own range
+	Lookback time.Duration `yaml:"lookback,omitempty"`
+
+	// Limit caps the number of discovered proxies, keeping the first in sorted
+	// order (0 = no limit)
+	Limit int `yaml:"limit,omitempty"`
+}
+
+// Supported Prometheus query modes
+const (
+	QueryModeQuery      = "query"
+	QueryModeRemoteRead = "remote_read"
+)
+
+// Supported policies for non-finite (NaN, ±Inf) sample values
+const (
+	NonFiniteDrop = "drop"
+	NonFiniteZero = "zero"
+	NonFiniteKeep = "keep"
+)
+
+// Actions of prometheus.maxSamplesAction
+const (
+	MaxSamplesError    = "error"
+	MaxSamplesTruncate = "truncate"
+)
+
+// SourceConfig contains the connection settings for one of several Prometheus servers
+type SourceConfig struct {
+	// Name identifies the source in stored metrics and output paths
+	Name string `yaml:"name"`
+
+	// URL is the Prometheus server URL
+	URL string `yaml:"url"`
+
+	// BasicAuth credentials if required
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+
+	// Bearer token auth, as for PrometheusConfig
+	BearerToken     string `yaml:"bearerToken,omitempty"`
+	BearerTokenFile string `yaml:"bearerTokenFile,omitempty"`
+
+	// TLS settings for HTTPS endpoints
+	TLS TLSConfig `yaml:"tls,omitempty"`
+}
+
+// TLSConfig contains TLS settings for connecting to Prometheus
+type TLSConfig struct {
+	// CACertFile is a PEM bundle used to verify the server certificate
+	CACertFile string `yaml:"caCertFile,omitempty"`
+
+	// ClientCertFile and ClientKeyFile enable mutual TLS
+	ClientCertFile string `yaml:"clientCertFile,omitempty"`
+	ClientKeyFile  string `yaml:"clientKeyFile,omitempty"`
+
+	// InsecureSkipVerify disables server certificate verification (development only)
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify,omitempty"`
 }
 
 // MetricConfig defines a specific Prometheus metric to collect
@@ -55,41 +378,391 @@ type MetricConfig struct {
 	// Name of the metric
 	Name string `yaml:"name"`
 
-	// Query is the PromQL query to execute
+	// Enabled set to false skips the metric without removing its definition (default true)
+	Enabled *bool `yaml:"enabled,omitempty"`
+
+	// Query is the PromQL query to execute, as a Go template where
+	// {{.APIProxy}} is replaced with the (escaped) API proxy name and
+	// {{.Selector}} with the label matchers built from ProxyLabel and Matchers
 	Query string `yaml:"query"`
 
+	// ProxyLabel is the label {{.Selector}} matches the API proxy on (default "app")
+	ProxyLabel string `yaml:"proxyLabel,omitempty"`
+
+	// Matchers are additional label="value" matchers rendered by {{.Selector}},
+	// e.g. to scope a query by environment and region
+	Matchers map[string]string `yaml:"matchers,omitempty"`
+
+	// SeparateFile writes this metric to its own metric=<name> directory next
+	// to the shared file, so scans of other metrics skip its pages (Parquet only)
+	SeparateFile bool `yaml:"separateFile,omitempty"`
+
+	// Timeout overrides prometheus.timeout for this metric's queries
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+
+	// LookbackDelta overrides prometheus.lookbackDelta for this metric's
+	// queries, e.g. to find samples of sparse series
+	LookbackDelta time.Duration `yaml:"lookbackDelta,omitempty"`
+
 	// Labels to include with the metric
 	Labels []string `yaml:"labels,omitempty"`
+
+	// Scale multiplies every sample value before it is stored, e.g. 1e-9 for
+	// bytes to gigabytes or 1000 for seconds to milliseconds (default 1; 0 is
+	// treated as 1)
+	Scale float64 `yaml:"scale,omitempty"`
+
+	// Offset is added to every sample value after Scale
+	Offset float64 `yaml:"offset,omitempty"`
+
+	// ExpectLabels are labels every returned series must carry, e.g. the
+	// grouping labels of a sum by (...) query, to catch a forgotten by clause
+	ExpectLabels []string `yaml:"expectLabels,omitempty"`
+
+	// MissingLabels is what happens to samples lacking an ExpectLabels label:
+	// "keep" (default) stores them and "drop" skips them; both log a warning
+	MissingLabels string `yaml:"missingLabels,omitempty"`
+
+	// MaxSamples overrides prometheus.maxSamples for this metric's queries
+	MaxSamples int `yaml:"maxSamples,omitempty"`
+}
+
+// ConvertValue applies Scale and Offset to a sample value
+func (m MetricConfig) ConvertValue(value float64) float64 {
+	if m.Scale != 0 {
+		value *= m.Scale
+	}
+	return value + m.Offset
+}
+
+// IsEnabled reports whether the metric is collected
+func (m MetricConfig) IsEnabled() bool {
+	return m.Enabled == nil || *m.Enabled
 }
 
-// StorageConfig contains settings for Parquet file storage
+// EnabledMetrics returns the metrics that are collected, in configuration order
+func (p PrometheusConfig) EnabledMetrics() []MetricConfig {
+	return enabledMetrics(p.Metrics)
+}
+
+// enabledMetrics returns the metrics of a list that are collected
+func enabledMetrics(metrics []MetricConfig) []MetricConfig {
+	enabled := make([]MetricConfig, 0, len(metrics))
+	for _, metric := range metrics {
+		if metric.IsEnabled() {
+			enabled = append(enabled, metric)
+		}
+	}
+	return enabled
+}
+
+// DisabledMetrics returns the names of the metrics configured with enabled: false
+func (p PrometheusConfig) DisabledMetrics() []string {
+	return disabledMetrics(p.Metrics)
+}
+
+// DisabledMetricsFor returns the names of the metrics disabled for an API
+// proxy, taking its overrides into account
+func (p PrometheusConfig) DisabledMetricsFor(apiProxy string) []string {
+	metrics, ok := p.ProxyMetrics[apiProxy]
+	if !ok {
+		return p.DisabledMetrics()
+	}
+	return disabledMetrics(metrics)
+}
+
+// disabledMetrics returns the names of the metrics of a list that are not collected
+func disabledMetrics(metrics []MetricConfig) []string {
+	var disabled []string
+	for _, metric := range metrics {
+		if !metric.IsEnabled() {
+			disabled = append(disabled, metric.Name)
+		}
+	}
+	return disabled
+}
+
+// Supported storage backends
+const (
+	StorageTypeParquet = "parquet"
+	StorageTypeDuckDB  = "duckdb"
+)
+
+// Supported file formats of the file storage backend
+const (
+	FormatParquet = "parquet"
+	FormatJSONL   = "jsonl"
+	FormatCSV     = "csv"
+)
+
+// Policies of a metric's missingLabels
+const (
+	MissingLabelsKeep = "keep"
+	MissingLabelsDrop = "drop"
+)
+
+// Row layouts of storage.layout
+const (
+	LayoutPoint  = "point"
+	LayoutSeries = "series"
+)
+
+// Units of storage.timestampPrecision
+const (
+	PrecisionMillis = "millis"
+	PrecisionMicros = "micros"
+	PrecisionNanos  = "nanos"
+)
+
+// Encodings of storage.columnEncoding
+const (
+	EncodingDictionary = "dictionary"
+	EncodingPlain      = "plain"
+)
+
+// StorageConfig contains settings for metrics storage
 type StorageConfig struct {
-	// OutputDir is the directory where Parquet files will be stored
+	// Type selects the storage backend ("parquet" or "duckdb")
+	Type string `yaml:"type,omitempty"`
+
+	// Format is the file format written by the "parquet" (file) backend:
+	// "parquet" (default), "jsonl" or "csv"
+	Format string `yaml:"format,omitempty"`
+
+	// DuckDBPath is the database file used by the duckdb backend
+	DuckDBPath string `yaml:"duckdbPath,omitempty"`
+
+	// OutputDir is the directory where Parquet files will be stored.
+	// An s3://bucket/prefix location writes files to S3 instead.
 	OutputDir string `yaml:"outputDir"`
 
-	// Compression algorithm to use (snappy, gzip, etc.)
+	// S3 connection settings used when OutputDir is an s3:// location
+	S3 S3Config `yaml:"s3,omitempty"`
+
+	// PathTemplate is a Go template for output file paths relative to OutputDir.
+	// Available fields: .Year .Month .Day .App .Source .MetricName .BatchStart
+	// .BatchEnd .RunID (default DefaultPathTemplate)
+	PathTemplate string `yaml:"pathTemplate,omitempty"`
+
+	// Compression algorithm to use (snappy, gzip, zstd, lz4, uncompressed)
 	Compression string `yaml:"compression"`
 
+	// CompressionLevel tunes gzip (1-9) and zstd (1-22) compression; 0 keeps the
+	// codec default and other codecs ignore it
+	CompressionLevel int `yaml:"compressionLevel,omitempty"`
+
 	// RowGroupSize controls the Parquet row group size
 	RowGroupSize int64 `yaml:"rowGroupSize"`
 
+	// PromoteLabels lists labels written as their own Parquet columns instead of
+	// inside the generic labels list (Parquet storage only)
+	PromoteLabels []string `yaml:"promoteLabels,omitempty"`
+
+	// ApiProxyLabelKeys are the labels tried in order for the api_proxy column;
+	// a sample with none of them gets the API proxy it was collected for
+	// (default ["apiproxy", "app"]; set to [] to always use the proxy name)
+	ApiProxyLabelKeys []string `yaml:"apiProxyLabelKeys"`
+
+	// IncludeLabels, when set, limits the labels stored with each sample to
+	// these names; promoted labels keep their own columns either way
+	IncludeLabels []string `yaml:"includeLabels,omitempty"`
+
+	// ExcludeLabels are labels never stored, even when listed in
+	// IncludeLabels (default ["__name__"]; set to [] to keep every label)
+	ExcludeLabels []string `yaml:"excludeLabels"`
+
+	// DictionaryEncoding writes the string columns dictionary encoded, which
+	// shrinks columns with few distinct values; by default they are written
+	// plain (Parquet format only)
+	DictionaryEncoding bool `yaml:"dictionaryEncoding,omitempty"`
+
+	// ColumnEncoding overrides DictionaryEncoding for single string columns
+	// with "dictionary" or "plain". Keys are metric_name, original_name,
+	// api_proxy, source, date, labels (its keys and values) or a promoted label.
+	ColumnEncoding map[string]string `yaml:"columnEncoding,omitempty"`
+
+	// Layout is the Parquet row layout: "point" (default) writes one row per
+	// sample, "series" one row per series and file with the samples in
+	// timestamps and values list columns (Parquet format only)
+	Layout string `yaml:"layout,omitempty"`
+
+	// TimestampPrecision is the unit of the timestamp and timestamps columns:
+	// "millis" (default), "micros" or "nanos" (Parquet format only)
+	TimestampPrecision string `yaml:"timestampPrecision,omitempty"`
+
+	// PageSize controls the Parquet page size within a row group
+	PageSize int64 `yaml:"pageSize,omitempty"`
+
+	// MaxOpenFiles caps the number of output files open for writing, across
+	// all API proxies and pipelined batches. The least recently used idle
+	// local file is closed to make room and reopened on its next write
+	// (0 means unlimited)
+	MaxOpenFiles int `yaml:"maxOpenFiles,omitempty"`
+
+	// CombineProxies writes the metrics of all API proxies for a day or batch into
+	// a single file instead of one file per app= partition
+	CombineProxies bool `yaml:"combineProxies,omitempty"`
+
+	// Streaming writes range batch rows to storage as queries return instead of
+	// buffering the whole batch in memory first
+	Streaming bool `yaml:"streaming,omitempty"`
+
+	// WriteSidecar writes a <file>.meta.json next to each Parquet file with its
+	// row count, byte size, timestamp range and SHA-256 checksum
+	WriteSidecar bool `yaml:"writeSidecar,omitempty"`
+
+	// WriteManifest maintains a manifest.json in every day= directory listing
+	// each file's path, row count, byte size and timestamp range, updated at
+	// the end of every collection cycle
+	WriteManifest bool `yaml:"writeManifest,omitempty"`
+
+	// WriteRunSummary writes a run-summary-<run id>.json to OutputDir after
+	// every collection cycle with the rows, durations and errors per API proxy
+	// and metric
+	WriteRunSummary bool `yaml:"writeRunSummary,omitempty"`
+
+	// SuccessMarker names an empty file written into every partition directory
+	// once all batches written to it in a cycle succeeded and its day has
+	// ended in Timezone, e.g. "_SUCCESS"; a failed batch removes it instead.
+	// Empty disables markers.
+	SuccessMarker string `yaml:"successMarker,omitempty"`
+
+	// Timezone is the IANA zone, e.g. "Europe/Berlin", whose calendar days the
+	// year=/month=/day= partitions and the date column follow (default "UTC")
+	Timezone string `yaml:"timezone,omitempty"`
+
+	// Location is Timezone loaded by LoadConfig
+	Location *time.Location `yaml:"-"`
+
+	// DateFormat is the Go time layout of the date column, e.g. "20060102" or
+	// "2006-01-02T15". It must contain the year, month and day so every value
+	// falls in one year=/month=/day= partition (default "2006-01-02").
+	DateFormat string `yaml:"dateFormat,omitempty"`
+
+	// InvocationID is the UUID the ingester generates at startup, written to
+	// the invocation_id column of every row it collects
+	InvocationID string `yaml:"-"`
+
+	// DirMode and FileMode are the octal permissions of the directories and
+	// files written on local disk, e.g. "0775" and "0664" for group-writable
+	// output (default "0755" and "0644"). They are applied regardless of the
+	// process umask.
+	DirMode  string `yaml:"dirMode,omitempty"`
+	FileMode string `yaml:"fileMode,omitempty"`
+
+	// DirPerm and FilePerm are DirMode and FileMode parsed by LoadConfig
+	DirPerm  os.FileMode `yaml:"-"`
+	FilePerm os.FileMode `yaml:"-"`
+
+	// OverwriteExisting re-collects range batches whose Parquet files already
+	// exist; by default such batches are skipped without querying Prometheus
+	OverwriteExisting bool `yaml:"overwriteExisting,omitempty"`
+
 	// WriteStopTimeout is the timeout duration for finalizing Parquet files
 	WriteStopTimeout time.Duration `yaml:"writeStopTimeout"`
+
+	// WriteRetries is the number of times a batch whose file failed to be
+	// written or finalized is written again (0 disables retries). Streamed
+	// batches are not retried.
+	WriteRetries int `yaml:"writeRetries,omitempty"`
+
+	// WriteRetryBackoff is the initial delay between write retries, doubled
+	// on each attempt up to one minute (default 1s)
+	WriteRetryBackoff time.Duration `yaml:"writeRetryBackoff,omitempty"`
+
+	// FailedDir is a local directory the records of a batch that could not be
+	// written are saved to as JSON lines, <path>.failed.jsonl, for re-ingesting
+	// later. Empty drops them.
+	FailedDir string `yaml:"failedDir,omitempty"`
+}
+
+// DefaultPathTemplate is the Hive-style layout
+// year=YYYY/month=MM/day=DD/[source=NAME/]app=APP/metrics[_HHMMSS_HHMMSS].parquet,
+// where the batch times are only present for range batches
+const DefaultPathTemplate = `year={{.Year}}/month={{.Month}}/day={{.Day}}/` +
+	`{{with .Source}}source={{.}}/{{end}}app={{.App}}/` +
+	`metrics{{if not .BatchStart.IsZero}}_{{.BatchStart.Format "150405"}}_{{.BatchEnd.Format "150405"}}{{end}}.parquet`
+
+// DefaultCombinedPathTemplate is the layout used when CombineProxies is set:
+// DefaultPathTemplate without the app= level
+const DefaultCombinedPathTemplate = `year={{.Year}}/month={{.Month}}/day={{.Day}}/` +
+	`{{with .Source}}source={{.}}/{{end}}` +
+	`metrics{{if not .BatchStart.IsZero}}_{{.BatchStart.Format "150405"}}_{{.BatchEnd.Format "150405"}}{{end}}.parquet`
+
+// S3Config contains settings for writing Parquet files to S3
+type S3Config struct {
+	// Region of the bucket; falls back to the AWS environment/shared config
+	Region string `yaml:"region,omitempty"`
+
+	// Endpoint overrides the S3 endpoint (e.g., for MinIO or other S3-compatible stores)
+	Endpoint string `yaml:"endpoint,omitempty"`
+
+	// ForcePathStyle uses path-style addressing, required by most S3-compatible stores
+	ForcePathStyle bool `yaml:"forcePathStyle,omitempty"`
+
+	// Static credentials; the default AWS credential chain is used when empty
+	AccessKeyID     string `yaml:"accessKeyId,omitempty"`
+	SecretAccessKey string `yaml:"secretAccessKey,omitempty"`
+	SessionToken    string `yaml:"sessionToken,omitempty"`
+}
+
+// LoadConfig loads the configuration from one or more YAML files, directories
+// of them or http(s) URLs, merged in order as described by readMerged. The merged
+// configuration is validated once.
+func LoadConfig(paths ...string) (*Config, error) {
+	return LoadConfigWithMetrics("", paths...)
 }
 
-// LoadConfig loads the configuration from a YAML file
-func LoadConfig(path string) (*Config, error) {
-	data, err := os.ReadFile(path)
+// LoadConfigWithMetrics is LoadConfig with the metrics of metricsFile appended
+// to prometheus.metrics before validation, unless metricsFile is empty. The
+// file holds a YAML list of metric entries written as under prometheus.metrics
+// and, like a configuration path, may be an http(s) URL or gzip-compressed.
+func LoadConfigWithMetrics(metricsFile string, paths ...string) (*Config, error) {
+	root, err := readMerged(paths)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %w", err)
+		return nil, err
 	}
 
 	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
+	if err := root.Decode(&cfg); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
 
+	if metricsFile != "" {
+		extra, err := readMetricsFile(metricsFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Prometheus.Metrics = append(cfg.Prometheus.Metrics, extra...)
+	}
+
+	// Expand environment variable references so secrets stay out of the file
+	if err := expandEnvFields(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to expand environment variables: %w", err)
+	}
+
 	// Set defaults
+	if cfg.LogLevel == "" {
+		cfg.LogLevel = "info"
+	}
+
+	if cfg.LogFormat == "" {
+		cfg.LogFormat = LogFormatJSON
+	}
+
+	if cfg.CollectionInterval == 0 {
+		if cfg.Debug {
+			// Keep the short debug interval only when no interval is configured
+			cfg.CollectionInterval = 1 * time.Minute
+		} else {
+			cfg.CollectionInterval = 24 * time.Hour
+		}
+	}
+
+	if cfg.MaxConcurrentProxies == 0 {
+		cfg.MaxConcurrentProxies = 1
+	}
+
 	if cfg.Prometheus.Timeout == 0 {
 		cfg.Prometheus.Timeout = 30 * time.Second
 	}
@@ -98,6 +771,92 @@ func LoadConfig(path string) (*Config, error) {
 		cfg.Prometheus.RangeStep = 1 * time.Hour // Default to 1 hour step
 	}
 
+	if cfg.Prometheus.BatchDuration == 0 {
+		cfg.Prometheus.BatchDuration = 6 * time.Hour
+	}
+
+	if cfg.Prometheus.QueryMode == "" {
+		cfg.Prometheus.QueryMode = QueryModeQuery
+	}
+
+	if cfg.Prometheus.NonFiniteValues == "" {
+		cfg.Prometheus.NonFiniteValues = NonFiniteDrop
+	}
+
+	if cfg.Prometheus.MaxSamplesAction == "" {
+		cfg.Prometheus.MaxSamplesAction = MaxSamplesError
+	}
+
+	if cfg.Prometheus.SourceName == "" && len(cfg.Sources) == 0 {
+		if u, err := url.Parse(cfg.Prometheus.URL); err == nil {
+			cfg.Prometheus.SourceName = u.Hostname()
+		}
+	}
+
+	if cfg.Prometheus.RetryBackoff == 0 {
+		cfg.Prometheus.RetryBackoff = 500 * time.Millisecond
+	}
+	if cfg.Prometheus.MaxRetryAfter == 0 {
+		cfg.Prometheus.MaxRetryAfter = time.Minute
+	}
+	if cfg.Prometheus.MaxThrottledRetries == 0 {
+		cfg.Prometheus.MaxThrottledRetries = 5
+	}
+
+	if cfg.Storage.Type == "" {
+		cfg.Storage.Type = StorageTypeParquet
+	}
+
+	if cfg.Storage.Format == "" {
+		cfg.Storage.Format = FormatParquet
+	}
+
+	if cfg.Storage.Layout == "" {
+		cfg.Storage.Layout = LayoutPoint
+	}
+
+	if cfg.Storage.TimestampPrecision == "" {
+		cfg.Storage.TimestampPrecision = PrecisionMillis
+	}
+
+	if cfg.Storage.Timezone == "" {
+		cfg.Storage.Timezone = "UTC"
+	}
+
+	if cfg.Storage.DateFormat == "" {
+		cfg.Storage.DateFormat = time.DateOnly
+	}
+
+	if cfg.Storage.DirMode == "" {
+		cfg.Storage.DirMode = "0755"
+	}
+	if cfg.Storage.FileMode == "" {
+		cfg.Storage.FileMode = "0644"
+	}
+
+	// Every series carries its metric name, which original_name already holds
+	if cfg.Storage.ExcludeLabels == nil {
+		cfg.Storage.ExcludeLabels = []string{"__name__"}
+	}
+
+	if cfg.Storage.ApiProxyLabelKeys == nil {
+		cfg.Storage.ApiProxyLabelKeys = []string{"apiproxy", "app"}
+	}
+
+	if cfg.Storage.DuckDBPath == "" {
+		cfg.Storage.DuckDBPath = filepath.Join(cfg.Storage.OutputDir, "metrics.duckdb")
+	}
+
+	if cfg.Storage.PathTemplate == "" {
+		if cfg.Storage.CombineProxies {
+			cfg.Storage.PathTemplate = DefaultCombinedPathTemplate
+		} else {
+			cfg.Storage.PathTemplate = DefaultPathTemplate
+		}
+		// The default layout names files after the format
+		cfg.Storage.PathTemplate = strings.TrimSuffix(cfg.Storage.PathTemplate, ".parquet") + "." + cfg.Storage.Format
+	}
+
 	if cfg.Storage.Compression == "" {
 		cfg.Storage.Compression = "snappy"
 	}
@@ -106,22 +865,877 @@ func LoadConfig(path string) (*Config, error) {
 		cfg.Storage.RowGroupSize = 128 * 1024 * 1024 // 128MB default
 	}
 
+	if cfg.Storage.PageSize == 0 {
+		cfg.Storage.PageSize = 8 * 1024 // 8KB default
+	}
+
 	if cfg.Storage.WriteStopTimeout == 0 {
 		cfg.Storage.WriteStopTimeout = 180 * time.Second // 3 minutes default
 	}
 
+	if cfg.Storage.WriteRetryBackoff == 0 {
+		cfg.Storage.WriteRetryBackoff = time.Second
+	}
+
+	if cfg.Downsample.Function == "" {
+		cfg.Downsample.Function = DownsampleAvg
+	}
+
+	if cfg.Telemetry.ListenAddress == "" {
+		cfg.Telemetry.ListenAddress = ":9101"
+	}
+
+	if cfg.Prometheus.DiscoverProxies.Label == "" {
+		cfg.Prometheus.DiscoverProxies.Label = DefaultProxyLabel
+	}
+
+	for i := range cfg.Prometheus.Metrics {
+		if cfg.Prometheus.Metrics[i].ProxyLabel == "" {
+			cfg.Prometheus.Metrics[i].ProxyLabel = DefaultProxyLabel
+		}
+	}
+
+	cfg.Prometheus.ProxyMetrics = resolveProxyMetrics(cfg.APIProxies, cfg.Prometheus.Metrics)
+
 	// Validate required fields
-	if cfg.Prometheus.URL == "" {
-		return nil, fmt.Errorf("prometheus.url is required")
+	if _, err := cfg.SlogLevel(); err != nil {
+		return nil, fmt.Errorf("logLevel must be debug, info, warn or error: %w", err)
+	}
+
+	if cfg.LogFormat != LogFormatJSON && cfg.LogFormat != LogFormatText {
+		return nil, fmt.Errorf("logFormat must be %q or %q", LogFormatJSON, LogFormatText)
+	}
+
+	if cfg.CollectionInterval <= 0 {
+		return nil, fmt.Errorf("collectionInterval must be positive")
+	}
+
+	if err := validateTracing(cfg.Tracing); err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Sources) > 0 {
+		if cfg.Prometheus.URL != "" {
+			return nil, fmt.Errorf("prometheus.url and sources are mutually exclusive")
+		}
+		if err := validateSources(cfg.Sources); err != nil {
+			return nil, fmt.Errorf("invalid sources configuration:\n%w", err)
+		}
+	} else if err := validateConnection("prometheus", cfg.Prometheus); err != nil {
+		return nil, err
+	}
+
+	if cfg.Prometheus.QueryMode != QueryModeQuery && cfg.Prometheus.QueryMode != QueryModeRemoteRead {
+		return nil, fmt.Errorf("prometheus.queryMode must be %q or %q", QueryModeQuery, QueryModeRemoteRead)
+	}
+
+	switch cfg.Prometheus.NonFiniteValues {
+	case NonFiniteDrop, NonFiniteZero, NonFiniteKeep:
+	default:
+		return nil, fmt.Errorf("prometheus.nonFiniteValues must be %q, %q or %q", NonFiniteDrop, NonFiniteZero, NonFiniteKeep)
+	}
+
+	if cfg.Prometheus.MaxSamples < 0 {
+		return nil, fmt.Errorf("prometheus.maxSamples must not be negative")
+	}
+
+	if cfg.Prometheus.MaxSamplesAction != MaxSamplesError && cfg.Prometheus.MaxSamplesAction != MaxSamplesTruncate {
+		return nil, fmt.Errorf("prometheus.maxSamplesAction must be %q or %q", MaxSamplesError, MaxSamplesTruncate)
+	}
+
+	if cfg.Prometheus.RangeStep <= 0 {
+		return nil, fmt.Errorf("prometheus.rangeStep must be positive")
+	}
+
+	if cfg.Prometheus.LookbackDelta < 0 {
+		return nil, fmt.Errorf("prometheus.lookbackDelta must not be negative")
+	}
+
+	if err := validateHTTPProxy(cfg.Prometheus.HTTPProxy); err != nil {
+		return nil, err
+	}
+
+	if cfg.Prometheus.BatchTimeout < 0 {
+		return nil, fmt.Errorf("prometheus.batchTimeout must not be negative")
+	}
+
+	if cfg.Prometheus.BatchDuration <= 0 {
+		return nil, fmt.Errorf("prometheus.batchDuration must be positive")
+	}
+
+	if cfg.SoftMemoryLimit < 0 {
+		return nil, fmt.Errorf("softMemoryLimit must not be negative")
+	}
+
+	if cfg.MaxConcurrentProxies <= 0 {
+		return nil, fmt.Errorf("maxConcurrentProxies must be positive")
+	}
+
+	if cfg.Prometheus.PipelineDepth < 0 {
+		return nil, fmt.Errorf("prometheus.pipelineDepth must not be negative")
+	}
+
+	if cfg.Prometheus.MaxConcurrentQueries < 0 {
+		return nil, fmt.Errorf("prometheus.maxConcurrentQueries must not be negative")
+	}
+
+	if cfg.Prometheus.QueriesPerSecond < 0 || !isFinite(cfg.Prometheus.QueriesPerSecond) {
+		return nil, fmt.Errorf("prometheus.queriesPerSecond must be a non-negative number")
+	}
+
+	if cfg.Prometheus.MaxRetries < 0 || cfg.Prometheus.RetryBackoff < 0 {
+		return nil, fmt.Errorf("prometheus.maxRetries and prometheus.retryBackoff must not be negative")
+	}
+	if cfg.Prometheus.MaxRetryAfter < 0 || cfg.Prometheus.MaxThrottledRetries < 0 {
+		return nil, fmt.Errorf("prometheus.maxRetryAfter and prometheus.maxThrottledRetries must not be negative")
 	}
 
 	if cfg.Storage.OutputDir == "" {
 		return nil, fmt.Errorf("storage.outputDir is required")
 	}
 
-	if len(cfg.APIProxies) == 0 {
-		return nil, fmt.Errorf("at least one API proxy must be specified")
+	if cfg.Storage.Type != StorageTypeParquet && cfg.Storage.Type != StorageTypeDuckDB {
+		return nil, fmt.Errorf("storage.type must be %q or %q", StorageTypeParquet, StorageTypeDuckDB)
+	}
+
+	switch cfg.Storage.Format {
+	case FormatParquet, FormatJSONL, FormatCSV:
+	default:
+		return nil, fmt.Errorf("storage.format must be %q, %q or %q", FormatParquet, FormatJSONL, FormatCSV)
+	}
+
+	if cfg.Storage.Type == StorageTypeDuckDB && cfg.Storage.Format != FormatParquet {
+		return nil, fmt.Errorf("storage.format applies to file output and cannot be used with storage.type %q", StorageTypeDuckDB)
+	}
+
+	if cfg.Storage.SuccessMarker != "" {
+		if cfg.Storage.Type == StorageTypeDuckDB {
+			return nil, fmt.Errorf("storage.successMarker applies to file output and cannot be used with storage.type %q", StorageTypeDuckDB)
+		}
+		if strings.ContainsAny(cfg.Storage.SuccessMarker, "/\\") || cfg.Storage.SuccessMarker == "." || cfg.Storage.SuccessMarker == ".." {
+			return nil, fmt.Errorf("storage.successMarker must be a file name, got %q", cfg.Storage.SuccessMarker)
+		}
+	}
+
+	if cfg.Storage.DateFormat != time.DateOnly && cfg.Storage.Type == StorageTypeDuckDB {
+		return nil, fmt.Errorf("storage.dateFormat applies to file output and cannot be used with storage.type %q", StorageTypeDuckDB)
+	}
+	if err := validateDateFormat(cfg.Storage.DateFormat); err != nil {
+		return nil, err
+	}
+
+	if cfg.Storage.RowGroupSize <= 0 || cfg.Storage.PageSize <= 0 {
+		return nil, fmt.Errorf("storage.rowGroupSize and storage.pageSize must be positive")
+	}
+
+	if cfg.Storage.MaxOpenFiles < 0 {
+		return nil, fmt.Errorf("storage.maxOpenFiles must not be negative")
+	}
+
+	if cfg.Storage.WriteManifest && cfg.Storage.Type == StorageTypeDuckDB {
+		return nil, fmt.Errorf("storage.writeManifest applies to file output and cannot be used with storage.type %q", StorageTypeDuckDB)
+	}
+
+	if cfg.Storage.WriteRetries < 0 || cfg.Storage.WriteRetryBackoff < 0 {
+		return nil, fmt.Errorf("storage.writeRetries and storage.writeRetryBackoff must not be negative")
+	}
+
+	if cfg.Storage.FailedDir != "" {
+		if cfg.Storage.Type == StorageTypeDuckDB {
+			return nil, fmt.Errorf("storage.failedDir applies to file output and cannot be used with storage.type %q", StorageTypeDuckDB)
+		}
+		if strings.HasPrefix(cfg.Storage.FailedDir, "s3://") {
+			return nil, fmt.Errorf("storage.failedDir must be a local path")
+		}
+	}
+
+	if cfg.Storage.Type == StorageTypeDuckDB && strings.HasPrefix(cfg.Storage.DuckDBPath, "s3://") {
+		return nil, fmt.Errorf("storage.duckdbPath must be a local path")
+	}
+
+	if len(cfg.APIProxies) == 0 && !cfg.Prometheus.DiscoverProxies.Enabled {
+		return nil, fmt.Errorf("at least one API proxy must be specified, or prometheus.discoverProxies enabled")
+	}
+
+	if err := validateDiscovery(cfg.Prometheus.DiscoverProxies); err != nil {
+		return nil, err
+	}
+
+	if err := validateAPIProxies(cfg.APIProxies); err != nil {
+		return nil, err
+	}
+
+	if cfg.Downsample.Interval < 0 {
+		return nil, fmt.Errorf("downsample.interval must not be negative")
+	}
+
+	switch cfg.Downsample.Function {
+	case DownsampleAvg, DownsampleSum, DownsampleMin, DownsampleMax, DownsampleLast:
+	default:
+		return nil, fmt.Errorf("downsample.function must be one of avg, sum, min, max or last")
+	}
+
+	if cfg.Storage.CombineProxies && cfg.Storage.Streaming {
+		return nil, fmt.Errorf("storage.combineProxies cannot be combined with storage.streaming")
+	}
+
+	if cfg.Downsample.Interval > 0 && cfg.Storage.Streaming {
+		return nil, fmt.Errorf("downsample cannot be combined with storage.streaming")
+	}
+
+	// Streaming already writes while the queries run
+	if cfg.Prometheus.PipelineDepth > 0 && cfg.Storage.Streaming {
+		return nil, fmt.Errorf("prometheus.pipelineDepth cannot be combined with storage.streaming")
+	}
+
+	if err := validateRollup(cfg.Rollup, cfg.Storage); err != nil {
+		return nil, err
+	}
+
+	if err := validateProcessors(cfg.Processors, cfg.Storage); err != nil {
+		return nil, err
+	}
+
+	if err := validatePromoteLabels(cfg.Storage.PromoteLabels); err != nil {
+		return nil, err
+	}
+
+	for _, key := range cfg.Storage.ApiProxyLabelKeys {
+		if !labelNamePattern.MatchString(key) {
+			return nil, fmt.Errorf("storage.apiProxyLabelKeys: %q is not a valid label name", key)
+		}
+	}
+
+	location, err := time.LoadLocation(cfg.Storage.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("storage.timezone: %w", err)
+	}
+	cfg.Storage.Location = location
+
+	// Steps are aligned to the Unix epoch, so a step of a day or more would
+	// start at UTC midnight rather than at the midnight of the partitions
+	if cfg.Prometheus.AlignStep && cfg.Prometheus.RangeStep >= 24*time.Hour && location.String() != "UTC" {
+		return nil, fmt.Errorf("prometheus.alignStep aligns to UTC, so it cannot be used with a rangeStep of %s and storage.timezone %q; use a shorter step or timezone UTC",
+			cfg.Prometheus.RangeStep, location)
+	}
+
+	if cfg.Storage.DirPerm, err = parseFileMode("storage.dirMode", cfg.Storage.DirMode); err != nil {
+		return nil, err
+	}
+	if cfg.Storage.FilePerm, err = parseFileMode("storage.fileMode", cfg.Storage.FileMode); err != nil {
+		return nil, err
+	}
+
+	if err := validateLabelFilter(cfg.Storage); err != nil {
+		return nil, err
+	}
+
+	if err := validateCompression(cfg.Storage); err != nil {
+		return nil, err
+	}
+
+	if err := validateEncoding(cfg.Storage); err != nil {
+		return nil, err
+	}
+
+	if err := validateLayout(cfg.Storage); err != nil {
+		return nil, err
+	}
+
+	if err := validatePrecision(cfg.Storage); err != nil {
+		return nil, err
+	}
+
+	if err := validateMetrics("prometheus.metrics", cfg.Prometheus.Metrics); err != nil {
+		return nil, fmt.Errorf("invalid metric configuration:\n%w", err)
+	}
+
+	var overrideErrs []error
+	for i, proxy := range cfg.APIProxies {
+		overrideErrs = append(overrideErrs, validateProxyOverrides(i, proxy, cfg.Prometheus.ProxyMetrics[proxy.Name]))
+	}
+	if err := errors.Join(overrideErrs...); err != nil {
+		return nil, fmt.Errorf("invalid metric overrides:\n%w", err)
+	}
+	if err := validateSeparateFiles(cfg.Prometheus, cfg.APIProxies); err != nil {
+		return nil, fmt.Errorf("invalid metric overrides:\n%w", err)
+	}
+
+	if cfg.Prometheus.QueryMode == QueryModeRemoteRead {
+		if err := validateRemoteReadQueries(&cfg); err != nil {
+			return nil, fmt.Errorf("prometheus.queryMode %q requires plain series selectors:\n%w", QueryModeRemoteRead, err)
+		}
 	}
 
 	return &cfg, nil
 }
+
+// ValidateTimeRange checks that the range query window set from the command
+// line is usable: the end must follow the start and the step must fit within it
+func (c *Config) ValidateTimeRange() error {
+	if c.StartTime.IsZero() && c.EndTime.IsZero() {
+		return nil
+	}
+
+	if !c.EndTime.After(c.StartTime) {
+		return fmt.Errorf("end time %s must be after start time %s",
+			c.EndTime.Format(time.RFC3339), c.StartTime.Format(time.RFC3339))
+	}
+
+	if c.Prometheus.RangeStep <= 0 {
+		return fmt.Errorf("prometheus.rangeStep must be positive, got %s", c.Prometheus.RangeStep)
+	}
+
+	if rangeDuration := c.EndTime.Sub(c.StartTime); c.Prometheus.RangeStep > rangeDuration {
+		return fmt.Errorf("prometheus.rangeStep %s is larger than the time range %s", c.Prometheus.RangeStep, rangeDuration)
+	}
+
+	return nil
+}
+
+// SlogLevel parses LogLevel into a log/slog level
+func (c *Config) SlogLevel() (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(c.LogLevel))
+	return level, err
+}
+
+// PrometheusSources returns the settings for every Prometheus server to collect
+// from: the prometheus block itself, or one copy of it per configured source
+// with that source's connection settings applied
+func (c *Config) PrometheusSources() []PrometheusConfig {
+	if len(c.Sources) == 0 {
+		return []PrometheusConfig{c.Prometheus}
+	}
+
+	sources := make([]PrometheusConfig, 0, len(c.Sources))
+	for _, src := range c.Sources {
+		p := c.Prometheus
+		p.SourceName = src.Name
+		p.URL = src.URL
+		p.Username = src.Username
+		p.Password = src.Password
+		p.BearerToken = src.BearerToken
+		p.BearerTokenFile = src.BearerTokenFile
+		p.TLS = src.TLS
+		sources = append(sources, p)
+	}
+	return sources
+}
+
+// validateConnection checks the URL and authentication settings of a Prometheus server
+func validateConnection(prefix string, p PrometheusConfig) error {
+	if p.URL == "" {
+		return fmt.Errorf("%s.url is required", prefix)
+	}
+
+	if p.BearerToken != "" && p.BearerTokenFile != "" {
+		return fmt.Errorf("%s.bearerToken and %s.bearerTokenFile are mutually exclusive", prefix, prefix)
+	}
+
+	if (p.Username != "" || p.Password != "") && (p.BearerToken != "" || p.BearerTokenFile != "") {
+		return fmt.Errorf("%s basic auth and bearer token auth are mutually exclusive", prefix)
+	}
+
+	return nil
+}
+
+// validateHTTPProxy checks that the proxy, if set, is an absolute http,
+// https or socks5 URL
+func validateHTTPProxy(proxy string) error {
+	if proxy == "" {
+		return nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return fmt.Errorf("prometheus.httpProxy: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return fmt.Errorf("prometheus.httpProxy must be an http://, https:// or socks5:// URL")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("prometheus.httpProxy must include a host")
+	}
+	return nil
+}
+
+// validateTracing checks that the trace endpoint, if set, is an absolute http
+// or https URL
+func validateTracing(t TracingConfig) error {
+	if t.Endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(t.Endpoint)
+	if err != nil {
+		return fmt.Errorf("tracing.endpoint: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("tracing.endpoint must be an http:// or https:// URL")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("tracing.endpoint must include a host")
+	}
+	return nil
+}
+
+// validateSources checks every source definition and returns all problems found
+func validateSources(sources []SourceConfig) error {
+	var errs []error
+	seen := make(map[string]bool, len(sources))
+
+	for i, src := range sources {
+		prefix := fmt.Sprintf("sources[%d]", i)
+		switch {
+		case src.Name == "":
+			errs = append(errs, fmt.Errorf("%s: name is required", prefix))
+		case strings.ContainsAny(src.Name, "/\\"):
+			errs = append(errs, fmt.Errorf("%s: name %q must not contain path separators", prefix, src.Name))
+		case seen[src.Name]:
+			errs = append(errs, fmt.Errorf("%s: duplicate source name %q", prefix, src.Name))
+		}
+		seen[src.Name] = true
+
+		p := PrometheusConfig{
+			URL:             src.URL,
+			Username:        src.Username,
+			Password:        src.Password,
+			BearerToken:     src.BearerToken,
+			BearerTokenFile: src.BearerTokenFile,
+		}
+		if err := validateConnection(prefix, p); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateAPIProxies checks that every API proxy name is usable as a partition
+// directory (app=<name>) and returns all problems found
+func validateAPIProxies(proxies []APIProxyConfig) error {
+	var errs []error
+	seen := make(map[string]bool, len(proxies))
+
+	for i, entry := range proxies {
+		proxy := entry.Name
+		prefix := fmt.Sprintf("apiProxies[%d]", i)
+		if err := ValidateAPIProxyName(proxy); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", prefix, err))
+		} else if seen[proxy] {
+			errs = append(errs, fmt.Errorf("%s: duplicate API proxy %q", prefix, proxy))
+		}
+		seen[proxy] = true
+	}
+
+	return errors.Join(errs...)
+}
+
+// ValidateAPIProxyName checks that an API proxy name is usable as a partition
+// directory; discovered names are checked the same way as configured ones
+func ValidateAPIProxyName(proxy string) error {
+	switch {
+	case strings.TrimSpace(proxy) == "":
+		return errors.New("name must not be empty")
+	case strings.TrimSpace(proxy) != proxy:
+		return fmt.Errorf("name %q must not start or end with whitespace", proxy)
+	case proxy == "." || proxy == "..":
+		return fmt.Errorf("name %q is not a valid directory name", proxy)
+	case strings.ContainsAny(proxy, "/\\="):
+		return fmt.Errorf("name %q must not contain path separators or '='", proxy)
+	case strings.IndexFunc(proxy, unicode.IsControl) >= 0:
+		return fmt.Errorf("name %q must not contain control characters", proxy)
+	}
+	return nil
+}
+
+// validateRollup checks that rollups can be written next to the raw output
+func validateRollup(r RollupConfig, storage StorageConfig) error {
+	if !r.Enabled {
+		return nil
+	}
+	if storage.Streaming {
+		return fmt.Errorf("rollup cannot be combined with storage.streaming")
+	}
+	if storage.Type == StorageTypeDuckDB {
+		return nil
+	}
+	if r.OutputDir == "" {
+		return fmt.Errorf("rollup.outputDir is required")
+	}
+	if strings.TrimSuffix(r.OutputDir, "/") == strings.TrimSuffix(storage.OutputDir, "/") {
+		return fmt.Errorf("rollup.outputDir must differ from storage.outputDir")
+	}
+	if strings.HasPrefix(r.OutputDir, "s3://") != strings.HasPrefix(storage.OutputDir, "s3://") {
+		return fmt.Errorf("rollup.outputDir must be an s3:// location exactly when storage.outputDir is")
+	}
+	return nil
+}
+
+// validateProcessors checks every entry of the processors chain
+func validateProcessors(processors []ProcessorConfig, storage StorageConfig) error {
+	if len(processors) > 0 && storage.Streaming {
+		return fmt.Errorf("processors cannot be combined with storage.streaming")
+	}
+	for i, p := range processors {
+		if len(p.RenameLabels) == 0 {
+			return fmt.Errorf("processors[%d]: renameLabels must be set", i)
+		}
+		// Two labels renamed to one name would each replace the other,
+		// depending on map order
+		names := make([]string, 0, len(p.RenameLabels))
+		for from := range p.RenameLabels {
+			names = append(names, from)
+		}
+		slices.Sort(names)
+
+		sources := make(map[string]string, len(p.RenameLabels))
+		for _, from := range names {
+			to := p.RenameLabels[from]
+			for _, name := range []string{from, to} {
+				if !labelNamePattern.MatchString(name) {
+					return fmt.Errorf("processors[%d].renameLabels: %q is not a valid label name", i, name)
+				}
+			}
+			if other, ok := sources[to]; ok {
+				return fmt.Errorf("processors[%d].renameLabels: %q and %q are both renamed to %q", i, other, from, to)
+			}
+			sources[to] = from
+		}
+	}
+	return nil
+}
+
+// validateDiscovery checks the API proxy discovery label, pattern, selectors
+// and bounds
+func validateDiscovery(d ProxyDiscoveryConfig) error {
+	if !labelNamePattern.MatchString(d.Label) {
+		return fmt.Errorf("prometheus.discoverProxies.label: %q is not a valid label name", d.Label)
+	}
+	if _, err := regexp.Compile(d.Match); err != nil {
+		return fmt.Errorf("prometheus.discoverProxies.match: %w", err)
+	}
+	for _, selector := range d.Selectors {
+		if strings.TrimSpace(selector) == "" {
+			return fmt.Errorf("prometheus.discoverProxies.selectors: selectors must not be empty")
+		}
+	}
+	if d.Lookback < 0 {
+		return fmt.Errorf("prometheus.discoverProxies.lookback must not be negative")
+	}
+	if d.Limit < 0 {
+		return fmt.Errorf("prometheus.discoverProxies.limit must not be negative")
+	}
+	return nil
+}
+
+// labelNamePattern matches valid Prometheus label names
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// validatePromoteLabels checks that promoted labels are valid, unique label
+// names. The storage rejects those of its built-in columns, which it derives
+// from its row layout.
+func validatePromoteLabels(labels []string) error {
+	seen := make(map[string]bool, len(labels))
+	for _, label := range labels {
+		if !labelNamePattern.MatchString(label) {
+			return fmt.Errorf("storage.promoteLabels: %q is not a valid label name", label)
+		}
+		if seen[label] {
+			return fmt.Errorf("storage.promoteLabels: duplicate label %q", label)
+		}
+		seen[label] = true
+	}
+	return nil
+}
+
+// validateDateFormat checks that the storage.dateFormat layout formats a time
+// into a value that parses back to the same calendar day
+func validateDateFormat(layout string) error {
+	ref := time.Date(2025, time.April, 7, 13, 4, 5, 0, time.UTC)
+	parsed, err := time.Parse(layout, ref.Format(layout))
+	if err != nil {
+		return fmt.Errorf("storage.dateFormat %q is not a valid time layout: %w", layout, err)
+	}
+	if y, m, d := parsed.Date(); y != ref.Year() || m != ref.Month() || d != ref.Day() {
+		return fmt.Errorf("storage.dateFormat %q must contain the year, month and day", layout)
+	}
+	return nil
+}
+
+// parseFileMode parses the octal permission bits of setting name, e.g. "0664"
+func parseFileMode(name, value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("%s must be octal permission bits such as \"0755\", got %q", name, value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// validateLabelFilter checks storage.includeLabels and storage.excludeLabels
+func validateLabelFilter(storage StorageConfig) error {
+	for _, list := range []struct {
+		name   string
+		labels []string
+	}{
+		{"storage.includeLabels", storage.IncludeLabels},
+		{"storage.excludeLabels", storage.ExcludeLabels},
+	} {
+		for _, label := range list.labels {
+			if !labelNamePattern.MatchString(label) {
+				return fmt.Errorf("%s: %q is not a valid label name", list.name, label)
+			}
+		}
+	}
+	for _, label := range storage.ExcludeLabels {
+		if slices.Contains(storage.PromoteLabels, label) {
+			return fmt.Errorf("storage.excludeLabels: %q is also in storage.promoteLabels", label)
+		}
+	}
+	return nil
+}
+
+// encodedColumns are the built-in string columns storage.columnEncoding may set
+var encodedColumns = []string{"metric_name", "original_name", "api_proxy", "source", "labels", "date"}
+
+// validateCompression checks the codec and that the level is within the range
+// of codecs with levels: gzip 1-9 and zstd 1-22, or 0 for the codec default.
+// Other codecs ignore the level.
+func validateCompression(storage StorageConfig) error {
+	level := storage.CompressionLevel
+	switch codec := strings.ToLower(strings.TrimSpace(storage.Compression)); codec {
+	case "snappy", "lz4", "uncompressed", "none":
+	case "gzip":
+		if level != 0 && (level < 1 || level > 9) {
+			return fmt.Errorf("storage.compressionLevel must be between 1 and 9 for gzip, got %d", level)
+		}
+	case "zstd":
+		if level != 0 && (level < 1 || level > 22) {
+			return fmt.Errorf("storage.compressionLevel must be between 1 and 22 for zstd, got %d", level)
+		}
+	default:
+		return fmt.Errorf("storage.compression must be one of snappy, gzip, zstd, lz4 or uncompressed, got %q", storage.Compression)
+	}
+	return nil
+}
+
+// validateEncoding checks the Parquet encoding settings of storage
+func validateEncoding(storage StorageConfig) error {
+	if !storage.DictionaryEncoding && len(storage.ColumnEncoding) == 0 {
+		return nil
+	}
+	if storage.Type != StorageTypeParquet || storage.Format != FormatParquet {
+		return fmt.Errorf("storage.dictionaryEncoding and storage.columnEncoding only apply to storage.format %q", FormatParquet)
+	}
+
+	for column, encoding := range storage.ColumnEncoding {
+		if !slices.Contains(encodedColumns, column) && !slices.Contains(storage.PromoteLabels, column) {
+			return fmt.Errorf("storage.columnEncoding: %q is not a string column or promoted label", column)
+		}
+		if encoding != EncodingDictionary && encoding != EncodingPlain {
+			return fmt.Errorf("storage.columnEncoding: %s must be %q or %q, got %q", column, EncodingDictionary, EncodingPlain, encoding)
+		}
+	}
+	return nil
+}
+
+// validateLayout checks storage.layout against the other storage settings
+func validateLayout(storage StorageConfig) error {
+	switch storage.Layout {
+	case LayoutPoint:
+		return nil
+	case LayoutSeries:
+	default:
+		return fmt.Errorf("storage.layout must be %q or %q", LayoutPoint, LayoutSeries)
+	}
+
+	if storage.Type != StorageTypeParquet || storage.Format != FormatParquet {
+		return fmt.Errorf("storage.layout %q only applies to storage.format %q", LayoutSeries, FormatParquet)
+	}
+	if storage.Streaming {
+		return fmt.Errorf("storage.layout %q cannot be combined with storage.streaming", LayoutSeries)
+	}
+	return nil
+}
+
+// validatePrecision checks storage.timestampPrecision against the other storage settings
+func validatePrecision(storage StorageConfig) error {
+	switch storage.TimestampPrecision {
+	case PrecisionMillis:
+		return nil
+	case PrecisionMicros, PrecisionNanos:
+	default:
+		return fmt.Errorf("storage.timestampPrecision must be %q, %q or %q", PrecisionMillis, PrecisionMicros, PrecisionNanos)
+	}
+
+	if storage.Type != StorageTypeParquet {
+		return fmt.Errorf("storage.timestampPrecision applies to file output and cannot be used with storage.type %q", storage.Type)
+	}
+	if storage.Format != FormatParquet {
+		return fmt.Errorf("storage.timestampPrecision %q only applies to storage.format %q", storage.TimestampPrecision, FormatParquet)
+	}
+	return nil
+}
+
+// DictionaryEncoded reports whether the string column is written dictionary encoded
+func (s StorageConfig) DictionaryEncoded(column string) bool {
+	if encoding, ok := s.ColumnEncoding[column]; ok {
+		return encoding == EncodingDictionary
+	}
+	return s.DictionaryEncoding
+}
+
+// isFinite reports whether v is neither NaN nor ±Inf
+func isFinite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+// validateMetrics checks every metric definition and returns all problems found
+func validateMetrics(prefix string, metrics []MetricConfig) error {
+	var errs []error
+	seen := make(map[string]bool, len(metrics))
+
+	for i, metric := range metrics {
+		if metric.Name == "" {
+			errs = append(errs, fmt.Errorf("%s[%d]: name is required", prefix, i))
+		} else if seen[metric.Name] {
+			errs = append(errs, fmt.Errorf("%s[%d]: duplicate metric name %q", prefix, i, metric.Name))
+		}
+		seen[metric.Name] = true
+
+		if strings.TrimSpace(metric.Query) == "" {
+			errs = append(errs, fmt.Errorf("%s[%d] (%s): query is required", prefix, i, metric.Name))
+			continue
+		}
+
+		if err := validateQueryTemplate(metric.Query); err != nil {
+			errs = append(errs, fmt.Errorf("%s[%d] (%s): %w", prefix, i, metric.Name, err))
+		}
+
+		if err := validateMatchers(metric); err != nil {
+			errs = append(errs, fmt.Errorf("%s[%d] (%s): %w", prefix, i, metric.Name, err))
+		}
+
+		if metric.Timeout < 0 || metric.LookbackDelta < 0 || metric.MaxSamples < 0 {
+			errs = append(errs, fmt.Errorf("%s[%d] (%s): timeout, lookbackDelta and maxSamples must not be negative", prefix, i, metric.Name))
+		}
+
+		if !isFinite(metric.Scale) || !isFinite(metric.Offset) {
+			errs = append(errs, fmt.Errorf("%s[%d] (%s): scale and offset must be finite numbers", prefix, i, metric.Name))
+		}
+
+		for _, label := range metric.ExpectLabels {
+			if !labelNamePattern.MatchString(label) {
+				errs = append(errs, fmt.Errorf("%s[%d] (%s): expectLabels: %q is not a valid label name", prefix, i, metric.Name, label))
+			}
+		}
+
+		switch metric.MissingLabels {
+		case "", MissingLabelsKeep, MissingLabelsDrop:
+		default:
+			errs = append(errs, fmt.Errorf("%s[%d] (%s): missingLabels must be %q or %q", prefix, i, metric.Name, MissingLabelsKeep, MissingLabelsDrop))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// queryTemplateData holds the values a query template is rendered with for validation
+type queryTemplateData struct {
+	APIProxy      string
+	APIProxyRegex string
+	Selector      string
+}
+
+// renderQueryTemplate renders a metric query template with data
+func renderQueryTemplate(query string, data queryTemplateData) (string, error) {
+	tmpl, err := template.New("query").Option("missingkey=error").Parse(query)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse query template: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render query template: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// validateQueryTemplate checks that a query parses as a template and references the API proxy
+func validateQueryTemplate(query string) error {
+	rendered, err := renderQueryTemplate(query, queryTemplateData{apiProxyPlaceholder, apiProxyPlaceholder, apiProxyPlaceholder})
+	if err != nil {
+		return err
+	}
+
+	if !strings.Contains(rendered, apiProxyPlaceholder) {
+		return fmt.Errorf("query must reference the API proxy via {{.APIProxy}}, {{.APIProxyRegex}} or {{.Selector}}")
+	}
+
+	return nil
+}
+
+// validateRemoteReadQueries checks that every enabled metric's query renders
+// to a plain series selector, the only queries remote read can run
+func validateRemoteReadQueries(cfg *Config) error {
+	var errs []error
+	check := func(prefix string, i int, metric MetricConfig) {
+		if !metric.IsEnabled() {
+			return
+		}
+		proxyLabel := metric.ProxyLabel
+		if proxyLabel == "" {
+			proxyLabel = DefaultProxyLabel
+		}
+		selector := fmt.Sprintf(`%s="%s"`, proxyLabel, apiProxyPlaceholder)
+		rendered, err := renderQueryTemplate(metric.Query, queryTemplateData{apiProxyPlaceholder, apiProxyPlaceholder, selector})
+		if err == nil {
+			_, err = ParseSelector(rendered)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s[%d] (%s): %w", prefix, i, metric.Name, err))
+		}
+	}
+
+	for i, metric := range cfg.Prometheus.Metrics {
+		check("prometheus.metrics", i, metric)
+	}
+	for i, proxy := range cfg.APIProxies {
+		for j, metric := range proxy.Metrics {
+			check(fmt.Sprintf("apiProxies[%d] (%s) metrics", i, proxy.Name), j, metric)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateMatchers checks a metric's selector labels and that its matchers
+// are actually rendered into the query
+func validateMatchers(metric MetricConfig) error {
+	if !labelNamePattern.MatchString(metric.ProxyLabel) {
+		return fmt.Errorf("proxyLabel %q is not a valid label name", metric.ProxyLabel)
+	}
+	if len(metric.Matchers) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(metric.Matchers))
+	for name := range metric.Matchers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		if !labelNamePattern.MatchString(name) {
+			return fmt.Errorf("matchers: %q is not a valid label name", name)
+		}
+		if name == metric.ProxyLabel {
+			return fmt.Errorf("matchers: %q is the proxy label and is matched on the API proxy", name)
+		}
+	}
+
+	if !strings.Contains(metric.Query, ".Selector") {
+		return fmt.Errorf("matchers are only applied through {{.Selector}}, which the query does not use")
+	}
+	return nil
+}
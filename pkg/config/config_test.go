@@ -0,0 +1,165 @@
+package config
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// baseConfig is a minimal valid configuration the tests merge their settings over
+const baseConfig = `
+apiProxies: [orders]
+prometheus:
+  url: http://prometheus:9090
+  metrics:
+    - name: requests
+      query: 'sum(rate(requests_total{app="{{.APIProxy}}"}[5m]))'
+storage:
+  outputDir: ./data
+`
+
+// loadYAML loads baseConfig merged with override
+func loadYAML(t *testing.T, override string) (*Config, error) {
+	t.Helper()
+	dir := t.TempDir()
+	paths := []string{filepath.Join(dir, "base.yaml"), filepath.Join(dir, "override.yaml")}
+	for i, content := range []string{baseConfig, override} {
+		if err := os.WriteFile(paths[i], []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return LoadConfig(paths...)
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := loadYAML(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Storage.RowGroupSize != 128*1024*1024 {
+		t.Errorf("RowGroupSize = %d, want 128MB", cfg.Storage.RowGroupSize)
+	}
+	if cfg.Storage.PageSize != 8*1024 {
+		t.Errorf("PageSize = %d, want 8KB", cfg.Storage.PageSize)
+	}
+}
+
+func TestLoadConfigRejects(t *testing.T) {
+	tests := []struct {
+		name     string
+		override string
+		want     string
+	}{
+		{"negative collection interval", "collectionInterval: -1m", "collectionInterval must be positive"},
+		{"negative range step", "prometheus: {rangeStep: -1m}", "prometheus.rangeStep must be positive"},
+		{"negative batch duration", "prometheus: {batchDuration: -1h}", "prometheus.batchDuration must be positive"},
+		{"negative maxConcurrentProxies", "maxConcurrentProxies: -2", "maxConcurrentProxies must be positive"},
+		{"negative row group size", "storage: {rowGroupSize: -1}", "storage.rowGroupSize and storage.pageSize must be positive"},
+		{"negative page size", "storage: {pageSize: -1}", "storage.rowGroupSize and storage.pageSize must be positive"},
+		{"query without placeholder", "prometheus: {metrics: [{name: up, query: 'up'}]}", "query must reference the API proxy"},
+		{"remote_read with an expression", "prometheus: {queryMode: remote_read}", `prometheus.metrics[0] (requests): remote_read mode requires a plain series selector`},
+		{"gzip level too high", "storage: {compression: gzip, compressionLevel: 10}", "storage.compressionLevel must be between 1 and 9 for gzip, got 10"},
+		{"zstd level negative", "storage: {compression: zstd, compressionLevel: -1}", "storage.compressionLevel must be between 1 and 22 for zstd, got -1"},
+		{"unknown codec", "storage: {compression: brotli}", "storage.compression must be one of"},
+		{"negative retry backoff", "prometheus: {retryBackoff: -1s}", "prometheus.maxRetries and prometheus.retryBackoff must not be negative"},
+		{"negative throttled retries", "prometheus: {maxThrottledRetries: -1}", "prometheus.maxRetryAfter and prometheus.maxThrottledRetries must not be negative"},
+		{"daily aligned steps outside UTC", "prometheus: {alignStep: true, rangeStep: 24h}\nstorage: {timezone: Europe/Berlin}", `prometheus.alignStep aligns to UTC, so it cannot be used with a rangeStep of 24h0m0s and storage.timezone "Europe/Berlin"`},
+		{"labels renamed to one name", "processors: [{renameLabels: {pod_name: pod, kubernetes_pod: pod}}]", `processors[0].renameLabels: "kubernetes_pod" and "pod_name" are both renamed to "pod"`},
+		{"proxy with a slash", `apiProxies: ["orders/v1"]`, `apiProxies[0]: name "orders/v1" must not contain path separators or '='`},
+		{"proxy with a backslash", `apiProxies: ['orders\v1']`, `must not contain path separators or '='`},
+		{"proxy escaping the directory", `apiProxies: [".."]`, `apiProxies[0]: name ".." is not a valid directory name`},
+		{"proxy with leading space", `apiProxies: [" orders"]`, "must not start or end with whitespace"},
+		{"separateFile for one proxy", "apiProxies: [orders, {name: billing, metrics: [{name: requests, separateFile: true}]}]", `apiProxies[1] (billing): metric "requests" has separateFile true, but false in prometheus.metrics`},
+		{"proxy with a control character", `apiProxies: ["orders\tv1"]`, "must not contain control characters"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadYAML(t, tt.override)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("LoadConfig error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigAPIProxyNames(t *testing.T) {
+	cfg, err := loadYAML(t, `apiProxies: ["orders v1", "заказы", "注文-api"]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, proxy := range cfg.APIProxies {
+		names = append(names, proxy.Name)
+	}
+	if got := strings.Join(names, ","); got != "orders v1,заказы,注文-api" {
+		t.Errorf("APIProxies = %s", got)
+	}
+}
+
+func TestLoadConfigProxyOnlySeparateFile(t *testing.T) {
+	override := `apiProxies: [orders, {name: billing, metrics: [{name: invoices, query: 'sum(invoices_total{app="{{.APIProxy}}"})', separateFile: true}]}]`
+	cfg, err := loadYAML(t, override)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, metric := range cfg.Prometheus.AllMetrics() {
+		if metric.Name == "invoices" && !metric.SeparateFile {
+			t.Error("invoices is not written to its own file")
+		}
+	}
+}
+
+func TestLoadConfigRemoteReadSelectors(t *testing.T) {
+	override := `
+prometheus:
+  queryMode: remote_read
+  metrics:
+    - name: requests
+      query: 'requests_total{app="{{.APIProxy}}", code=~"5.."}'
+    - name: latency
+      query: 'latency_seconds{ {{.Selector}} }'
+      matchers: {env: prod}
+    - name: ratio
+      query: 'sum(rate(errors_total{app="{{.APIProxy}}"}[5m]))'
+      enabled: false
+`
+	if _, err := loadYAML(t, override); err != nil {
+		t.Errorf("LoadConfig: %v", err)
+	}
+}
+
+func TestConvertValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric MetricConfig
+		value  float64
+		want   float64
+	}{
+		{"default", MetricConfig{}, 42, 42},
+		{"bytes to gigabytes", MetricConfig{Scale: 1e-9}, 5e9, 5},
+		{"seconds to milliseconds", MetricConfig{Scale: 1000}, 0.25, 250},
+		{"kelvin to celsius", MetricConfig{Offset: -273.15}, 273.15, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.metric.ConvertValue(tt.value); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("ConvertValue(%v) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigAlignStep(t *testing.T) {
+	for _, override := range []string{
+		"prometheus: {alignStep: true, rangeStep: 24h}",
+		"prometheus: {alignStep: true, rangeStep: 24h}\nstorage: {timezone: UTC}",
+		"prometheus: {alignStep: true, rangeStep: 1h}\nstorage: {timezone: Europe/Berlin}",
+		"prometheus: {rangeStep: 24h}\nstorage: {timezone: Europe/Berlin}",
+	} {
+		if _, err := loadYAML(t, override); err != nil {
+			t.Errorf("%q: %v", override, err)
+		}
+	}
+}
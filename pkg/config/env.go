@@ -0,0 +1,82 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// expandEnvFields expands ${VAR} and $VAR references in the config fields that
+// commonly hold secrets or deployment-specific values. Use $$ for a literal $.
+func expandEnvFields(cfg *Config) error {
+	type envField struct {
+		name  string
+		field *string
+	}
+	fields := []envField{
+		{"prometheus.url", &cfg.Prometheus.URL},
+		{"prometheus.username", &cfg.Prometheus.Username},
+		{"prometheus.password", &cfg.Prometheus.Password},
+		{"prometheus.bearerToken", &cfg.Prometheus.BearerToken},
+		{"prometheus.bearerTokenFile", &cfg.Prometheus.BearerTokenFile},
+		{"prometheus.tls.caCertFile", &cfg.Prometheus.TLS.CACertFile},
+		{"prometheus.tls.clientCertFile", &cfg.Prometheus.TLS.ClientCertFile},
+		{"prometheus.tls.clientKeyFile", &cfg.Prometheus.TLS.ClientKeyFile},
+		{"prometheus.httpProxy", &cfg.Prometheus.HTTPProxy},
+		{"storage.outputDir", &cfg.Storage.OutputDir},
+		{"storage.duckdbPath", &cfg.Storage.DuckDBPath},
+		{"storage.failedDir", &cfg.Storage.FailedDir},
+		{"storage.s3.region", &cfg.Storage.S3.Region},
+		{"storage.s3.endpoint", &cfg.Storage.S3.Endpoint},
+		{"storage.s3.accessKeyId", &cfg.Storage.S3.AccessKeyID},
+		{"storage.s3.secretAccessKey", &cfg.Storage.S3.SecretAccessKey},
+		{"storage.s3.sessionToken", &cfg.Storage.S3.SessionToken},
+	}
+	for i := range cfg.Sources {
+		src := &cfg.Sources[i]
+		prefix := fmt.Sprintf("sources[%d]", i)
+		fields = append(fields,
+			envField{prefix + ".url", &src.URL},
+			envField{prefix + ".username", &src.Username},
+			envField{prefix + ".password", &src.Password},
+			envField{prefix + ".bearerToken", &src.BearerToken},
+			envField{prefix + ".bearerTokenFile", &src.BearerTokenFile},
+			envField{prefix + ".tls.caCertFile", &src.TLS.CACertFile},
+			envField{prefix + ".tls.clientCertFile", &src.TLS.ClientCertFile},
+			envField{prefix + ".tls.clientKeyFile", &src.TLS.ClientKeyFile},
+		)
+	}
+
+	var errs []error
+	for _, f := range fields {
+		expanded, err := expandEnv(*f.field)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f.name, err))
+			continue
+		}
+		*f.field = expanded
+	}
+
+	return errors.Join(errs...)
+}
+
+// expandEnv expands environment variable references in value, returning an
+// error listing any referenced variables that are not set
+func expandEnv(value string) (string, error) {
+	var missing []string
+	expanded := os.Expand(value, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable(s) not set: %v", missing)
+	}
+	return expanded, nil
+}
@@ -0,0 +1,171 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// readMerged reads the configuration files at paths and deep-merges them in
+// order. A directory stands for the *.yaml and *.yml files in it, in name
+// order; http:// and https:// paths are fetched and files ending in .gz are
+// decompressed, see readConfigFile. Later files override earlier ones: mappings are merged key by key,
+// lists whose entries all have a name (metrics, sources) are merged entry by
+// entry on that name, and any other value, including other lists, is replaced.
+func readMerged(paths []string) (*yaml.Node, error) {
+	files, err := expandConfigPaths(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	var merged *yaml.Node
+	for _, file := range files {
+		data, err := readConfigFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", file, err)
+		}
+		if len(doc.Content) == 0 {
+			// An empty file changes nothing
+			continue
+		}
+
+		root := doc.Content[0]
+		if root.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("failed to parse config file %s: top level must be a mapping", file)
+		}
+		if merged == nil {
+			merged = root
+			continue
+		}
+		mergeNodes(merged, root)
+	}
+
+	if merged == nil {
+		return nil, fmt.Errorf("no configuration found in %s", strings.Join(paths, ", "))
+	}
+	return merged, nil
+}
+
+// expandConfigPaths replaces each directory in paths by the YAML files it
+// contains, compressed or not. URLs are kept as they are.
+func expandConfigPaths(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		if isConfigURL(path) {
+			files = append(files, path)
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config directory: %w", err)
+		}
+		var found []string
+		for _, entry := range entries {
+			ext := filepath.Ext(strings.TrimSuffix(entry.Name(), ".gz"))
+			if !entry.IsDir() && (ext == ".yaml" || ext == ".yml") {
+				found = append(found, filepath.Join(path, entry.Name()))
+			}
+		}
+		if len(found) == 0 {
+			return nil, fmt.Errorf("config directory %s contains no .yaml or .yml files (optionally .gz)", path)
+		}
+		sort.Strings(found)
+		files = append(files, found...)
+	}
+	return files, nil
+}
+
+// mergeNodes merges src into dst following the rules of readMerged
+func mergeNodes(dst, src *yaml.Node) {
+	switch {
+	case dst.Kind == yaml.MappingNode && src.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(src.Content); i += 2 {
+			key, value := src.Content[i], src.Content[i+1]
+			if existing := mappingValue(dst, key.Value); existing != nil {
+				mergeNodes(existing, value)
+			} else {
+				dst.Content = append(dst.Content, key, value)
+			}
+		}
+	case dst.Kind == yaml.SequenceNode && src.Kind == yaml.SequenceNode && namedEntries(dst) && namedEntries(src):
+		for _, entry := range src.Content {
+			name := mappingValue(entry, "name").Value
+			if existing := namedEntry(dst, name); existing != nil {
+				mergeNodes(existing, entry)
+			} else {
+				dst.Content = append(dst.Content, entry)
+			}
+		}
+	default:
+		*dst = *src
+	}
+}
+
+// mappingValue returns the value of key in a mapping node, or nil
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// namedEntries reports whether every entry of a sequence is a mapping with a scalar name
+func namedEntries(seq *yaml.Node) bool {
+	for _, entry := range seq.Content {
+		if entry.Kind != yaml.MappingNode {
+			return false
+		}
+		name := mappingValue(entry, "name")
+		if name == nil || name.Kind != yaml.ScalarNode {
+			return false
+		}
+	}
+	return true
+}
+
+// namedEntry returns the entry of a sequence of named mappings with the given name, or nil
+func namedEntry(seq *yaml.Node, name string) *yaml.Node {
+	for _, entry := range seq.Content {
+		if mappingValue(entry, "name").Value == name {
+			return entry
+		}
+	}
+	return nil
+}
+
+// readMetricsFile reads the list of extra metric entries in path
+func readMetricsFile(path string) ([]MetricConfig, error) {
+	data, err := readConfigFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("metrics file: %w", err)
+	}
+
+	var metrics []MetricConfig
+	if err := yaml.Unmarshal(data, &metrics); err != nil {
+		return nil, fmt.Errorf("failed to parse metrics file %s: %w", path, err)
+	}
+	if len(metrics) == 0 {
+		return nil, fmt.Errorf("metrics file %s lists no metrics", path)
+	}
+	return metrics, nil
+}
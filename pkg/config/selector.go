@@ -0,0 +1,141 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MatchType mirrors the remote read LabelMatcher.Type enum
+type MatchType int
+
+const (
+	MatchEqual MatchType = iota
+	MatchNotEqual
+	MatchRegexp
+	MatchNotRegexp
+)
+
+// LabelMatcher is a single label matcher of a series selector
+type LabelMatcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+}
+
+// ParseSelector parses a plain PromQL series selector such as
+// `metric_name{label="value", other=~"re.*"}` into label matchers.
+// Functions, aggregations and range selectors are rejected since remote read
+// only returns raw series.
+func ParseSelector(selector string) ([]LabelMatcher, error) {
+	s := strings.TrimSpace(selector)
+	var matchers []LabelMatcher
+
+	name, rest := consumeIdentifier(s, true)
+	if name != "" {
+		matchers = append(matchers, LabelMatcher{Type: MatchEqual, Name: "__name__", Value: name})
+	}
+	rest = strings.TrimSpace(rest)
+
+	if strings.HasPrefix(rest, "{") {
+		rest = strings.TrimSpace(rest[1:])
+		for !strings.HasPrefix(rest, "}") {
+			var m LabelMatcher
+			var err error
+			m, rest, err = consumeMatcher(rest)
+			if err != nil {
+				return nil, fmt.Errorf("invalid selector %q: %w", selector, err)
+			}
+			matchers = append(matchers, m)
+
+			rest = strings.TrimSpace(rest)
+			if strings.HasPrefix(rest, ",") {
+				rest = strings.TrimSpace(rest[1:])
+			} else if !strings.HasPrefix(rest, "}") {
+				return nil, fmt.Errorf("invalid selector %q: expected ',' or '}'", selector)
+			}
+		}
+		rest = strings.TrimSpace(rest[1:])
+	}
+
+	if rest != "" {
+		return nil, fmt.Errorf("remote_read mode requires a plain series selector, got %q", selector)
+	}
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("selector %q has no matchers", selector)
+	}
+
+	return matchers, nil
+}
+
+// consumeMatcher parses `name op "value"` from the start of s
+func consumeMatcher(s string) (LabelMatcher, string, error) {
+	name, rest := consumeIdentifier(s, false)
+	if name == "" {
+		return LabelMatcher{}, "", fmt.Errorf("expected label name at %q", s)
+	}
+	rest = strings.TrimSpace(rest)
+
+	var m LabelMatcher
+	m.Name = name
+	switch {
+	case strings.HasPrefix(rest, "=~"):
+		m.Type, rest = MatchRegexp, rest[2:]
+	case strings.HasPrefix(rest, "!~"):
+		m.Type, rest = MatchNotRegexp, rest[2:]
+	case strings.HasPrefix(rest, "!="):
+		m.Type, rest = MatchNotEqual, rest[2:]
+	case strings.HasPrefix(rest, "="):
+		m.Type, rest = MatchEqual, rest[1:]
+	default:
+		return LabelMatcher{}, "", fmt.Errorf("expected match operator after label %s", name)
+	}
+	rest = strings.TrimSpace(rest)
+
+	value, rest, err := consumeString(rest)
+	if err != nil {
+		return LabelMatcher{}, "", fmt.Errorf("label %s: %w", name, err)
+	}
+	m.Value = value
+
+	return m, rest, nil
+}
+
+// consumeIdentifier reads a metric name (allowColon) or label name from the start of s
+func consumeIdentifier(s string, allowColon bool) (string, string) {
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		valid := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(i > 0 && c >= '0' && c <= '9') || (allowColon && c == ':')
+		if !valid {
+			break
+		}
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// consumeString reads a double-quoted or backtick-quoted string from the start of s
+func consumeString(s string) (string, string, error) {
+	if s == "" || (s[0] != '"' && s[0] != '`') {
+		return "", "", fmt.Errorf("expected quoted string")
+	}
+
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		if s[i] == '\\' && quote == '"' {
+			i++
+			continue
+		}
+		if s[i] == quote {
+			value, err := strconv.Unquote(s[:i+1])
+			if err != nil {
+				return "", "", fmt.Errorf("invalid string %s: %w", s[:i+1], err)
+			}
+			return value, s[i+1:], nil
+		}
+	}
+
+	return "", "", fmt.Errorf("unterminated string")
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// configFetchTimeout bounds fetching a configuration file from a URL,
+// including reading its body
+const configFetchTimeout = 30 * time.Second
+
+// maxConfigSize caps a fetched or decompressed configuration file, so a
+// misbehaving server or a corrupt archive cannot exhaust memory
+const maxConfigSize = 16 << 20
+
+// isConfigURL reports whether a configuration path is an http:// or https://
+// URL rather than a local file or directory
+func isConfigURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// isGzipConfig reports whether a configuration file is gzip-compressed, judged
+// by the .gz extension of its name or URL path
+func isGzipConfig(path string) bool {
+	if isConfigURL(path) {
+		if u, err := url.Parse(path); err == nil {
+			path = u.Path
+		}
+	}
+	return strings.HasSuffix(path, ".gz")
+}
+
+// readConfigFile returns the YAML of one configuration file: a local file or
+// a URL fetched with a GET request, decompressed when it ends in .gz
+func readConfigFile(path string) ([]byte, error) {
+	var data []byte
+	var err error
+	if isConfigURL(path) {
+		data, err = fetchConfig(path)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	if !isGzipConfig(path) {
+		return data, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress config file %s: %w", path, err)
+	}
+	defer zr.Close()
+	data, err = readLimited(zr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress config file %s: %w", path, err)
+	}
+	return data, nil
+}
+
+// fetchConfig downloads a configuration file within configFetchTimeout
+func fetchConfig(rawURL string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), configFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: unexpected status %s", redactURL(rawURL), resp.Status)
+	}
+	data, err := readLimited(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %w", redactURL(rawURL), err)
+	}
+	return data, nil
+}
+
+// readLimited reads r to the end, failing once it exceeds maxConfigSize
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxConfigSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxConfigSize {
+		return nil, fmt.Errorf("larger than %d bytes", maxConfigSize)
+	}
+	return data, nil
+}
+
+// redactURL hides the password of a URL's user info for error messages
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}